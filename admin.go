@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	adminDefaultPageSize = 100
+	adminMaxPageSize     = 1000
+)
+
+// adminTokens maps admin API bearer tokens to the name of their holder, which
+// is logged for every change made through the API.
+var adminTokens map[string]string
+
+// parseAdminTokens parses ADMIN_TOKENS, a comma-separated list of name:token
+// pairs.
+func parseAdminTokens(list string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, token, found := strings.Cut(entry, ":")
+		if !found || name == "" || token == "" {
+			return nil, fmt.Errorf("expected name:token, got %q", entry)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+// newAdminHandler returns the handler of the admin listener. Every request
+// needs one of the ADMIN_TOKENS as a bearer token.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", adminAuth(serveMetrics))
+	mux.HandleFunc("GET /sessions", adminAuth(listSessions))
+	mux.HandleFunc("DELETE /sessions/{app}", adminAuth(revokeSessions))
+	mux.HandleFunc("DELETE /sessions/{app}/{ip}", adminAuth(revokeSessions))
+	return mux
+}
+
+// adminAuth wraps an admin handler with bearer token authentication, passing
+// the caller's name on.
+func adminAuth(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(responseWriter http.ResponseWriter, request *http.Request) {
+		token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		caller := ""
+		if found {
+			// Compare against every token so timing doesn't reveal a prefix match
+			for candidate, name := range adminTokens {
+				if secretEqual(token, candidate) {
+					caller = name
+				}
+			}
+		}
+		if caller == "" {
+			warnf("Rejected admin API request from %s: missing or invalid token", request.RemoteAddr)
+			responseWriter.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(responseWriter, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(responseWriter, request, caller)
+	}
+}
+
+// sessionInfo describes one session in admin API responses.
+type sessionInfo struct {
+	IP         string `json:"ip,omitempty"`
+	SessionID  string `json:"session_id,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+	// Empty for sessions stored as plain strings by older versions
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type sessionList struct {
+	App string `json:"app"`
+	// Sessions of a session group are shared by all its apps
+	Group    string        `json:"group,omitempty"`
+	Sessions []sessionInfo `json:"sessions"`
+	// Pass as cursor to get the next page; "0" once all sessions were listed
+	NextCursor string `json:"next_cursor"`
+}
+
+// listSessions answers GET /sessions?app=<hostname>, paginated through the
+// app's session index with the cursor and count parameters.
+func listSessions(responseWriter http.ResponseWriter, request *http.Request, caller string) {
+	query := request.URL.Query()
+	app, exists := lookupApp(currentApps(), query.Get("app"))
+	if !exists {
+		http.Error(responseWriter, "Unknown app", http.StatusNotFound)
+		return
+	}
+	cursor, err := strconv.ParseUint(defaultString(query.Get("cursor"), "0"), 10, 64)
+	if err != nil {
+		http.Error(responseWriter, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.Atoi(defaultString(query.Get("count"), strconv.Itoa(adminDefaultPageSize)))
+	if err != nil || count < 1 || count > adminMaxPageSize {
+		http.Error(responseWriter, fmt.Sprintf("Invalid count (1-%d)", adminMaxPageSize), http.StatusBadRequest)
+		return
+	}
+
+	stored, nextCursor, err := sessionStore.List(request.Context(), app, cursor, count)
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		http.Error(responseWriter, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	sessions := describeSessions(app, stored)
+	app.debugf("Admin %s listed %d sessions", caller, len(sessions))
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(responseWriter).Encode(sessionList{
+		App:        app.Hostname,
+		Group:      app.SessionGroup,
+		Sessions:   sessions,
+		NextCursor: strconv.FormatUint(nextCursor, 10),
+	})
+}
+
+// describeSessions converts stored sessions for admin API responses.
+func describeSessions(app *AppConfig, stored []storedSession) []sessionInfo {
+	sessions := make([]sessionInfo, 0, len(stored))
+	for _, session := range stored {
+		info := sessionInfo{TTLSeconds: int64(session.ttl.Seconds()), Metadata: session.metadata}
+		if session.ttl < 0 {
+			info.TTLSeconds = -1
+		}
+		if ip, found := strings.CutPrefix(session.key, ipSessionKey(app, "")); found {
+			info.IP = ip
+		} else {
+			info.SessionID = strings.TrimPrefix(session.key, sessionIDKey(app, ""))
+		}
+		sessions = append(sessions, info)
+	}
+	return sessions
+}
+
+// revokeSessions answers DELETE /sessions/{app}/{ip}, ending every session
+// of the IP, and DELETE /sessions/{app}, ending all sessions of the app. For
+// apps in a session group, this ends the sessions on all its apps.
+func revokeSessions(responseWriter http.ResponseWriter, request *http.Request, caller string) {
+	app, exists := lookupApp(currentApps(), request.PathValue("app"))
+	if !exists {
+		http.Error(responseWriter, "Unknown app", http.StatusNotFound)
+		return
+	}
+	ip := request.PathValue("ip")
+	if ip != "" {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			http.Error(responseWriter, "Invalid IP", http.StatusBadRequest)
+			return
+		}
+		ip = addr.WithZone("").Unmap().String()
+	}
+
+	revoked, err := endSessions(request.Context(), app, ip)
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		http.Error(responseWriter, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	target := "all clients"
+	if ip != "" {
+		target = ip
+	}
+	if app.SessionGroup != "" {
+		target += " in session group " + app.SessionGroup
+	}
+	app.warnf("Admin %s (%s) revoked %d sessions of %s", caller, request.RemoteAddr, revoked, target)
+	app.metrics.activeSessions.Add(-int64(revoked))
+	publishEvent(app, eventRevoke, ip, request.URL.Path)
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(map[string]any{"app": app.Hostname, "revoked": revoked})
+}
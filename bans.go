@@ -0,0 +1,74 @@
+package main
+
+import "context"
+
+// isBanned reports whether ip is temporarily banned from app. Redis errors are
+// logged and treated as not banned so the regular session checks still apply.
+func isBanned(ctx context.Context, app *AppConfig, ip string) bool {
+	if app.BanThreshold == 0 {
+		return false
+	}
+	key := banKey(app, ip)
+	if banned, found := denials.get(key); found && banned {
+		app.metrics.denialCacheHits.Add(1)
+		return true
+	}
+	if denials != nil {
+		app.metrics.denialCacheMisses.Add(1)
+	}
+	banned, err := redisClient.Exists(ctx, key).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return false
+	}
+	if banned > 0 {
+		denials.put(key, true)
+	}
+	return banned > 0
+}
+
+// recordFailedAttempt counts a denied request from ip toward the app's knock
+// failure limit and bans ip once the app's threshold is reached within the ban
+// window.
+func recordFailedAttempt(ctx context.Context, app *AppConfig, ip string) {
+	countKnockFailure(ctx, app)
+	if app.BanThreshold == 0 {
+		return
+	}
+
+	failKey := failedAttemptsKey(app, ip)
+	failures, err := redisClient.Incr(ctx, failKey).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return
+	}
+	if failures == 1 {
+		_ = redisClient.Expire(ctx, failKey, app.BanWindow).Err()
+	}
+	if failures < int64(app.BanThreshold) {
+		return
+	}
+
+	if err := redisClient.Set(ctx, banKey(app, ip), "1", app.BanDuration).Err(); err != nil {
+		app.errorf("Redis error: %v", err)
+		return
+	}
+	_ = redisClient.Del(ctx, failKey).Err()
+	app.warnf("Banned %s for %s after %d denied requests within %s", ip, app.BanDuration, failures, app.BanWindow)
+}
+
+// clearFailedAttempts resets the failure counter after a successful knock.
+func clearFailedAttempts(ctx context.Context, app *AppConfig, ip string) {
+	if app.BanThreshold == 0 {
+		return
+	}
+	_ = redisClient.Del(ctx, failedAttemptsKey(app, ip)).Err()
+}
+
+func failedAttemptsKey(app *AppConfig, ip string) string {
+	return appKey(app, "fail:%s", ip)
+}
+
+func banKey(app *AppConfig, ip string) string {
+	return appKey(app, "ban:%s", ip)
+}
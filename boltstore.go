@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	bberrors "go.etcd.io/bbolt/errors"
+	"time"
+)
+
+// The bucket holding all sessions, keyed like in Redis
+var boltSessionsBucket = []byte("sessions")
+
+// boltStore keeps sessions in a bbolt database file, for single instances
+// without Redis that must keep their sessions across restarts. bbolt locks
+// the file, so only one process can use it at a time.
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// boltSession is how a memorySession is stored in the database file.
+type boltSession struct {
+	Metadata map[string]string `json:"metadata"`
+	// Unix milliseconds; 0 for sessions without expiry
+	Expires int64 `json:"expires,omitempty"`
+	Granted int64 `json:"granted"`
+	Indexed bool  `json:"indexed,omitempty"`
+}
+
+// openBoltStore opens, or creates, the database file at path. It fails if the
+// file isn't writable or another process holds it.
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if errors.Is(err, bberrors.ErrTimeout) {
+		return nil, fmt.Errorf("%v (is another process using it?)", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	store := &boltStore{db: db}
+	go store.sweep()
+	return store, nil
+}
+
+func (s *boltStore) sweep() {
+	for range time.Tick(memorySweepInterval) {
+		now := time.Now()
+		err := s.db.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket(boltSessionsBucket)
+			var expired [][]byte
+			err := bucket.ForEach(func(key, value []byte) error {
+				if session, err := decodeBoltSession(value); err != nil || session.expired(now) {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range expired {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			errorf("Session store error dropping expired sessions: %v", err)
+		}
+	}
+}
+
+func decodeBoltSession(value []byte) (*memorySession, error) {
+	var stored boltSession
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, err
+	}
+	session := &memorySession{metadata: stored.Metadata, granted: time.UnixMilli(stored.Granted), indexed: stored.Indexed}
+	if session.metadata == nil {
+		session.metadata = make(map[string]string)
+	}
+	if stored.Expires != 0 {
+		session.expires = time.UnixMilli(stored.Expires)
+	}
+	return session, nil
+}
+
+func putBoltSession(bucket *bbolt.Bucket, key string, session *memorySession) error {
+	stored := boltSession{Metadata: session.metadata, Granted: session.granted.UnixMilli(), Indexed: session.indexed}
+	if !session.expires.IsZero() {
+		stored.Expires = session.expires.UnixMilli()
+	}
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+// lookupBoltSession returns the live session under key, or nil.
+func lookupBoltSession(bucket *bbolt.Bucket, key string, now time.Time) (*memorySession, error) {
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return nil, nil
+	}
+	session, err := decodeBoltSession(value)
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %v", key, err)
+	}
+	if session.expired(now) {
+		return nil, nil
+	}
+	return session, nil
+}
+
+func (s *boltStore) Exists(ctx context.Context, app *AppConfig, keys []string) ([]storedSession, error) {
+	now := time.Now()
+	sessions := make([]storedSession, len(keys))
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltSessionsBucket)
+		for i, key := range keys {
+			session, err := lookupBoltSession(bucket, key, now)
+			if err != nil {
+				return err
+			}
+			if session != nil {
+				sessions[i] = session.describe(app, key, now)
+			} else {
+				sessions[i] = storedSession{key: key}
+			}
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+func (s *boltStore) Grant(ctx context.Context, app *AppConfig, keys []string, metadata map[string]any, ttl time.Duration) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltSessionsBucket)
+		existing, err := lookupBoltSession(bucket, keys[0], now)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.granted.Unix() >= now.Unix() {
+			return errConcurrentGrant
+		}
+		for i, key := range keys {
+			if err := putBoltSession(bucket, key, newMemorySession(metadata, ttl, now, i == 0)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Renew(ctx context.Context, renewals []*renewal) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltSessionsBucket)
+		for _, queued := range renewals {
+			for _, key := range queued.keys {
+				session, err := lookupBoltSession(bucket, key, now)
+				if err != nil {
+					return err
+				}
+				if session == nil {
+					continue
+				}
+				session.renew(queued, now)
+				if err := putBoltSession(bucket, key, session); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Revoke(ctx context.Context, app *AppConfig, keys []string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltSessionsBucket)
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// List pages through the app's sessions in key order, with the cursor
+// counting the sessions already listed, like the memory store.
+func (s *boltStore) List(ctx context.Context, app *AppConfig, cursor uint64, count int) ([]storedSession, uint64, error) {
+	now := time.Now()
+	sessions := []storedSession{}
+	var next uint64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var listed uint64
+		return s.forEachIndexed(tx, app, now, func(key string, session *memorySession) bool {
+			if listed >= cursor {
+				if len(sessions) == count {
+					next = listed
+					return false
+				}
+				sessions = append(sessions, session.describe(app, key, now))
+			}
+			listed++
+			return true
+		})
+	})
+	return sessions, next, err
+}
+
+func (s *boltStore) Count(ctx context.Context, app *AppConfig) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return s.forEachIndexed(tx, app, time.Now(), func(string, *memorySession) bool {
+			count++
+			return true
+		})
+	})
+	return count, err
+}
+
+// forEachIndexed calls visit with the app's live indexed sessions in key
+// order, until it returns false.
+func (s *boltStore) forEachIndexed(tx *bbolt.Tx, app *AppConfig, now time.Time, visit func(string, *memorySession) bool) error {
+	prefix := []byte(sessionNamespace(app) + ":")
+	cursor := tx.Bucket(boltSessionsBucket).Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		session, err := decodeBoltSession(value)
+		if err != nil {
+			return fmt.Errorf("session %s: %v", key, err)
+		}
+		if !session.indexed || session.expired(now) {
+			continue
+		}
+		if !visit(string(key), session) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+// Returned for Redis commands while the circuit breaker is open
+var errCircuitOpen = errors.New("Redis circuit breaker open")
+
+// circuitBreaker fails Redis commands right away after threshold consecutive
+// connection failures or timeouts, instead of letting every request wait for
+// Redis to time out, until a background ping gets through again. The apps'
+// store_failure then decides what happens to requests. It is installed as a
+// go-redis hook, so it covers every command.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	failures  int
+	// Zero while closed
+	openedAt time.Time
+}
+
+// Set when REDIS_BREAKER_THRESHOLD isn't 0
+var redisBreaker *circuitBreaker
+
+// Marks the pings of the circuit breaker and the health monitor, which are
+// let through while they fail other commands
+type redisProbeKey struct{}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// isOpen reports whether Redis commands are currently being failed. A nil
+// breaker is always closed.
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openedAt.IsZero()
+}
+
+// allow reports whether a command may be sent to Redis.
+func (b *circuitBreaker) allow(ctx context.Context) bool {
+	return ctx.Value(redisProbeKey{}) != nil || !b.isOpen()
+}
+
+// record counts the outcome of a command sent to Redis. Replies, including
+// errors like WRONGTYPE, show Redis is working; only failing to get one
+// counts.
+func (b *circuitBreaker) record(err error) {
+	var reply redis.Error
+	failed := err != nil && !errors.As(err, &reply) && !errors.Is(err, context.Canceled)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < b.threshold || !b.openedAt.IsZero() {
+		return
+	}
+	b.openedAt = time.Now()
+	errorf("Redis circuit breaker open after %d consecutive failures (last: %v); failing Redis calls until a ping every %s gets through", b.failures, err, b.cooldown)
+	go b.probe()
+}
+
+// probe pings Redis every cooldown while the breaker is open and closes it
+// once Redis answers.
+func (b *circuitBreaker) probe() {
+	probeContext := context.WithValue(backgroundContext, redisProbeKey{}, true)
+	for {
+		time.Sleep(b.cooldown)
+		err := redisClient.Ping(probeContext).Err()
+		if err != nil {
+			debugf("Redis circuit breaker probe failed: %v", err)
+			continue
+		}
+		b.mu.Lock()
+		outage := time.Since(b.openedAt)
+		b.openedAt = time.Time{}
+		b.failures = 0
+		b.mu.Unlock()
+		infof("Redis circuit breaker closed: Redis is answering again after %s", outage.Round(time.Second))
+		return
+	}
+}
+
+func (b *circuitBreaker) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (b *circuitBreaker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !b.allow(ctx) {
+			cmd.SetErr(errCircuitOpen)
+			return errCircuitOpen
+		}
+		err := next(ctx, cmd)
+		if ctx.Value(redisProbeKey{}) == nil {
+			b.record(err)
+		}
+		return err
+	}
+}
+
+func (b *circuitBreaker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !b.allow(ctx) {
+			for _, cmd := range cmds {
+				cmd.SetErr(errCircuitOpen)
+			}
+			return errCircuitOpen
+		}
+		err := next(ctx, cmds)
+		if ctx.Value(redisProbeKey{}) == nil {
+			b.record(err)
+		}
+		return err
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configFile is a CONFIG_FILE: the apps, like in APPS_CONFIG, the defaults
+// of their settings, plus global settings that apply unless the environment
+// sets them.
+type configFile struct {
+	path     string
+	apps     []fileApp
+	defaults map[string]string
+	// By environment variable name
+	settings map[string]string
+}
+
+// fileApp is an entry of a config file's apps, with where each of its fields
+// is for errors; TOML files have no lines.
+type fileApp struct {
+	line   int
+	config map[string]string
+	lines  map[string]int
+}
+
+// Set for CONFIG_FILE
+var appsFile *configFile
+
+// loadConfigFile reads a config file in the format of its extension: YAML,
+// JSON, which is read as YAML, or TOML. Errors name the file and, but for
+// TOML, the line.
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch extension := strings.ToLower(filepath.Ext(path)); extension {
+	case ".yaml", ".yml", ".json":
+		return parseYAMLConfig(path, data)
+	case ".toml":
+		return parseTOMLConfig(path, data)
+	default:
+		return nil, fmt.Errorf("%s: unknown format %q (expected .yaml, .yml, .json or .toml)", path, extension)
+	}
+}
+
+func parseYAMLConfig(path string, data []byte) (*configFile, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	file := &configFile{path: path, settings: make(map[string]string)}
+	if len(document.Content) == 0 {
+		return file, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, file.errorf(root.Line, "expected a mapping with apps and global settings")
+	}
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch {
+		case key.Value == "apps":
+			if err := file.loadApps(value); err != nil {
+				return nil, err
+			}
+		case key.Value == "defaults":
+			if err := file.loadYAMLDefaults(value); err != nil {
+				return nil, err
+			}
+		case value.Kind == yaml.MappingNode:
+			for j := 0; j < len(value.Content); j += 2 {
+				if err := file.setYAMLSetting(key.Value+"."+value.Content[j].Value, value.Content[j+1]); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if err := file.setYAMLSetting(key.Value, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return file, nil
+}
+
+func (file *configFile) loadApps(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return file.errorf(node.Line, "apps must be a list")
+	}
+	for i, entry := range node.Content {
+		if entry.Kind != yaml.MappingNode {
+			return file.errorf(entry.Line, "apps[%d] must be a mapping", i)
+		}
+		app := fileApp{line: entry.Line, config: make(map[string]string), lines: make(map[string]int)}
+		for j := 0; j < len(entry.Content); j += 2 {
+			key, value := entry.Content[j], entry.Content[j+1]
+			flattened, err := flattenYAMLValue(value)
+			if err != nil {
+				return file.errorf(value.Line, "apps[%d].%s %v", i, key.Value, err)
+			}
+			app.config[key.Value] = flattened
+			app.lines[key.Value] = key.Line
+		}
+		file.apps = append(file.apps, app)
+	}
+	return nil
+}
+
+func (file *configFile) loadYAMLDefaults(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return file.errorf(node.Line, "defaults must be a mapping")
+	}
+	file.defaults = make(map[string]string)
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		flattened, err := flattenYAMLValue(value)
+		if err != nil {
+			return file.errorf(value.Line, "defaults.%s %v", key.Value, err)
+		}
+		if err := checkDefault(key.Value); err != nil {
+			return file.errorf(key.Line, "defaults: %v", err)
+		}
+		file.defaults[key.Value] = flattened
+	}
+	return nil
+}
+
+func (file *configFile) setYAMLSetting(key string, node *yaml.Node) error {
+	value, err := flattenYAMLValue(node)
+	if err != nil {
+		return file.errorf(node.Line, "%s %v", key, err)
+	}
+	return file.setSetting(key, value, node.Line)
+}
+
+// setSetting records the global setting under key as the environment
+// variable it stands for, with its variables expanded like the apps'. A
+// top-level key, or one of the server section, stands for the variable of the
+// same name, and a key of another section like redis the one prefixed with
+// it, e.g. redis: {address: ...} for REDIS_ADDRESS.
+func (file *configFile) setSetting(key, value string, line int) error {
+	name := strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(key, "server."), ".", "_"))
+	if !isFileSetting(name) {
+		return file.errorf(line, "unknown setting %s", key)
+	}
+	unresolved := make(map[string]bool)
+	expanded, err := expandValue(value, nil, unresolved)
+	if err == nil && len(unresolved) > 0 {
+		err = unresolvedError(unresolved)
+	}
+	if err != nil {
+		return file.errorf(line, "%s: %v", key, err)
+	}
+	file.settings[name] = expanded
+	return nil
+}
+
+// flattenYAMLValue converts a value into the string form parseAppConfig and
+// the environment variables use, like appConfigInput's settings: lists are joined
+// with commas.
+func flattenYAMLValue(node *yaml.Node) (string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return "", nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("must be a string or a list of strings")
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return "", fmt.Errorf("must be a string or a list of strings")
+	}
+}
+
+// parseTOMLConfig reads a TOML config file, with the apps as [[apps]] tables
+// and the global settings in [server] and [redis] sections.
+func parseTOMLConfig(path string, data []byte) (*configFile, error) {
+	var document map[string]any
+	if err := toml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	file := &configFile{path: path, settings: make(map[string]string)}
+	// In order, so the first of several errors is always the one reported
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch value := document[key].(type) {
+		case []map[string]any:
+			if key != "apps" {
+				return nil, file.errorf(0, "unknown setting %s", key)
+			}
+			for i, entry := range value {
+				app := fileApp{config: make(map[string]string)}
+				for field, fieldValue := range entry {
+					flattened, err := flattenTOMLValue(fieldValue)
+					if err != nil {
+						return nil, file.errorf(0, "apps[%d].%s %v", i, field, err)
+					}
+					app.config[field] = flattened
+				}
+				file.apps = append(file.apps, app)
+			}
+		case map[string]any:
+			if key == "defaults" {
+				file.defaults = make(map[string]string)
+				for name, defaultValue := range value {
+					flattened, err := flattenTOMLValue(defaultValue)
+					if err != nil {
+						return nil, file.errorf(0, "defaults.%s %v", name, err)
+					}
+					file.defaults[name] = flattened
+				}
+				if err := checkDefaults(file.defaults); err != nil {
+					return nil, file.errorf(0, "defaults: %v", err)
+				}
+				continue
+			}
+			for name, settingValue := range value {
+				flattened, err := flattenTOMLValue(settingValue)
+				if err != nil {
+					return nil, file.errorf(0, "%s.%s %v", key, name, err)
+				}
+				if err := file.setSetting(key+"."+name, flattened, 0); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			flattened, err := flattenTOMLValue(value)
+			if err != nil {
+				return nil, file.errorf(0, "%s %v", key, err)
+			}
+			if err := file.setSetting(key, flattened, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return file, nil
+}
+
+// flattenTOMLValue converts a value into the string form parseAppConfig and
+// the environment variables use, like flattenYAMLValue.
+func flattenTOMLValue(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case int64, float64, bool:
+		return fmt.Sprint(value), nil
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			flattened, err := flattenTOMLValue(item)
+			if _, nested := item.([]any); err != nil || nested {
+				return "", fmt.Errorf("must be a string or a list of strings")
+			}
+			values = append(values, flattened)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return "", fmt.Errorf("must be a string or a list of strings")
+	}
+}
+
+// setting returns the global setting under its environment variable name. A
+// nil file has none.
+func (file *configFile) setting(name string) (string, bool) {
+	if file == nil {
+		return "", false
+	}
+	value, found := file.settings[name]
+	return value, found
+}
+
+func (file *configFile) errorf(line int, format string, args ...any) error {
+	if line == 0 {
+		return fmt.Errorf("%s: %s", file.path, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s:%d: %s", file.path, line, fmt.Sprintf(format, args...))
+}
+
+// loadAppsFromFile parses the config file's apps. Errors point at the field
+// they are about when it can be told, else at the app.
+func loadAppsFromFile(file *configFile, defaults map[string]string, apps map[string]*AppConfig) error {
+	entries := make(map[string]string)
+	for i, entry := range file.apps {
+		app, err := reuseOrParseApp(withDefaults(entry.config, defaults))
+		if err == nil {
+			name := fmt.Sprintf("apps[%d]", i)
+			if entry.line > 0 {
+				name += fmt.Sprintf(" at line %d", entry.line)
+			}
+			err = addApp(apps, app, name, entries)
+		}
+		if err != nil {
+			return file.errorf(entry.fieldLine(err), "apps[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// fieldLine returns the line of the field err is about, going by
+// parseAppConfig's messages starting with the field, "invalid <field>" or
+// unknown field "<field>".
+func (entry fileApp) fieldLine(err error) int {
+	message := strings.TrimPrefix(strings.TrimPrefix(err.Error(), "invalid "), `unknown field "`)
+	line, length := entry.line, 0
+	for field, fieldLine := range entry.lines {
+		if len(field) > length && strings.HasPrefix(message, field) {
+			line, length = fieldLine, len(field)
+		}
+	}
+	return line
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// What every file of examples/ holds
+var exampleConfig = struct {
+	settings map[string]string
+	apps     []map[string]string
+}{
+	settings: map[string]string{"LISTEN_ADDRESS": ":8080", "LOG_LEVEL": "info", "REDIS_ADDRESS": "redis:6379", "REDIS_OP_TIMEOUT": "1s"},
+	apps: []map[string]string{
+		{
+			"hostname":     "immich.example.com",
+			"secret_path":  "/13b84d2a-faff-4b02-bef0-9f7898252659",
+			"upstream_url": "http://immich:2283",
+			"allow_ips":    "192.168.1.100,10.0.0.0/8",
+			"session_ttl":  "24h",
+			"auto_renew":   "true",
+		},
+		{
+			"hostname":     "nextcloud.example.com",
+			"secret_path":  "/a1b2c3d4-e5f6-7890-abcd-ef1234567890,/backup-secret",
+			"upstream_url": "http://nextcloud:80",
+			"session_ttl":  "1h",
+			"auto_renew":   "false",
+			"max_sessions": "20",
+		},
+	},
+}
+
+func TestLoadConfigFileExamples(t *testing.T) {
+	for _, name := range []string{"mithrandir.yaml", "mithrandir.json", "mithrandir.toml"} {
+		t.Run(name, func(t *testing.T) {
+			file, err := loadConfigFile(filepath.Join("examples", name))
+			if err != nil {
+				t.Fatalf("loadConfigFile: %v", err)
+			}
+			if !maps.Equal(file.settings, exampleConfig.settings) {
+				t.Errorf("settings = %v, want %v", file.settings, exampleConfig.settings)
+			}
+			var apps []map[string]string
+			for _, entry := range file.apps {
+				apps = append(apps, entry.config)
+			}
+			if !reflect.DeepEqual(apps, exampleConfig.apps) {
+				t.Errorf("apps = %v, want %v", apps, exampleConfig.apps)
+			}
+
+			loaded := make(map[string]*AppConfig)
+			if err := loadAppsFromFile(file, nil, loaded); err != nil {
+				t.Fatalf("loadAppsFromFile: %v", err)
+			}
+			if app := loaded["nextcloud.example.com"]; app == nil || len(app.SecretPathPrefixes) != 2 || app.MaxSessions != 20 {
+				t.Errorf("nextcloud.example.com loaded as %+v", app)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// appConfigInput is an app of APPS_CONFIG or CONFIG_REDIS_KEY. It is decoded
+// with unknown fields disallowed, so a misspelt setting is an error rather
+// than silently left at its default. Values are kept as they are in the JSON
+// and converted by settings, which knows their names for errors. Secret
+// settings are tagged with how they are masked when printed, see
+// redactValue. In alphabetical order.
+type appConfigInput struct {
+	Aliases                       *json.RawMessage `json:"aliases"`
+	AllowASNs                     *json.RawMessage `json:"allow_asns"`
+	AllowCountries                *json.RawMessage `json:"allow_countries"`
+	AllowIPs                      *json.RawMessage `json:"allow_ips"`
+	AllowPrivate                  *json.RawMessage `json:"allow_private"`
+	AllowedEmails                 *json.RawMessage `json:"allowed_emails"`
+	AutoRenew                     *json.RawMessage `json:"auto_renew"`
+	BanDuration                   *json.RawMessage `json:"ban_duration"`
+	BanThreshold                  *json.RawMessage `json:"ban_threshold"`
+	BanWindow                     *json.RawMessage `json:"ban_window"`
+	BindUserAgent                 *json.RawMessage `json:"bind_user_agent"`
+	BlockIPs                      *json.RawMessage `json:"block_ips"`
+	BrowserRegex                  *json.RawMessage `json:"browser_regex"`
+	ConfirmKnock                  *json.RawMessage `json:"confirm_knock"`
+	ConfirmKnockBrowsersOnly      *json.RawMessage `json:"confirm_knock_browsers_only"`
+	DenyContact                   *json.RawMessage `json:"deny_contact"`
+	DenyCountries                 *json.RawMessage `json:"deny_countries"`
+	DenyDelay                     *json.RawMessage `json:"deny_delay"`
+	DenyPage                      *json.RawMessage `json:"deny_page"`
+	DenyRedirectURL               *json.RawMessage `json:"deny_redirect_url" redact:"url"`
+	DenyStatus                    *json.RawMessage `json:"deny_status"`
+	EmailLinkTTL                  *json.RawMessage `json:"email_link_ttl"`
+	EmailPath                     *json.RawMessage `json:"email_path"`
+	ErrorPage                     *json.RawMessage `json:"error_page"`
+	ExposeSessionTTL              *json.RawMessage `json:"expose_session_ttl"`
+	ForwardedHeaders              *json.RawMessage `json:"forwarded_headers"`
+	GeoIPUnknown                  *json.RawMessage `json:"geoip_unknown"`
+	GrantWebhookURL               *json.RawMessage `json:"grant_webhook_url" redact:"url"`
+	Hostname                      *json.RawMessage `json:"hostname"`
+	IPFromHeaders                 *json.RawMessage `json:"ip_from_headers"`
+	IPHeaders                     *json.RawMessage `json:"ip_headers"`
+	KnockHeader                   *json.RawMessage `json:"knock_header"`
+	KnockPassphrase               *json.RawMessage `json:"knock_passphrase" redact:"secret"`
+	KnockToken                    *json.RawMessage `json:"knock_token" redact:"secret"`
+	KnockUserAgentRegex           *json.RawMessage `json:"knock_user_agent_regex"`
+	LogLevel                      *json.RawMessage `json:"log_level"`
+	LogoutPath                    *json.RawMessage `json:"logout_path"`
+	MaxFailuresPerMinute          *json.RawMessage `json:"max_failures_per_minute"`
+	MaxGrantsPerMinute            *json.RawMessage `json:"max_grants_per_minute"`
+	MaxSessionAge                 *json.RawMessage `json:"max_session_age"`
+	MaxSessions                   *json.RawMessage `json:"max_sessions"`
+	OncePath                      *json.RawMessage `json:"once_path"`
+	PostKnockRedirect             *json.RawMessage `json:"post_knock_redirect"`
+	PreauthorizedIPs              *json.RawMessage `json:"preauthorized_ips"`
+	ProtectedPaths                *json.RawMessage `json:"protected_paths"`
+	PublicPaths                   *json.RawMessage `json:"public_paths"`
+	RateLimit                     *json.RawMessage `json:"rate_limit"`
+	RedirectAndroid               *json.RawMessage `json:"redirect_android"`
+	RenewFraction                 *json.RawMessage `json:"renew_fraction"`
+	RequestHeaders                *json.RawMessage `json:"request_headers" redact:"secret"`
+	RotationInterval              *json.RawMessage `json:"rotation_interval"`
+	RotationOverlap               *json.RawMessage `json:"rotation_overlap"`
+	RotationSeed                  *json.RawMessage `json:"rotation_seed" redact:"secret"`
+	SecretPath                    *json.RawMessage `json:"secret_path" redact:"secret"`
+	SecretPathMatch               *json.RawMessage `json:"secret_path_match"`
+	SecretQuery                   *json.RawMessage `json:"secret_query" redact:"secret"`
+	SessionGroup                  *json.RawMessage `json:"session_group"`
+	SessionIPv4Prefix             *json.RawMessage `json:"session_ipv4_prefix"`
+	SessionIPv6Prefix             *json.RawMessage `json:"session_ipv6_prefix"`
+	SessionMode                   *json.RawMessage `json:"session_mode"`
+	SessionTTL                    *json.RawMessage `json:"session_ttl"`
+	ShareSessions                 *json.RawMessage `json:"share_sessions"`
+	SignedPath                    *json.RawMessage `json:"signed_path"`
+	SigningKey                    *json.RawMessage `json:"signing_key" redact:"secret"`
+	StoreFailure                  *json.RawMessage `json:"store_failure"`
+	StoreFailureGrace             *json.RawMessage `json:"store_failure_grace"`
+	StripSecretPath               *json.RawMessage `json:"strip_secret_path"`
+	TOTPRejectReplay              *json.RawMessage `json:"totp_reject_replay"`
+	TOTPSecret                    *json.RawMessage `json:"totp_secret" redact:"secret"`
+	TrustedHops                   *json.RawMessage `json:"trusted_hops"`
+	TrustedProxies                *json.RawMessage `json:"trusted_proxies"`
+	UpstreamDialTimeout           *json.RawMessage `json:"upstream_dial_timeout"`
+	UpstreamHost                  *json.RawMessage `json:"upstream_host"`
+	UpstreamHTTP2                 *json.RawMessage `json:"upstream_http2"`
+	UpstreamIdleConnTimeout       *json.RawMessage `json:"upstream_idle_conn_timeout"`
+	UpstreamMaxConnsPerHost       *json.RawMessage `json:"upstream_max_conns_per_host"`
+	UpstreamMaxIdleConns          *json.RawMessage `json:"upstream_max_idle_conns"`
+	UpstreamMaxIdleConnsPerHost   *json.RawMessage `json:"upstream_max_idle_conns_per_host"`
+	UpstreamResponseHeaderTimeout *json.RawMessage `json:"upstream_response_header_timeout"`
+	UpstreamTimeout               *json.RawMessage `json:"upstream_timeout"`
+	UpstreamTLSCAFile             *json.RawMessage `json:"upstream_tls_ca_file"`
+	UpstreamTLSCertFile           *json.RawMessage `json:"upstream_tls_cert_file"`
+	UpstreamTLSHandshakeTimeout   *json.RawMessage `json:"upstream_tls_handshake_timeout"`
+	UpstreamTLSInsecureSkipVerify *json.RawMessage `json:"upstream_tls_insecure_skip_verify"`
+	UpstreamTLSKeyFile            *json.RawMessage `json:"upstream_tls_key_file"`
+	UpstreamURL                   *json.RawMessage `json:"upstream_url" redact:"url"`
+}
+
+// appSettings are the names of the per-app settings, the JSON names of
+// appConfigInput's fields.
+var appSettings = func() []string {
+	var names []string
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[appConfigInput]()) {
+		names = append(names, field.Tag.Get("json"))
+	}
+	return names
+}()
+
+// decodeAppConfig decodes a JSON app config into the string map used by
+// parseAppConfig.
+func decodeAppConfig(raw json.RawMessage) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var input appConfigInput
+	if err := decoder.Decode(&input); err != nil {
+		// Like "unknown field \"sesion_ttl\""
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return input.settings()
+}
+
+// settings returns the settings present in the input in the string form the
+// environment variables use: strings as they are, numbers and booleans as
+// written, and arrays joined with commas. JSON nulls count as absent.
+func (input *appConfigInput) settings() (map[string]string, error) {
+	config := make(map[string]string)
+	fields := reflect.ValueOf(input).Elem()
+	for i, name := range appSettings {
+		raw, _ := fields.Field(i).Interface().(*json.RawMessage)
+		if raw == nil {
+			continue
+		}
+		value, err := flattenJSONValue(*raw, true)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a string, number, boolean or an array of them", name)
+		}
+		config[name] = value
+	}
+	return config, nil
+}
+
+// flattenJSONValue converts a string, number or boolean, or if list is set an
+// array of them, into its string form.
+func flattenJSONValue(raw json.RawMessage, list bool) (string, error) {
+	var text string
+	switch raw = bytes.TrimSpace(raw); {
+	case len(raw) == 0:
+		return "", fmt.Errorf("empty value")
+	case raw[0] == '"':
+		err := json.Unmarshal(raw, &text)
+		return text, err
+	case raw[0] == '[' && list:
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return "", err
+		}
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			value, err := flattenJSONValue(item, false)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	case raw[0] == 't' || raw[0] == 'f' || raw[0] == '-' || raw[0] >= '0' && raw[0] <= '9':
+		// Numbers and booleans as written, e.g. 0.25 or true
+		return string(raw), nil
+	default:
+		return "", fmt.Errorf("unexpected %s", raw)
+	}
+}
+
+// checkUnknownSettings reports the keys of an app config that aren't
+// settings all at once, like decodeAppConfig does for JSON, for the loaders
+// without a schema of their own.
+func checkUnknownSettings(config map[string]string) error {
+	var unknown []string
+	for key := range config {
+		if !slices.Contains(appSettings, key) {
+			unknown = append(unknown, strconv.Quote(key))
+		}
+	}
+	slices.Sort(unknown)
+	switch len(unknown) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("unknown field %s", unknown[0])
+	default:
+		return fmt.Errorf("unknown fields %s", strings.Join(unknown, ", "))
+	}
+}
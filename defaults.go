@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Settings that can't have a default, as each app needs its own
+var perAppOnlySettings = []string{"hostname", "aliases"}
+
+// appDefaults returns the settings every app gets unless it sets them
+// itself: those of the config file's defaults, then of the JSON's defaults
+// block, if any, then of the APP_DEFAULT_* variables, each overriding the
+// ones before, like the environment overrides the config file.
+func appDefaults(file *configFile, block map[string]string) (map[string]string, error) {
+	defaults := make(map[string]string)
+	if file != nil {
+		maps.Copy(defaults, file.defaults)
+	}
+	maps.Copy(defaults, block)
+
+	var variables []string
+	for _, variable := range os.Environ() {
+		if variable, found := strings.CutPrefix(variable, "APP_DEFAULT_"); found {
+			variables = append(variables, variable)
+		}
+	}
+	sort.Strings(variables)
+	for _, variable := range variables {
+		name, value, _ := strings.Cut(variable, "=")
+		setting := strings.ToLower(name)
+		if base, found := strings.CutSuffix(setting, "_file"); found && !slices.Contains(appSettings, setting) && slices.Contains(appSettings, base) {
+			// Read by loadSecretFiles into the variable it names
+			continue
+		}
+		if err := checkDefault(setting); err != nil {
+			return nil, fmt.Errorf("APP_DEFAULT_%s: %v", name, err)
+		}
+		defaults[setting] = value
+	}
+	return defaults, nil
+}
+
+// checkDefault reports why a setting can't have a default, if it can't.
+func checkDefault(setting string) error {
+	if slices.Contains(perAppOnlySettings, setting) {
+		return fmt.Errorf("%s can't have a default", setting)
+	}
+	return checkUnknownSettings(map[string]string{setting: ""})
+}
+
+// checkDefaults checks each setting of a defaults block, in order.
+func checkDefaults(defaults map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(defaults)) {
+		if err := checkDefault(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withDefaults returns the app config with the defaults it doesn't set
+// itself. A setting the app has, even empty, replaces the default as a
+// whole: lists like allow_ips aren't appended to.
+func withDefaults(config, defaults map[string]string) map[string]string {
+	if len(defaults) == 0 {
+		return config
+	}
+	merged := maps.Clone(defaults)
+	maps.Copy(merged, config)
+	return merged
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppDefaultsSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ttl")
+	if err := os.WriteFile(path, []byte("2h\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APP_DEFAULT_SESSION_TTL_FILE", path)
+	t.Setenv("APP_DEFAULT_UPSTREAM_TLS_CA_FILE", "/etc/ssl/ca.pem")
+	os.Unsetenv("APP_DEFAULT_SESSION_TTL")
+	t.Cleanup(func() { os.Unsetenv("APP_DEFAULT_SESSION_TTL") })
+	if err := loadSecretFiles(); err != nil {
+		t.Fatalf("loadSecretFiles: %v", err)
+	}
+
+	defaults, err := appDefaults(nil, nil)
+	if err != nil {
+		t.Fatalf("appDefaults: %v", err)
+	}
+	if defaults["session_ttl"] != "2h" {
+		t.Errorf("session_ttl = %q, want 2h from the file", defaults["session_ttl"])
+	}
+	// A setting of its own, not the file of upstream_tls_ca
+	if defaults["upstream_tls_ca_file"] != "/etc/ssl/ca.pem" {
+		t.Errorf("upstream_tls_ca_file = %q, want /etc/ssl/ca.pem", defaults["upstream_tls_ca_file"])
+	}
+	if _, found := defaults["session_ttl_file"]; found {
+		t.Errorf("session_ttl_file is a default")
+	}
+}
+
+func TestAppDefaultsUnknownSetting(t *testing.T) {
+	t.Setenv("APP_DEFAULT_SESION_TTL_FILE", "/tmp/ttl")
+	if _, err := appDefaults(nil, nil); err == nil {
+		t.Errorf("appDefaults accepted APP_DEFAULT_SESION_TTL_FILE")
+	}
+}
+
+func TestAppDefaultsEveryField(t *testing.T) {
+	dir := t.TempDir()
+	for _, setting := range appSettings {
+		variable := "APP_DEFAULT_" + strings.ToUpper(setting)
+		if slices.Contains(perAppOnlySettings, setting) {
+			t.Setenv(variable, "x")
+			if _, err := appDefaults(nil, nil); err == nil {
+				t.Errorf("%s is accepted", variable)
+			}
+			os.Unsetenv(variable)
+			continue
+		}
+		value := "default of " + setting
+		if strings.HasSuffix(setting, "_file") {
+			// Its own setting, not a secret file
+			t.Setenv(variable, value)
+		} else {
+			path := filepath.Join(dir, setting)
+			if err := os.WriteFile(path, []byte(value+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(variable+"_FILE", path)
+			os.Unsetenv(variable)
+			t.Cleanup(func() { os.Unsetenv(variable) })
+		}
+	}
+	if err := loadSecretFiles(); err != nil {
+		t.Fatalf("loadSecretFiles: %v", err)
+	}
+	defaults, err := appDefaults(nil, nil)
+	if err != nil {
+		t.Fatalf("appDefaults: %v", err)
+	}
+
+	for _, setting := range appSettings {
+		if slices.Contains(perAppOnlySettings, setting) {
+			continue
+		}
+		want := "default of " + setting
+		if defaults[setting] != want {
+			t.Errorf("default %s = %q, want %q", setting, defaults[setting], want)
+		}
+		merged := withDefaults(map[string]string{"hostname": "app.example.com"}, defaults)
+		if merged[setting] != want {
+			t.Errorf("app without %s got %q, want the default", setting, merged[setting])
+		}
+		merged = withDefaults(map[string]string{"hostname": "app.example.com", setting: "own"}, defaults)
+		if merged[setting] != "own" {
+			t.Errorf("app with its own %s got %q", setting, merged[setting])
+		}
+		// Even empty, the app's wins
+		merged = withDefaults(map[string]string{"hostname": "app.example.com", setting: ""}, defaults)
+		if merged[setting] != "" {
+			t.Errorf("app with an empty %s got %q", setting, merged[setting])
+		}
+	}
+}
+
+func TestWithDefaultsListsOverride(t *testing.T) {
+	defaults := map[string]string{"allow_ips": "10.0.0.0/8,192.168.0.0/16", "session_ttl": "30m", "auto_renew": "true"}
+	config := withDefaults(map[string]string{
+		"hostname":     "app.example.com",
+		"secret_path":  "/knock-knock-1234",
+		"upstream_url": "http://app:3000",
+		"allow_ips":    "203.0.113.7",
+	}, defaults)
+	app, err := parseAppConfig(config)
+	if err != nil {
+		t.Fatalf("parseAppConfig: %v", err)
+	}
+	if len(app.AllowIPs) != 1 || app.AllowIPs[0].pattern != "203.0.113.7" {
+		t.Errorf("allow_ips = %v, want only the app's 203.0.113.7", app.AllowIPs)
+	}
+	if app.SessionTTL != 30*time.Minute || !app.AutoRenew {
+		t.Errorf("session_ttl %s, auto_renew %t, want the defaults", app.SessionTTL, app.AutoRenew)
+	}
+}
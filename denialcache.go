@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// denialCache remembers for a short while the Redis lookups that led to a
+// denial, i.e. session keys that don't exist and ban keys that do, so a
+// client retrying a denied request doesn't query Redis every time. A nil
+// cache remembers nothing.
+type denialCache struct {
+	ttl     time.Duration
+	size    int
+	mu      sync.Mutex
+	entries map[string]denialEntry
+}
+
+type denialEntry struct {
+	exists  bool
+	expires time.Time
+}
+
+// Shared by all apps; nil when DENIAL_CACHE_TTL is 0
+var denials *denialCache
+
+func newDenialCache(ttl time.Duration, size int) *denialCache {
+	return &denialCache{ttl: ttl, size: size, entries: make(map[string]denialEntry, size)}
+}
+
+// get reports whether key was remembered as existing, and whether it was
+// remembered at all.
+func (c *denialCache) get(key string) (exists, found bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[key]
+	if !found {
+		return false, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return false, false
+	}
+	return entry.exists, true
+}
+
+// put remembers whether key exists. When the cache is full, expired entries
+// are dropped first, then arbitrary ones.
+func (c *denialCache) put(key string, exists bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		for cached, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, cached)
+			}
+		}
+		for cached := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, cached)
+		}
+	}
+	c.entries[key] = denialEntry{exists: exists, expires: now.Add(c.ttl)}
+}
+
+// forget drops whatever is remembered about keys, e.g. once a knock created
+// them.
+func (c *denialCache) forget(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Bounds the denied connections held open at once by deny_delay, so the
+// tarpit can't be used to exhaust goroutines or file descriptors
+var tarpitSlots chan struct{}
+
+// Non-standard status that closes the connection without any response, like
+// nginx's 444
+const statusCloseConnection = 444
+
+// denyAccess answers a denied request with a redirect to the app's
+// deny_redirect_url or according to its deny_status: the deny page or plain
+// text 403, the same 404 as an unknown hostname, or no response at all.
+func denyAccess(responseWriter http.ResponseWriter, request *http.Request, app *AppConfig, ip string) {
+	app.metrics.denies.Add(1)
+	publishEvent(app, eventDeny, ip, request.URL.Path)
+	if app.DenyDelay > 0 && !tarpit(request, app.DenyDelay) {
+		return
+	}
+
+	if app.DenyRedirectURL != nil {
+		// The target itself being denied here would redirect to itself forever
+		if !isDenyRedirectTarget(app, request) {
+			http.Redirect(responseWriter, request, app.DenyRedirectURL.String(), http.StatusFound)
+			return
+		}
+		app.debugf("Not redirecting to deny_redirect_url, the request is for it")
+	}
+
+	switch app.DenyStatus {
+	case http.StatusNotFound:
+		notFound(responseWriter, app.requestHost())
+		return
+	case statusCloseConnection:
+		closeConnection(responseWriter)
+		return
+	}
+
+	data := map[string]string{"Hostname": app.requestHost(), "Contact": app.DenyContact}
+	if app.DenyPage == nil || !writeTemplate(responseWriter, app.DenyPage, http.StatusForbidden, data) {
+		http.Error(responseWriter, "Access denied", http.StatusForbidden)
+	}
+}
+
+// tarpit holds a denied request for delay before it is answered. Once all
+// slots are taken, requests are answered right away. It reports false if the
+// client went away in the meantime, leaving nothing to answer.
+func tarpit(request *http.Request, delay time.Duration) bool {
+	select {
+	case tarpitSlots <- struct{}{}:
+		defer func() { <-tarpitSlots }()
+	default:
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-request.Context().Done():
+		return false
+	}
+}
+
+// closeConnection drops the client connection without writing a response.
+func closeConnection(responseWriter http.ResponseWriter) {
+	hijacker, ok := responseWriter.(http.Hijacker)
+	if !ok {
+		// HTTP/2 connections can't be hijacked; aborting resets the stream
+		panic(http.ErrAbortHandler)
+	}
+	connection, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	connection.Close()
+}
+
+// isDenyRedirectTarget reports whether the request is for the app's
+// deny_redirect_url itself.
+func isDenyRedirectTarget(app *AppConfig, request *http.Request) bool {
+	target := app.DenyRedirectURL
+	host, _, _ := strings.Cut(request.Host, ":")
+	return strings.EqualFold(target.Hostname(), host) && normalizePath(defaultString(target.Path, "/")) == normalizePath(request.URL.Path)
+}
+
+// checkDenyRedirectLoops follows each app's deny_redirect_url through the
+// apps served by this proxy and fails if a visitor without a session would be
+// redirected in a circle. A chain ends at a host that isn't served here, or at
+// a target that is a public path or would be answered with a deny page.
+func checkDenyRedirectLoops(apps map[string]*AppConfig) error {
+	for _, start := range apps {
+		// By hostname, as wildcard apps come as a new copy every time
+		visited := map[string]bool{}
+		for app := start; app != nil && app.DenyRedirectURL != nil; {
+			if visited[app.Hostname] {
+				return fmt.Errorf("deny_redirect_url of %s leads to a redirect loop through %s", start.Hostname, app.Hostname)
+			}
+			visited[app.Hostname] = true
+
+			target := app.DenyRedirectURL
+			next, _ := lookupApp(apps, target.Hostname())
+			if next != nil && isPublicPath(next, defaultString(target.Path, "/")) {
+				break
+			}
+			app = next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels starting with it configure a container's app, e.g.
+// mithrandir.hostname; the others are settings of APPS_CONFIG entries
+const dockerLabelPrefix = "mithrandir."
+
+// How long to wait before reconnecting to Docker after losing its events
+const dockerRetryInterval = 5 * time.Second
+
+// dockerContainer is a container as listed by the Docker Engine API.
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerEvent is an entry of the Docker events stream.
+type dockerEvent struct {
+	Action string `json:"Action"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+// discoveredApp is the app config of a container found by Docker discovery.
+type discoveredApp struct {
+	name   string
+	config map[string]string
+	// Set once the container stopped, to remove the app after the grace period
+	removal *time.Timer
+}
+
+var (
+	// Set for DOCKER_DISCOVERY
+	dockerClient      *http.Client
+	dockerBaseURL     string
+	dockerGracePeriod time.Duration
+
+	dockerMu sync.Mutex
+	// By container ID
+	discoveredApps = make(map[string]*discoveredApp)
+)
+
+// newDockerClient returns a client of the Docker Engine API at host, a
+// unix:// socket or a tcp:// address, along with the base URL of its
+// requests.
+func newDockerClient(host string) (*http.Client, string, error) {
+	switch scheme, address, _ := strings.Cut(host, "://"); scheme {
+	case "unix":
+		dialer := &net.Dialer{}
+		transport := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", address)
+		}}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case "tcp":
+		return &http.Client{}, "http://" + address, nil
+	default:
+		return nil, "", fmt.Errorf("%s (expected unix:///path or tcp://host:port)", host)
+	}
+}
+
+// dockerRequest sends a GET to the Docker Engine API, with the filters as
+// its filters parameter.
+func dockerRequest(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	encoded, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, dockerBaseURL+path+"?filters="+url.QueryEscape(string(encoded)), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := dockerClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("%s: %s %s", path, response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// listDockerContainers returns the running containers labelled with a
+// hostname, or only the one with the given ID.
+func listDockerContainers(id string) ([]dockerContainer, error) {
+	ctx, cancel := context.WithTimeout(backgroundContext, 10*time.Second)
+	defer cancel()
+	filters := map[string][]string{"label": {dockerLabelPrefix + "hostname"}}
+	if id != "" {
+		filters["id"] = []string{id}
+	}
+	response, err := dockerRequest(ctx, "/containers/json", filters)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var containers []dockerContainer
+	if err := json.NewDecoder(response.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("/containers/json: %v", err)
+	}
+	return containers, nil
+}
+
+// containerAppConfig builds the app config of a container from its labels.
+// Unless a label sets upstream_url, the upstream is the container's IP, on
+// mithrandir.network if it has several, with the port of mithrandir.port,
+// or its only exposed one.
+func containerAppConfig(container dockerContainer) (map[string]string, error) {
+	config := make(map[string]string)
+	for label, value := range container.Labels {
+		if key, found := strings.CutPrefix(label, dockerLabelPrefix); found && key != "port" && key != "network" {
+			config[key] = value
+		}
+	}
+	if config["upstream_url"] != "" {
+		return config, nil
+	}
+
+	network := container.Labels[dockerLabelPrefix+"network"]
+	var ip string
+	if network != "" {
+		ip = container.NetworkSettings.Networks[network].IPAddress
+	} else if len(container.NetworkSettings.Networks) == 1 {
+		for _, settings := range container.NetworkSettings.Networks {
+			ip = settings.IPAddress
+		}
+	} else {
+		return nil, fmt.Errorf("it is on several networks; set mithrandir.network to the one to reach it on")
+	}
+	if ip == "" {
+		return nil, fmt.Errorf("it has no IP address on network %q", network)
+	}
+
+	port := container.Labels[dockerLabelPrefix+"port"]
+	if port == "" {
+		var ports []int
+		for _, exposed := range container.Ports {
+			if exposed.Type == "tcp" && !slices.Contains(ports, exposed.PrivatePort) {
+				ports = append(ports, exposed.PrivatePort)
+			}
+		}
+		if len(ports) != 1 {
+			return nil, fmt.Errorf("it exposes %d TCP ports; set mithrandir.port to the one to proxy to", len(ports))
+		}
+		port = fmt.Sprint(ports[0])
+	}
+	config["upstream_url"] = "http://" + net.JoinHostPort(ip, port)
+	return config, nil
+}
+
+func containerName(container dockerContainer) string {
+	if len(container.Names) > 0 {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+	return container.ID[:min(12, len(container.ID))]
+}
+
+// discoverContainer records the app of a running container, and returns
+// whether that changed it. A container without a usable upstream is logged
+// and left out.
+func discoverContainer(container dockerContainer) bool {
+	name := containerName(container)
+	config, err := containerAppConfig(container)
+	if err != nil {
+		warnf("Docker container %s: %v, not adding its app", name, err)
+		return false
+	}
+
+	dockerMu.Lock()
+	defer dockerMu.Unlock()
+	if discovered, found := discoveredApps[container.ID]; found {
+		if discovered.removal != nil {
+			infof("Docker container %s restarted, keeping its app", name)
+			discovered.removal.Stop()
+			discovered.removal = nil
+		}
+		if maps.Equal(discovered.config, config) {
+			return false
+		}
+		discovered.config = config
+		return true
+	}
+	// A container recreated in the grace period of the one it replaces
+	for id, discovered := range discoveredApps {
+		if discovered.removal != nil && discovered.config["hostname"] == config["hostname"] {
+			discovered.removal.Stop()
+			delete(discoveredApps, id)
+		}
+	}
+	discoveredApps[container.ID] = &discoveredApp{name: name, config: config}
+	return true
+}
+
+// containerStopped schedules the removal of a stopped container's app, which
+// keeps being served for the grace period in case it restarts.
+func containerStopped(id, storeBackend string) {
+	dockerMu.Lock()
+	defer dockerMu.Unlock()
+	discovered, found := discoveredApps[id]
+	if !found || discovered.removal != nil {
+		return
+	}
+	infof("Docker container %s stopped, removing its app in %s unless it restarts", discovered.name, dockerGracePeriod)
+	var removal *time.Timer
+	removal = time.AfterFunc(dockerGracePeriod, func() {
+		dockerMu.Lock()
+		removed := discoveredApps[id] == discovered && discovered.removal == removal
+		if removed {
+			delete(discoveredApps, id)
+		}
+		dockerMu.Unlock()
+		if removed {
+			reloadApps(storeBackend)
+		}
+	})
+	discovered.removal = removal
+}
+
+// syncDockerContainers lists the running containers and brings the
+// discovered apps in line with them, returning whether any changed.
+func syncDockerContainers(storeBackend string) (bool, error) {
+	containers, err := listDockerContainers("")
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+		if discoverContainer(container) {
+			changed = true
+		}
+	}
+	dockerMu.Lock()
+	var stopped []string
+	for id := range discoveredApps {
+		if !running[id] {
+			stopped = append(stopped, id)
+		}
+	}
+	dockerMu.Unlock()
+	for _, id := range stopped {
+		containerStopped(id, storeBackend)
+	}
+	return changed, nil
+}
+
+// watchDockerContainers follows the Docker events for containers starting
+// and stopping, reloading the apps as theirs come and go. The containers are
+// listed again whenever the events stream is opened, so nothing is missed
+// while it was down.
+func watchDockerContainers(storeBackend string) {
+	for {
+		if err := followDockerEvents(storeBackend); err != nil {
+			errorf("Docker events: %v, reconnecting in %s", err, dockerRetryInterval)
+		}
+		time.Sleep(dockerRetryInterval)
+	}
+}
+
+func followDockerEvents(storeBackend string) error {
+	filters := map[string][]string{"type": {"container"}, "event": {"start", "die"}, "label": {dockerLabelPrefix + "hostname"}}
+	response, err := dockerRequest(backgroundContext, "/events", filters)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if changed, err := syncDockerContainers(storeBackend); err != nil {
+		return err
+	} else if changed {
+		reloadApps(storeBackend)
+	}
+	decoder := json.NewDecoder(bufio.NewReader(response.Body))
+	for {
+		var event dockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		switch event.Action {
+		case "start":
+			containers, err := listDockerContainers(event.Actor.ID)
+			if err != nil {
+				return err
+			}
+			// Already gone again otherwise
+			if len(containers) == 1 && discoverContainer(containers[0]) {
+				infof("Docker container %s started", containerName(containers[0]))
+				reloadApps(storeBackend)
+			}
+		case "die":
+			containerStopped(event.Actor.ID, storeBackend)
+		}
+	}
+}
+
+// addDiscoveredApps adds the apps of the discovered containers to the
+// statically configured apps, which win when both have a hostname. Apps
+// whose labels are invalid are logged and left out, so a container can't
+// stop the others from being served. They get the same defaults.
+func addDiscoveredApps(apps map[string]*AppConfig, defaults map[string]string) {
+	dockerMu.Lock()
+	discovered := make([]*discoveredApp, 0, len(discoveredApps))
+	for _, entry := range discoveredApps {
+		discovered = append(discovered, entry)
+	}
+	dockerMu.Unlock()
+	sort.Slice(discovered, func(i, j int) bool { return discovered[i].name < discovered[j].name })
+
+	entries := make(map[string]string)
+	for _, entry := range discovered {
+		app, err := reuseOrParseApp(withDefaults(entry.config, defaults))
+		if err == nil {
+			err = addApp(apps, app, "Docker container "+entry.name, entries)
+		}
+		if err != nil {
+			warnf("Docker container %s: %v, not adding its app", entry.name, err)
+		}
+	}
+}
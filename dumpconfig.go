@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// How secret settings are masked wherever the configuration is printed
+const (
+	// Only the start and length of the value show, see redact
+	redactSecret = "secret"
+	// The URL shows with its password masked
+	redactURL = "url"
+)
+
+// The redactions of the secret app settings, from the redact tags of
+// appConfigInput's fields
+var appRedactions = func() map[string]string {
+	redactions := make(map[string]string)
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[appConfigInput]()) {
+		if redaction := field.Tag.Get("redact"); redaction != "" {
+			redactions[field.Tag.Get("json")] = redaction
+		}
+	}
+	return redactions
+}()
+
+// configDump is the effective configuration printed by -dump-config and
+// logged at startup, with its secrets masked.
+type configDump struct {
+	// Where the apps were read from
+	Source string `json:"source"`
+	// The global settings that have a value, by environment variable name
+	Settings map[string]string `json:"settings"`
+	// The settings of each app, once merged with the defaults and expanded
+	Apps []map[string]string `json:"apps"`
+}
+
+// effectiveConfig returns the configuration the apps were loaded with, every
+// value masked as its setting requires.
+func effectiveConfig(apps map[string]*AppConfig, file *configFile) configDump {
+	dump := configDump{Source: appsSource(file), Settings: make(map[string]string)}
+	for _, setting := range globalSettings {
+		if value := getenv(setting.name, setting.fallback); value != "" {
+			dump.Settings[setting.name] = redactValue(settingRedactions[setting.name], value)
+		}
+	}
+	for _, hostname := range sortedHostnames(apps) {
+		config := make(map[string]string)
+		for name, value := range apps[hostname].config {
+			if value != "" {
+				config[name] = redactedAppValue(name, value)
+			}
+		}
+		dump.Apps = append(dump.Apps, config)
+	}
+	return dump
+}
+
+// appsSource names where loadAppConfigurations reads the apps from.
+func appsSource(file *configFile) string {
+	var source string
+	switch {
+	case configSource == "redis":
+		source = fmt.Sprintf("Redis key %s (version %s)", configRedisKey, configState().Version)
+	case file != nil && len(file.apps) > 0:
+		source = "CONFIG_FILE " + file.path
+	case setting("APPS_CONFIG") != "":
+		source = "APPS_CONFIG"
+	default:
+		source = "numbered environment variables"
+	}
+	if dockerClient != nil {
+		source += " and Docker discovery"
+	}
+	return source
+}
+
+// logConfig logs the effective configuration, one line per global setting
+// and per app.
+func logConfig(dump configDump) {
+	infof("Effective configuration, apps from %s:", dump.Source)
+	for _, name := range slices.Sorted(maps.Keys(dump.Settings)) {
+		infof("  %s=%s", name, dump.Settings[name])
+	}
+	for _, config := range dump.Apps {
+		var settings []string
+		for _, name := range slices.Sorted(maps.Keys(config)) {
+			if name != "hostname" {
+				settings = append(settings, name+"="+config[name])
+			}
+		}
+		infof("  %s: %s", config["hostname"], strings.Join(settings, " "))
+	}
+}
+
+// redactedAppValue returns a value of an app's setting, or one derived from
+// it, the way it may be printed: masked if the setting is secret. Whatever
+// prints an app's configuration goes through it, rather than formatting the
+// AppConfig fields itself.
+func redactedAppValue(name, value string) string {
+	return redactValue(appRedactions[name], value)
+}
+
+// redactValue masks the value of a setting with the given redaction, if any.
+// A URL that can't be parsed is masked whole.
+func redactValue(redaction, value string) string {
+	switch redaction {
+	case "":
+		return value
+	case redactURL:
+		if parsed, err := url.Parse(value); err == nil {
+			return parsed.Redacted()
+		}
+	}
+	return redact(value)
+}
+
+// redact masks a secret, keeping its length and, when it is long enough that
+// they give little away, its first 2 characters, e.g. "/s…(12 chars)".
+func redact(secret string) string {
+	characters := []rune(secret)
+	if len(characters) < 8 {
+		return fmt.Sprintf("…(%d chars)", len(characters))
+	}
+	return fmt.Sprintf("%s…(%d chars)", string(characters[:2]), len(characters))
+}
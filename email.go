@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Login link requests per client IP and minute
+	emailRateLimit        = 3
+	emailAddressParameter = "email"
+	emailNonceParameter   = "nonce"
+	// Minimum time between two login emails to the same address
+	emailResendInterval = time.Minute
+)
+
+// smtpConfig holds the global SMTP settings used to send login links.
+type smtpConfig struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+// SMTP settings for email knocks; nil when SMTP_HOST is unset
+var smtpSettings *smtpConfig
+
+// loadSMTPConfig reads the SMTP settings from the environment.
+func loadSMTPConfig() (*smtpConfig, error) {
+	host := setting("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+	config := &smtpConfig{
+		host:     host,
+		port:     setting("SMTP_PORT"),
+		username: setting("SMTP_USERNAME"),
+		password: setting("SMTP_PASSWORD"),
+		from:     setting("SMTP_FROM"),
+	}
+	if _, err := strconv.Atoi(config.port); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_PORT: %s", config.port)
+	}
+	if _, err := mail.ParseAddress(config.from); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %v", err)
+	}
+	return config, nil
+}
+
+// parseAllowedEmails parses a comma-separated list of addresses and
+// @domain entries, which allow any address at that domain.
+func parseAllowedEmails(list string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if !strings.HasPrefix(entry, "@") {
+			if _, err := mail.ParseAddress(entry); err != nil {
+				return nil, fmt.Errorf("invalid address %s", entry)
+			}
+		}
+		allowed[entry] = true
+	}
+	return allowed, nil
+}
+
+// emailAllowed reports whether an address may request a login link.
+func emailAllowed(app *AppConfig, address string) bool {
+	address = strings.ToLower(address)
+	at := strings.LastIndex(address, "@")
+	return app.AllowedEmails[address] || at > 0 && app.AllowedEmails[address[at:]]
+}
+
+// emailSignature computes the HMAC-SHA256 signature of a login link. The
+// leading "email" keeps it from ever being valid as a signed knock link.
+func emailSignature(app *AppConfig, address, expires, nonce string) string {
+	mac := hmac.New(sha256.New, app.SigningKey)
+	fmt.Fprintf(mac, "email\n%s\n%s\n%s\n%s", app.requestHost(), strings.ToLower(address), expires, nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailLoginURL builds a signed, expiring login link for an address.
+func emailLoginURL(app *AppConfig, address string, now time.Time) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(random)
+	expires := strconv.FormatInt(now.Add(app.EmailLinkTTL).Unix(), 10)
+
+	query := url.Values{}
+	query.Set(emailAddressParameter, address)
+	query.Set(signedExpiresParameter, expires)
+	query.Set(emailNonceParameter, nonce)
+	query.Set(signedSignatureParameter, emailSignature(app, address, expires, nonce))
+	link := url.URL{Scheme: "https", Host: app.requestHost(), Path: app.EmailPath, RawQuery: query.Encode()}
+	return link.String(), nil
+}
+
+// isEmailLink reports whether a request is for a login link rather than the
+// login form.
+func isEmailLink(app *AppConfig, request *http.Request) bool {
+	return app.EmailPath != "" && request.URL.Path == app.EmailPath && request.URL.Query().Has(signedSignatureParameter)
+}
+
+// verifyEmailLink checks the signature and expiry of a login link and
+// returns its address and nonce.
+func verifyEmailLink(app *AppConfig, query url.Values, now time.Time) (string, string, error) {
+	address := query.Get(emailAddressParameter)
+	expires := query.Get(signedExpiresParameter)
+	nonce := query.Get(emailNonceParameter)
+	signature := query.Get(signedSignatureParameter)
+
+	expected := emailSignature(app, address, expires, nonce)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", "", fmt.Errorf("invalid signature")
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid expiry")
+	}
+	if now.Unix() > expiresAt {
+		return "", "", fmt.Errorf("link expired at %s", time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	if !emailAllowed(app, address) {
+		return "", "", fmt.Errorf("%s is no longer allowed", address)
+	}
+	return address, nonce, nil
+}
+
+// claimEmailNonce marks a login link as used so it works only once. Redis
+// errors fail closed.
+func claimEmailNonce(ctx context.Context, app *AppConfig, nonce string) bool {
+	claimed, err := redisClient.SetNX(ctx, emailNonceKey(app, nonce), "1", app.EmailLinkTTL).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return false
+	}
+	return claimed
+}
+
+// serveEmailLogin shows the login form on GET and sends a login link on POST.
+// The answer to a POST is the same whether or not the address is allowed, so
+// the form can't be used to probe the allow list.
+func serveEmailLogin(responseWriter http.ResponseWriter, request *http.Request, app *AppConfig, ip string) {
+	data := map[string]string{"Hostname": app.requestHost(), "Action": request.URL.RequestURI()}
+	if request.Method != http.MethodPost {
+		servePage(responseWriter, "email.html", http.StatusOK, data)
+		return
+	}
+
+	if wait := app.EmailRateLimiter.retryAfter(ip); wait > 0 {
+		app.debugf("Email rate limit exceeded for %s", ip)
+		data["Error"] = "Too many requests, please try again later."
+		servePage(responseWriter, "email.html", http.StatusTooManyRequests, data)
+		return
+	}
+	app.EmailRateLimiter.consume(ip)
+
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, maxFormSize)
+	address, err := mail.ParseAddress(request.PostFormValue(emailAddressParameter))
+	if err != nil {
+		data["Error"] = "Please enter a valid email address."
+		servePage(responseWriter, "email.html", http.StatusBadRequest, data)
+		return
+	}
+
+	data["Sent"] = address.Address
+	if emailAllowed(app, address.Address) {
+		sendLoginLink(request.Context(), app, address.Address, ip)
+	} else {
+		app.infof("Login link requested by %s for address not on the allow list: %s", ip, address.Address)
+		recordFailedAttempt(request.Context(), app, ip)
+	}
+	servePage(responseWriter, "email.html", http.StatusOK, data)
+}
+
+// sendLoginLink emails a login link in the background. Each address gets at
+// most one email per emailResendInterval.
+func sendLoginLink(ctx context.Context, app *AppConfig, address, ip string) {
+	throttled, err := redisClient.SetNX(ctx, emailResendKey(app, address), "1", emailResendInterval).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return
+	}
+	if !throttled {
+		app.infof("Not sending another login link to %s yet", address)
+		return
+	}
+
+	link, err := emailLoginURL(app, address, time.Now())
+	if err != nil {
+		app.errorf("Failed to create login link: %v", err)
+		return
+	}
+	go func() {
+		if err := sendEmail(address, "Your login link for "+app.requestHost(), fmt.Sprintf(
+			"Open this link to access %s:\r\n\r\n%s\r\n\r\nIt works once and expires in %s. If you didn't ask for it, ignore this email.\r\n",
+			app.requestHost(), link, app.EmailLinkTTL)); err != nil {
+			app.warnf("Failed to send login link to %s: %v", address, err)
+			return
+		}
+		app.infof("Sent login link to %s (requested by %s)", address, ip)
+	}()
+}
+
+func emailNonceKey(app *AppConfig, nonce string) string {
+	return appKey(app, "email:%s", nonce)
+}
+
+func emailResendKey(app *AppConfig, address string) string {
+	return appKey(app, "mail:%s", strings.ToLower(address))
+}
+
+// sendEmail sends a plain text email through the configured SMTP server,
+// using STARTTLS when the server offers it.
+func sendEmail(to, subject, body string) error {
+	var auth smtp.Auth
+	if smtpSettings.username != "" {
+		auth = smtp.PlainAuth("", smtpSettings.username, smtpSettings.password, smtpSettings.host)
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		smtpSettings.from, to, subject, time.Now().Format(time.RFC1123Z), body)
+	from, err := mail.ParseAddress(smtpSettings.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(net.JoinHostPort(smtpSettings.host, smtpSettings.port), auth, from.Address, []string{to}, []byte(message))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// Session lifecycle events
+const (
+	eventGrant   = "grant"
+	eventRenewal = "renewal"
+	eventRevoke  = "revoke"
+	eventExpire  = "expire"
+	eventDeny    = "deny"
+)
+
+const (
+	eventQueueSize = 4096
+	// Events written to Redis in one pipeline at most
+	eventBatchSize = 100
+)
+
+// sessionEvent is one entry of the EVENT_STREAM audit stream.
+type sessionEvent struct {
+	app       string
+	ip        string
+	event     string
+	path      string
+	timestamp time.Time
+}
+
+var (
+	// Redis stream receiving session events; empty when disabled
+	eventStream       string
+	eventStreamMaxLen int64
+	eventQueue        = make(chan sessionEvent, eventQueueSize)
+)
+
+// publishEvent queues a session event for the event stream. It never blocks
+// the request: when the queue is full, the event is dropped with a warning.
+// Knock paths in path are replaced by their label, see logPath.
+func publishEvent(app *AppConfig, event, ip, path string) {
+	if eventStream == "" {
+		return
+	}
+	select {
+	case eventQueue <- sessionEvent{app: app.requestHost(), ip: ip, event: event, path: logPath(app, path), timestamp: time.Now().UTC()}:
+	default:
+		app.warnf("Event queue full, dropped %s event for %s", event, ip)
+	}
+}
+
+// runEventPublisher writes queued events to the event stream, batching
+// whatever has queued up while the previous batch was written. Failed writes
+// are logged and the events are lost.
+func runEventPublisher() {
+	for event := range eventQueue {
+		batch := []sessionEvent{event}
+	drain:
+		for len(batch) < eventBatchSize {
+			select {
+			case next := <-eventQueue:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		_, err := redisClient.Pipelined(backgroundContext, func(pipe redis.Pipeliner) error {
+			for _, event := range batch {
+				pipe.XAdd(backgroundContext, &redis.XAddArgs{
+					Stream: redisKey("%s", eventStream),
+					MaxLen: eventStreamMaxLen,
+					Approx: true,
+					Values: []any{
+						"app", event.app,
+						"ip", event.ip,
+						"event", event.event,
+						"path", event.path,
+						"timestamp", event.timestamp.Format(time.RFC3339Nano),
+					},
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			warnf("Failed to write %d events to %s: %v", len(batch), eventStream, err)
+		}
+	}
+}
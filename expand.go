@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// expandVariables returns the app config with ${VAR} and ${VAR:-default} in
+// its values replaced from the environment, so one config can serve several
+// environments. The default applies when VAR is unset or empty, and $${
+// stands for a literal ${. All unresolved variables are reported at once.
+// The placeholders of request_headers are left for each request to fill in.
+func expandVariables(config map[string]string) (map[string]string, error) {
+	expanded := make(map[string]string, len(config))
+	unresolved := make(map[string]bool)
+	for key, value := range config {
+		var placeholders []string
+		if key == "request_headers" {
+			placeholders = requestHeaderPlaceholders
+		}
+		var err error
+		if expanded[key], err = expandValue(value, placeholders, unresolved); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if len(unresolved) > 0 {
+		return nil, unresolvedError(unresolved)
+	}
+	return expanded, nil
+}
+
+// expandValue replaces the variables in value, other than placeholders,
+// adding the ones not set to unresolved.
+func expandValue(value string, placeholders []string, unresolved map[string]bool) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var result strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			result.WriteString(value)
+			return result.String(), nil
+		}
+		if start > 0 && value[start-1] == '$' {
+			result.WriteString(value[:start-1] + "${")
+			value = value[start+2:]
+			continue
+		}
+		result.WriteString(value[:start])
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${")
+		}
+		name, fallback, hasFallback := strings.Cut(value[start+2:start+end], ":-")
+		if !validVariableName(name) {
+			// Not the name, it may be part of a secret
+			return "", fmt.Errorf("invalid variable name in ${...}")
+		}
+		switch resolved, set := os.LookupEnv(name); {
+		case slices.Contains(placeholders, name) && !hasFallback:
+			result.WriteString("${" + name + "}")
+		case set && (resolved != "" || !hasFallback):
+			result.WriteString(resolved)
+		case hasFallback:
+			result.WriteString(fallback)
+		default:
+			unresolved[name] = true
+		}
+		value = value[start+end+1:]
+	}
+}
+
+func validVariableName(name string) bool {
+	for i, char := range name {
+		if char != '_' && (char < 'A' || char > 'Z') && (char < 'a' || char > 'z') && (i == 0 || char < '0' || char > '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func unresolvedError(unresolved map[string]bool) error {
+	names := make([]string, 0, len(unresolved))
+	for name := range unresolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unresolved variables: %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long the replica reporting an expiration is remembered, so the other
+// replicas, which get the same notification, stay quiet
+const expiryClaimTTL = time.Minute
+
+// Set for SESSION_EXPIRY_EVENTS
+var sessionExpiryEvents bool
+
+// watchSessionExpiry logs, and publishes to EVENT_STREAM, every session whose
+// TTL runs out, as reported by Redis keyspace notifications. go-redis
+// resubscribes on its own after Redis restarts. In a cluster, every master
+// sends the notifications of its own keys, so each is subscribed to.
+func watchSessionExpiry(database int) {
+	checkExpiryNotifications()
+	// Keys expiring in REDIS_DB
+	channel := fmt.Sprintf("__keyevent@%d__:expired", database)
+	if cluster, ok := redisClient.(*redis.ClusterClient); ok {
+		_ = cluster.ForEachMaster(backgroundContext, func(ctx context.Context, node *redis.Client) error {
+			go receiveExpiryEvents(node.Subscribe(backgroundContext, channel))
+			return nil
+		})
+		return
+	}
+	go receiveExpiryEvents(redisClient.Subscribe(backgroundContext, channel))
+}
+
+// checkExpiryNotifications warns once if Redis isn't configured to send the
+// notifications, which needs notify-keyspace-events to include E and x (or A).
+func checkExpiryNotifications() {
+	config, err := redisClient.ConfigGet(backgroundContext, "notify-keyspace-events").Result()
+	if err != nil {
+		warnf("Can't check notify-keyspace-events (%v); session expirations are only logged if it includes Ex", err)
+		return
+	}
+	flags := config["notify-keyspace-events"]
+	if !strings.Contains(flags, "E") || !strings.ContainsAny(flags, "xA") {
+		warnf("Redis notify-keyspace-events is %q, so session expirations won't be logged; set it to include Ex, e.g. CONFIG SET notify-keyspace-events Ex", flags)
+	}
+}
+
+func receiveExpiryEvents(subscription *redis.PubSub) {
+	for message := range subscription.Channel() {
+		key := message.Payload
+		// Neither max_session_age keys nor the claims of reportExpiredSession
+		if strings.HasSuffix(key, sessionAgeKey("")) || strings.HasSuffix(key, expiryClaimKey("")) {
+			continue
+		}
+		// Of the apps configured now, which reloads change
+		prefixes := sessionKeyPrefixes()
+		// Wildcard apps' keys are of the hostname the session was for
+		if app, found := lookupApp(currentApps(), sessionKeyHost(key)); found && app.host != "" {
+			prefixes = append(prefixes, sessionKeyPrefix{ipSessionKey(app, ""), app, true}, sessionKeyPrefix{sessionIDKey(app, ""), app, false})
+		}
+		for _, prefix := range prefixes {
+			rest, found := strings.CutPrefix(key, prefix.prefix)
+			if !found {
+				continue
+			}
+			// Cookie sessions' IP expired with them
+			ip := ""
+			if prefix.ipKeys {
+				ip = rest
+			}
+			reportExpiredSession(prefix.app, key, ip)
+			break
+		}
+	}
+}
+
+// sessionKeyPrefix is the start of an app's IP or cookie session keys.
+type sessionKeyPrefix struct {
+	prefix string
+	app    *AppConfig
+	ipKeys bool
+}
+
+// sessionKeyPrefixes returns the prefixes of the apps' IP and cookie session
+// keys. Apps of a session group share theirs, which are reported for the
+// group's first app.
+func sessionKeyPrefixes() []sessionKeyPrefix {
+	var prefixes []sessionKeyPrefix
+	seen := make(map[string]bool)
+	apps := currentApps()
+	for _, hostname := range sortedHostnames(apps) {
+		app := apps[hostname]
+		for _, prefix := range []sessionKeyPrefix{{ipSessionKey(app, ""), app, true}, {sessionIDKey(app, ""), app, false}} {
+			if !seen[prefix.prefix] {
+				seen[prefix.prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	// Longest first, so an app's prefix never shadows a longer one
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i].prefix) > len(prefixes[j].prefix) })
+	return prefixes
+}
+
+// sessionKeyHost returns the hostname of an app's session key, or "" for keys
+// of session groups.
+func sessionKeyHost(key string) string {
+	rest, found := strings.CutPrefix(strings.TrimPrefix(strings.TrimPrefix(key, redisKeyPrefix), "{"), "app:")
+	if !found {
+		return ""
+	}
+	hostname, _, _ := strings.Cut(rest, ":")
+	return strings.TrimSuffix(hostname, "}")
+}
+
+// reportExpiredSession logs the app's expired session under key, unless
+// another replica already did.
+func reportExpiredSession(app *AppConfig, key, ip string) {
+	claimed, err := redisClient.SetNX(backgroundContext, expiryClaimKey(key), "1", expiryClaimTTL).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	group := ""
+	if app.SessionGroup != "" {
+		group = " in session group " + app.SessionGroup
+	}
+	// Session IDs are credentials and never logged
+	if ip != "" {
+		app.infof("Session of %s%s expired", ip, group)
+	} else {
+		app.infof("Cookie session%s expired", group)
+	}
+	publishEvent(app, eventExpire, ip, "")
+}
+
+func expiryClaimKey(sessionKey string) string {
+	return sessionKey + ":expired"
+}
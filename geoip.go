@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// geoIPDatabase wraps a MaxMind database file and reopens it whenever the file
+// changes on disk, since GeoLite2 databases are updated regularly.
+type geoIPDatabase struct {
+	path    string
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+type geoIPCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type geoIPASNRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+var (
+	geoIPDB *geoIPDatabase
+	asnDB   *geoIPDatabase
+)
+
+// checkGeoIPDatabases fails if an app uses country or ASN rules without the
+// database they need.
+func checkGeoIPDatabases(apps map[string]*AppConfig) error {
+	for hostname, app := range apps {
+		if (len(app.AllowCountries) > 0 || len(app.DenyCountries) > 0) && setting("GEOIP_DB_PATH") == "" {
+			return fmt.Errorf("app %s uses allow_countries/deny_countries but GEOIP_DB_PATH is not set", hostname)
+		}
+		if len(app.AllowASNs) > 0 && setting("GEOIP_ASN_DB_PATH") == "" {
+			return fmt.Errorf("app %s uses allow_asns but GEOIP_ASN_DB_PATH is not set", hostname)
+		}
+	}
+	return nil
+}
+
+// loadGeoIPDatabases opens the country (GEOIP_DB_PATH) and ASN
+// (GEOIP_ASN_DB_PATH) databases and starts watching them for updates. A
+// single reader is shared when both settings point at the same file.
+func loadGeoIPDatabases() error {
+	countryPath := setting("GEOIP_DB_PATH")
+	asnPath := setting("GEOIP_ASN_DB_PATH")
+	if countryPath == "" && asnPath == "" {
+		return nil
+	}
+
+	refresh, err := time.ParseDuration(setting("GEOIP_REFRESH_INTERVAL"))
+	if err != nil || refresh <= 0 {
+		return fmt.Errorf("invalid GEOIP_REFRESH_INTERVAL: %s", setting("GEOIP_REFRESH_INTERVAL"))
+	}
+
+	if countryPath != "" {
+		if geoIPDB, err = openGeoIPDatabase(countryPath); err != nil {
+			return err
+		}
+		go geoIPDB.watch(refresh)
+	}
+	if asnPath != "" {
+		if asnPath == countryPath {
+			asnDB = geoIPDB
+		} else {
+			if asnDB, err = openGeoIPDatabase(asnPath); err != nil {
+				return err
+			}
+			go asnDB.watch(refresh)
+		}
+	}
+	return nil
+}
+
+func openGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	db := &geoIPDatabase{path: path}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reload reopens the database if its modification time changed.
+func (db *geoIPDatabase) reload() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("cannot stat GeoIP database %s: %v", db.path, err)
+	}
+
+	db.mu.RLock()
+	unchanged := db.reader != nil && info.ModTime().Equal(db.modTime)
+	db.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(db.path)
+	if err != nil {
+		return fmt.Errorf("cannot open GeoIP database %s: %v", db.path, err)
+	}
+
+	db.mu.Lock()
+	previous := db.reader
+	db.reader = reader
+	db.modTime = info.ModTime()
+	db.mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+		infof("Reloaded GeoIP database %s (%s)", db.path, reader.Metadata.DatabaseType)
+	}
+	return nil
+}
+
+// watch periodically checks the database file for updates.
+func (db *geoIPDatabase) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := db.reload(); err != nil {
+			warnf("GeoIP refresh failed, keeping previous database: %v", err)
+		}
+	}
+}
+
+func (db *geoIPDatabase) lookup(ip string, result any) (bool, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, found, err := db.reader.LookupNetwork(net.IP(addr.AsSlice()), result)
+	return found, err
+}
+
+// country returns the ISO country code for an IP, or "" if it can't be resolved.
+func (db *geoIPDatabase) country(ip string) string {
+	var record geoIPCountryRecord
+	if found, err := db.lookup(ip, &record); err != nil || !found {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// asn returns the autonomous system number for an IP, or 0 if it can't be
+// resolved.
+func (db *geoIPDatabase) asn(ip string) uint {
+	var record geoIPASNRecord
+	if found, err := db.lookup(ip, &record); err != nil || !found {
+		return 0
+	}
+	return record.AutonomousSystemNumber
+}
+
+// countryAllowed applies the app's country rules to an IP. Deny rules win over
+// allow rules, and IPs without a known country follow the app's default.
+func countryAllowed(app *AppConfig, ip string) (bool, string) {
+	country := geoIPDB.country(ip)
+	if country == "" {
+		return app.GeoIPAllowUnknown, "unknown"
+	}
+	if app.DenyCountries[country] {
+		return false, country
+	}
+	if len(app.AllowCountries) > 0 && !app.AllowCountries[country] {
+		return false, country
+	}
+	return true, country
+}
@@ -2,9 +2,21 @@ module github.com/sudhanwadindorkar/secret-proxy
 
 go 1.24.4
 
-require github.com/redis/go-redis/v9 v9.10.0
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/pires/go-proxyproto v0.11.0
+	github.com/redis/go-redis/v9 v9.10.0
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.46.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.39.0 // indirect
 )
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+	// Redis may be unreachable this long before /healthz reports unhealthy
+	healthRedisThreshold time.Duration
+)
+
+type healthStatus struct {
+	Status        string       `json:"status"`
+	Store         string       `json:"store"`
+	Redis         *redisHealth `json:"redis,omitempty"`
+	Apps          int          `json:"apps"`
+	Config        configHealth `json:"config"`
+	UptimeSeconds int64        `json:"uptime_seconds"`
+}
+
+type redisHealth struct {
+	Reachable bool    `json:"reachable"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// How long Redis has been unreachable
+	DownSeconds int64          `json:"down_seconds,omitempty"`
+	CircuitOpen bool           `json:"circuit_open"`
+	Pool        redisPoolStats `json:"pool"`
+	down        time.Duration
+}
+
+// configHealth tells whether the last reload of the apps worked; a failed one
+// leaves the previous apps serving, so it doesn't make the replica unhealthy.
+type configHealth struct {
+	LoadedAt time.Time `json:"loaded_at"`
+	Version  string    `json:"version,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// redisPoolStats are go-redis' connection pool counters, summed over all
+// nodes, to check REDIS_POOL_SIZE against: timeouts count calls that gave up
+// waiting for a free connection.
+type redisPoolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+	StaleConns uint32 `json:"stale_conns"`
+}
+
+// newHealthHandler returns the handler of the health listener, which serves
+// GET /healthz without authentication, for orchestrators' health checks.
+func newHealthHandler(store string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(responseWriter http.ResponseWriter, request *http.Request) {
+		serveHealth(responseWriter, request, store)
+	})
+	return mux
+}
+
+// serveHealth reports the state of Redis found by the health monitor, and
+// answers 503 once Redis has failed every ping for longer than
+// HEALTH_REDIS_THRESHOLD, so a short blip doesn't get the replica restarted.
+func serveHealth(responseWriter http.ResponseWriter, request *http.Request, store string) {
+	status := healthStatus{Status: "ok", Store: store, Apps: len(sortedHostnames(currentApps())), UptimeSeconds: int64(time.Since(startTime).Seconds())}
+	status.Config = configState()
+	if store == "redis" {
+		status.Redis = checkRedisHealth()
+		if status.Redis.down > healthRedisThreshold {
+			status.Status = "unhealthy"
+		}
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		responseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(responseWriter).Encode(status); err != nil {
+		errorf("Health check response: %v", err)
+	}
+}
+
+func checkRedisHealth() *redisHealth {
+	stats := redisClient.PoolStats()
+	health := &redisHealth{
+		CircuitOpen: redisBreaker.isOpen(),
+		Pool: redisPoolStats{
+			Hits:       stats.Hits,
+			Misses:     stats.Misses,
+			Timeouts:   stats.Timeouts,
+			TotalConns: stats.TotalConns,
+			IdleConns:  stats.IdleConns,
+			StaleConns: stats.StaleConns,
+		},
+	}
+
+	monitor := redisHealthMonitor
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	if !monitor.downSince.IsZero() {
+		health.Error = monitor.lastErr.Error()
+		health.down = time.Since(monitor.downSince)
+		health.DownSeconds = int64(health.down.Seconds())
+		return health
+	}
+	health.Reachable = true
+	health.LatencyMS = float64(monitor.latency.Microseconds()) / 1000
+	return health
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	passphraseField = "passphrase"
+	maxFormSize     = 4096
+)
+
+// knockRequest describes a request from a client without a session that asks
+// for one.
+type knockRequest struct {
+	// Recorded as the session value so grants can be attributed
+	via string
+	// Used in logs; must never contain secret values
+	description string
+	// Prefix removed from the path before redirecting or proxying
+	stripPrefix string
+	// Session TTL, overriding the app's when non-zero
+	ttl time.Duration
+	// Proxy the knocking request instead of redirecting browsers
+	proxy bool
+	// Only a POST confirming the knock grants the session
+	confirm bool
+	// Single-use knocks (TOTP codes, one-time tokens) must be claimed before
+	// granting; nil for reusable ones
+	claim func() bool
+}
+
+// detectKnock checks whether a request knocks via one of the app's configured
+// methods: a secret path (optionally with a TOTP code), a one-time path, the
+// secret query parameter, the knock header, or a signed or emailed link. It returns nil if
+// it doesn't. Single-use knocks are only claimed later, once confirmed.
+func detectKnock(app *AppConfig, request *http.Request, ip string) *knockRequest {
+	confirm := needsKnockConfirmation(app, request)
+
+	if secretPath, isSecretPath := matchSecretPath(app, request.URL.Path); isSecretPath {
+		label := secretPathLabel(app, secretPath)
+		knock := &knockRequest{via: label, description: label, confirm: confirm}
+		if app.StripSecretPath {
+			knock.stripPrefix = secretPath
+		}
+		if app.TOTPKey != nil {
+			knock.claim = func() bool { return claimTOTPCode(request.Context(), app, secretPath) }
+		}
+		return knock
+	}
+
+	if token, knockPath, isOneTimePath := matchOneTimePath(app, request.URL.Path); isOneTimePath {
+		return &knockRequest{via: "one-time token", description: "one-time token", stripPrefix: knockPath, confirm: confirm,
+			claim: func() bool { return consumeOneTimeToken(request.Context(), app, token) }}
+	}
+
+	if hasSecretQuery(app, request) {
+		return &knockRequest{via: "query", description: "secret query", confirm: confirm}
+	}
+
+	if app.KnockHeader != "" {
+		if token := request.Header.Get(app.KnockHeader); token != "" {
+			if secretEqual(token, app.KnockToken) {
+				return &knockRequest{via: "header", description: "knock header " + app.KnockHeader, proxy: true}
+			}
+			// Falls through to the deny path, which counts it as a failed attempt
+			app.infof("Rejected invalid %s token from %s", app.KnockHeader, ip)
+		}
+	}
+
+	if isEmailLink(app, request) {
+		address, nonce, err := verifyEmailLink(app, request.URL.Query(), time.Now())
+		if err == nil {
+			return &knockRequest{via: "email " + address, description: "email link for " + address, stripPrefix: app.EmailPath, confirm: confirm,
+				claim: func() bool { return claimEmailNonce(request.Context(), app, nonce) }}
+		}
+		app.infof("Rejected email link from %s: %v", ip, err)
+	}
+
+	if app.SigningKey != nil && request.URL.Path == app.SignedPath {
+		ttl, err := verifySignedKnock(app, request.URL.Query(), time.Now())
+		if err == nil {
+			return &knockRequest{via: "signed link", description: "signed link", stripPrefix: app.SignedPath, ttl: ttl, confirm: confirm}
+		}
+		app.infof("Rejected signed link from %s: %v", ip, err)
+	}
+
+	return nil
+}
+
+// needsKnockConfirmation reports whether link-based knocks (secret or one-time
+// path, query, signed or emailed link) from this client must be confirmed with a POST. Header knocks
+// are never followed by link previewers and don't need it. A knock passphrase
+// always has to be POSTed, whatever the client.
+func needsKnockConfirmation(app *AppConfig, request *http.Request) bool {
+	if app.KnockPassphrase != nil {
+		return true
+	}
+	if !app.ConfirmKnock {
+		return false
+	}
+	return !app.ConfirmBrowsersOnly || app.BrowserRegex.MatchString(request.Header.Get("User-Agent"))
+}
+
+// knockUserAgentAllowed reports whether the request's User-Agent may knock. A
+// missing User-Agent never matches.
+func knockUserAgentAllowed(app *AppConfig, request *http.Request) bool {
+	if app.KnockUserAgentRegex == nil {
+		return true
+	}
+	userAgent := request.Header.Get("User-Agent")
+	return userAgent != "" && app.KnockUserAgentRegex.MatchString(userAgent)
+}
+
+// confirmKnock runs the confirmation step of a knock that needs one and
+// reports whether it may grant a session. Otherwise the request has already
+// been answered with the confirmation page or passphrase form.
+func confirmKnock(responseWriter http.ResponseWriter, request *http.Request, app *AppConfig, ip string, knock *knockRequest) bool {
+	if request.Method != http.MethodPost {
+		app.infof("Asking %s to confirm knock via %s", ip, knock.description)
+		serveKnockForm(responseWriter, request, app, "", http.StatusOK)
+		return false
+	}
+	if app.KnockPassphrase == nil {
+		return true
+	}
+
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, maxFormSize)
+	passphrase := request.PostFormValue(passphraseField)
+	if bcrypt.CompareHashAndPassword(app.KnockPassphrase, []byte(passphrase)) == nil {
+		return true
+	}
+	app.infof("Wrong passphrase from %s", ip)
+	if app.RateLimiter != nil {
+		app.RateLimiter.consume(ip)
+	}
+	recordFailedAttempt(request.Context(), app, ip)
+	serveKnockForm(responseWriter, request, app, "Wrong passphrase", http.StatusUnauthorized)
+	return false
+}
+
+// isRedirectableBrowser reports whether a client that just knocked should be
+// redirected rather than have the request forwarded.
+func isRedirectableBrowser(app *AppConfig, userAgent string) bool {
+	if !app.BrowserRegex.MatchString(userAgent) {
+		return false
+	}
+	return app.RedirectAndroid || !strings.Contains(strings.ToLower(userAgent), "android")
+}
+
+// knockRedirectTarget returns where a browser is redirected after a knock:
+// the stripped request path, or the app's post_knock_redirect resolved against
+// it. The remaining query string is carried over unless the configured target
+// has a query of its own.
+func knockRedirectTarget(app *AppConfig, strippedPath, rawQuery string) string {
+	target := &url.URL{Path: strippedPath, RawQuery: rawQuery}
+	if app.PostKnockRedirect == nil {
+		return target.String()
+	}
+
+	redirect := target.ResolveReference(app.PostKnockRedirect)
+	if app.PostKnockRedirect.RawQuery == "" {
+		redirect.RawQuery = rawQuery
+	}
+	return redirect.String()
+}
+
+// stripKnockParameters removes knock credentials carried in the query string
+// or headers so they never reach the upstream.
+func stripKnockParameters(app *AppConfig, request *http.Request) {
+	if app.KnockHeader != "" {
+		request.Header.Del(app.KnockHeader)
+	}
+	if app.SecretQueryName != "" {
+		stripQueryParameters(request, app.SecretQueryName)
+	}
+	if app.SigningKey != nil && request.URL.Path == app.SignedPath {
+		stripQueryParameters(request, signedExpiresParameter, signedTTLParameter, signedSignatureParameter)
+	}
+	if isEmailLink(app, request) {
+		stripQueryParameters(request, emailAddressParameter, signedExpiresParameter, emailNonceParameter, signedSignatureParameter)
+	}
+}
+
+// matchSecretPath returns the app's secret path that path matches, preferring
+// the longest one when several match. In TOTP and rotation mode the prefix
+// must be followed by a valid code or segment, and the returned knock path
+// includes it.
+func matchSecretPath(app *AppConfig, path string) (string, bool) {
+	if app.TOTPKey != nil {
+		return matchTOTPPath(app, path)
+	}
+	if app.RotationSeed != nil {
+		return matchRotatedPath(app, path)
+	}
+	match := ""
+	for _, prefix := range app.SecretPathPrefixes {
+		if secretPathMatches(app, path, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	return match, match != ""
+}
+
+// secretPathLabel names a knock path matchSecretPath returned after the
+// position of its secret path in secret_path, e.g. "secret path #2", for logs
+// and granted_via, which must not contain the path itself.
+func secretPathLabel(app *AppConfig, knockPath string) string {
+	number, longest := 0, -1
+	for i, prefix := range app.SecretPathPrefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if strings.HasPrefix(knockPath, prefix) && len(prefix) > longest {
+			number, longest = i+1, len(prefix)
+		}
+	}
+	return fmt.Sprintf("secret path #%d", number)
+}
+
+// logPath returns a request path for logs, with a secret or one-time knock
+// path in it replaced by a label, since they grant access. Events get it too.
+func logPath(app *AppConfig, path string) string {
+	// The default logout path is below the first secret path
+	if path == app.LogoutPath && app.config["logout_path"] == "" {
+		return "<secret path #1>/logout"
+	}
+	if knockPath, found := matchSecretPath(app, path); found {
+		return "<" + secretPathLabel(app, knockPath) + ">" + path[len(knockPath):]
+	}
+	if _, knockPath, found := matchOneTimePath(app, path); found {
+		return "<one-time token>" + path[len(knockPath):]
+	}
+	return path
+}
+
+// secretPathMatches compares path against a secret path in constant time. In
+// exact mode only the secret path itself (optionally with a trailing slash)
+// matches; otherwise any path starting with it does. Only the fixed-length
+// candidate is compared, so timing doesn't reveal how much of it was correct.
+func secretPathMatches(app *AppConfig, path, secretPath string) bool {
+	candidate := path
+	if app.SecretPathExact {
+		if !strings.HasSuffix(secretPath, "/") {
+			candidate = strings.TrimSuffix(path, "/")
+		}
+		if len(candidate) != len(secretPath) {
+			return false
+		}
+	} else {
+		if len(candidate) < len(secretPath) {
+			return false
+		}
+		candidate = candidate[:len(secretPath)]
+	}
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(secretPath)) == 1
+}
+
+// hasSecretQuery reports whether the request carries the app's secret query
+// parameter with the correct value. The comparison is constant-time.
+func hasSecretQuery(app *AppConfig, request *http.Request) bool {
+	if app.SecretQueryName == "" {
+		return false
+	}
+	for _, value := range request.URL.Query()[app.SecretQueryName] {
+		if secretEqual(value, app.SecretQueryValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripQueryParameters removes the named query parameters from the request,
+// keeping the other parameters in their original order.
+func stripQueryParameters(request *http.Request, names ...string) {
+	if request.URL.RawQuery == "" {
+		return
+	}
+	var kept []string
+	for _, parameter := range strings.Split(request.URL.RawQuery, "&") {
+		name, _, _ := strings.Cut(parameter, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && slices.Contains(names, unescaped) {
+			continue
+		}
+		kept = append(kept, parameter)
+	}
+	request.URL.RawQuery = strings.Join(kept, "&")
+}
+
+// secretEqual compares a candidate against a secret in constant time. Both are
+// hashed first so the comparison doesn't leak the secret's length either.
+func secretEqual(candidate, secret string) bool {
+	candidateHash := sha256.Sum256([]byte(candidate))
+	secretHash := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(candidateHash[:], secretHash[:]) == 1
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecretPathMatchesSharedPrefix(t *testing.T) {
+	tests := []struct {
+		path          string
+		exact, prefix bool
+	}{
+		{"/secret", true, true},
+		{"/secret/", true, true},
+		{"/secret/app", false, true},
+		{"/secret_path_anything_else", false, true},
+		{"/secre", false, false},
+		{"/secreT", false, false},
+		{"/other/secret", false, false},
+	}
+	for _, test := range tests {
+		if got := secretPathMatches(&AppConfig{SecretPathExact: true}, test.path, "/secret"); got != test.exact {
+			t.Errorf("secretPathMatches(%q) in exact mode = %t, want %t", test.path, got, test.exact)
+		}
+		if got := secretPathMatches(&AppConfig{}, test.path, "/secret"); got != test.prefix {
+			t.Errorf("secretPathMatches(%q) in prefix mode = %t, want %t", test.path, got, test.prefix)
+		}
+	}
+}
+
+func TestKnockHidesSecretPath(t *testing.T) {
+	const secretPath = "/s3cret-knock-path"
+	for _, confirm := range []string{"false", "true"} {
+		t.Run("confirm_knock="+confirm, func(t *testing.T) {
+			upstream, _ := countingUpstream(t, nil)
+			useSessionStore(t, newMemoryStore())
+			app := useApp(t, map[string]string{
+				"hostname":      "app.example.com",
+				"upstream_url":  upstream.URL,
+				"secret_path":   "/other-path," + secretPath,
+				"session_ttl":   "1h",
+				"confirm_knock": confirm,
+			})
+			logs := captureLogs(t)
+			handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://app.example.com"+secretPath+"/photos", nil))
+			if confirm == "true" {
+				handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://app.example.com"+secretPath+"/photos", nil))
+			}
+
+			sessions, err := sessionStore.Exists(context.Background(), app, []string{ipSessionKey(app, "192.0.2.1")})
+			if err != nil || !sessions[0].exists {
+				t.Fatalf("knock granted no session: %v\n%s", err, logs)
+			}
+			if via := sessions[0].metadata["granted_via"]; via != "secret path #2" {
+				t.Errorf("granted_via = %q, want secret path #2", via)
+			}
+			if strings.Contains(logs.String(), secretPath) {
+				t.Errorf("logs contain the secret path:\n%s", logs)
+			}
+			for _, want := range []string{"Request from 192.0.2.1 GET <secret path #2>/photos", "Access granted to 192.0.2.1 via secret path #2"} {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logs don't contain %q:\n%s", want, logs)
+				}
+			}
+			if confirm == "true" && !strings.Contains(logs.String(), "Asking 192.0.2.1 to confirm knock via secret path #2") {
+				t.Errorf("logs don't name the secret path asked to confirm:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestLogPath(t *testing.T) {
+	app := &AppConfig{SecretPathPrefixes: []string{"/knock", "/knock-admin/"}, SecretPathExact: true, OncePath: "/once", LogoutPath: "/knock/logout"}
+	tests := map[string]string{
+		"/knock":             "<secret path #1>",
+		"/knock-admin/":      "<secret path #2>",
+		"/knock/logout":      "<secret path #1>/logout",
+		"/once/abc123":       "<one-time token>",
+		"/once/abc123/files": "<one-time token>/files",
+		"/knock/photos":      "/knock/photos",
+		"/photos":            "/photos",
+	}
+	for path, want := range tests {
+		if got := logPath(app, path); got != want {
+			t.Errorf("logPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+// Knock limits cap how many sessions an app grants and how many failed
+// attempts it accepts per minute across all client IPs. The counters live in
+// Redis so every replica shares the same budget.
+const knockLimitWindow = time.Minute
+
+const (
+	knockLimitGrants   = "grants"
+	knockLimitFailures = "failures"
+)
+
+// knockLimitRetryAfter reports how long unauthenticated requests to app are
+// turned away because a knock limit was reached in the current window, or
+// zero if they aren't. Redis errors are logged and don't limit anything.
+func knockLimitRetryAfter(ctx context.Context, app *AppConfig) time.Duration {
+	if app.MaxGrantsPerMinute == 0 && app.MaxFailuresPerMinute == 0 {
+		return 0
+	}
+	now := time.Now()
+	counts, err := redisClient.MGet(ctx, knockLimitKey(app, knockLimitGrants, now), knockLimitKey(app, knockLimitFailures, now)).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return 0
+	}
+	if knockLimitReached(counts[0], app.MaxGrantsPerMinute) || knockLimitReached(counts[1], app.MaxFailuresPerMinute) {
+		return now.Truncate(knockLimitWindow).Add(knockLimitWindow).Sub(now)
+	}
+	return 0
+}
+
+func knockLimitReached(count any, limit int) bool {
+	if limit == 0 || count == nil {
+		return false
+	}
+	value, err := strconv.Atoi(count.(string))
+	return err == nil && value >= limit
+}
+
+// countKnockGrant counts a granted session toward the app's grant limit.
+func countKnockGrant(ctx context.Context, app *AppConfig) {
+	countKnockLimit(ctx, app, knockLimitGrants, app.MaxGrantsPerMinute)
+}
+
+// countKnockFailure counts a failed attempt toward the app's failure limit.
+func countKnockFailure(ctx context.Context, app *AppConfig) {
+	countKnockLimit(ctx, app, knockLimitFailures, app.MaxFailuresPerMinute)
+}
+
+// countKnockLimit increments the counter of the current window. The replica
+// whose increment reaches the limit reports it, so the alert fires only once
+// per window.
+func countKnockLimit(ctx context.Context, app *AppConfig, kind string, limit int) {
+	if limit == 0 {
+		return
+	}
+	key := knockLimitKey(app, kind, time.Now())
+	var count *redis.IntCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 2*knockLimitWindow)
+		return nil
+	})
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return
+	}
+	if count.Val() == int64(limit) {
+		app.errorf("Knock limit reached: %d %s within a minute, turning away unauthenticated requests until the next minute", limit, kind)
+		notifyKnockLimit(app, kind, limit)
+	}
+}
+
+func knockLimitKey(app *AppConfig, kind string, now time.Time) string {
+	return appKey(app, "limit:%s:%d", kind, now.Unix()/int64(knockLimitWindow.Seconds()))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// LOG_LEVEL, the level of the lines logged without an app and the default of
+// the apps' log_level
+var logLevel slog.LevelVar
+
+// defaultLogger logs the lines of no particular app, at LOG_LEVEL.
+var defaultLogger = slog.New(&logHandler{level: &logLevel})
+
+// newAppLogger returns the logger of an app's lines at its log_level, with
+// the app attribute set to hostname, the requested one for wildcard apps.
+func newAppLogger(level slog.Level, hostname string) *slog.Logger {
+	return slog.New(&logHandler{level: level}).With("app", hostname)
+}
+
+// logHandler writes records as mithrandir's plain log lines, through the
+// standard logger: the level unless it's INFO, the app attribute as a
+// [hostname] prefix, the message, then any other attributes as key=value.
+type logHandler struct {
+	level slog.Leveler
+	app   string
+	attrs []slog.Attr
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(_ context.Context, record slog.Record) error {
+	var line strings.Builder
+	if record.Level != slog.LevelInfo {
+		line.WriteString(record.Level.String() + " ")
+	}
+	if h.app != "" {
+		line.WriteString("[" + h.app + "] ")
+	}
+	line.WriteString(record.Message)
+	write := func(attr slog.Attr) bool {
+		fmt.Fprintf(&line, " %s=%v", attr.Key, attr.Value)
+		return true
+	}
+	for _, attr := range h.attrs {
+		write(attr)
+	}
+	record.Attrs(write)
+	log.Print(line.String())
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		if attr.Key == "app" {
+			next.app = attr.Value.String()
+		} else {
+			next.attrs = append(next.attrs, attr)
+		}
+	}
+	return &next
+}
+
+// WithGroup is a no-op: mithrandir's lines have no groups.
+func (h *logHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level '%s'", level)
+}
+
+// logf formats a line for logger, unless its level is filtered anyway.
+func logf(logger *slog.Logger, level slog.Level, format string, args []any) {
+	if logger.Enabled(context.Background(), level) {
+		logger.Log(context.Background(), level, fmt.Sprintf(format, args...))
+	}
+}
+
+func debugf(format string, args ...any) {
+	logf(defaultLogger, slog.LevelDebug, format, args)
+}
+
+func infof(format string, args ...any) {
+	logf(defaultLogger, slog.LevelInfo, format, args)
+}
+
+func warnf(format string, args ...any) {
+	logf(defaultLogger, slog.LevelWarn, format, args)
+}
+
+func errorf(format string, args ...any) {
+	logf(defaultLogger, slog.LevelError, format, args)
+}
+
+// The app's own log lines, through its logger: prefixed with its hostname,
+// at its log_level rather than LOG_LEVEL's.
+
+func (app *AppConfig) debugf(format string, args ...any) {
+	logf(app.log(), slog.LevelDebug, format, args)
+}
+
+func (app *AppConfig) infof(format string, args ...any) {
+	logf(app.log(), slog.LevelInfo, format, args)
+}
+
+func (app *AppConfig) warnf(format string, args ...any) {
+	logf(app.log(), slog.LevelWarn, format, args)
+}
+
+func (app *AppConfig) errorf(format string, args ...any) {
+	logf(app.log(), slog.LevelError, format, args)
+}
+
+// log returns the app's logger; apps not parsed by parseAppConfig log at
+// LOG_LEVEL.
+func (app *AppConfig) log() *slog.Logger {
+	if app.logger == nil {
+		return defaultLogger.With("app", app.requestHost())
+	}
+	return app.logger
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAppLogLevel(t *testing.T) {
+	logs := captureLogs(t)
+	parse := func(hostname, level string) *AppConfig {
+		app, err := parseAppConfig(map[string]string{
+			"hostname":     hostname,
+			"upstream_url": "http://127.0.0.1:8080",
+			"secret_path":  "/knock",
+			"session_ttl":  "1h",
+			"log_level":    level,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+	debugging, quiet := parse("debug.example.com", "debug"), parse("quiet.example.com", "warn")
+	wildcard, _ := lookupApp(map[string]*AppConfig{"*.example.com": parse("*.example.com", "info")}, "pr-1.example.com")
+
+	debugging.debugf("Checking %s", "192.0.2.1")
+	quiet.infof("Forwarding request from %s", "192.0.2.1")
+	quiet.warnf("Rate limit exceeded for %s", "192.0.2.1")
+	wildcard.infof("Request from %s", "192.0.2.1")
+	debugging.logger.Info("Granted", "ip", "192.0.2.1")
+
+	want := []string{
+		"DEBUG [debug.example.com] Checking 192.0.2.1",
+		"WARN [quiet.example.com] Rate limit exceeded for 192.0.2.1",
+		"[pr-1.example.com] Request from 192.0.2.1",
+		"[debug.example.com] Granted ip=192.0.2.1",
+	}
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("logged %d lines, want %d:\n%s", len(lines), len(want), logs)
+	}
+	for i, line := range lines {
+		// After the standard logger's date and time
+		if _, message, _ := strings.Cut(line, " "); !strings.HasSuffix(message, " "+want[i]) {
+			t.Errorf("line %d is %q, want %q", i+1, line, want[i])
+		}
+	}
+}
@@ -1,189 +1,1821 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/pires/go-proxyproto"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// ipMatcher matches a client IP against a CIDR (or exact IP) or, when the
+// pattern was given with a "regex:" prefix, against a regular expression.
+type ipMatcher struct {
+	pattern string
+	prefix  netip.Prefix
+	regex   *regexp.Regexp
+}
+
 type AppConfig struct {
-	Hostname         string
-	SecretPathPrefix string
-	UpstreamURL      *url.URL
-	AllowIPs         []*regexp.Regexp
+	// Or a wildcard like *.apps.example.com, matching the hostnames below it
+	// that have no app of their own, or * for the default app, serving those
+	// no other app matches
+	Hostname string
+	// Further hostnames served by the app, sharing its sessions, which are
+	// keyed by Hostname
+	Aliases []string
+	// Secret path prefixes, any of which grants a session
+	SecretPathPrefixes []string
+	// Only the exact secret path grants a session, not paths below it
+	SecretPathExact bool
+	// Whether the secret path prefix is removed before proxying
+	StripSecretPath bool
+	// With a TOTP key, secret paths must be followed by a current TOTP code
+	TOTPKey          []byte
+	TOTPRejectReplay bool
+	// With a rotation seed, secret paths must be followed by a segment
+	// derived from the seed that changes every RotationInterval; the previous
+	// one stays valid for RotationOverlap
+	RotationSeed     []byte
+	RotationInterval time.Duration
+	RotationOverlap  time.Duration
+	// Link knocks only grant a session when confirmed with a POST from the
+	// page shown on GET, optionally only for browsers
+	ConfirmKnock        bool
+	ConfirmBrowsersOnly bool
+	// Bcrypt hash of a passphrase that must be POSTed with link knocks
+	KnockPassphrase []byte
+	// User agents that get a redirect after a knock; Android is excluded
+	// unless RedirectAndroid is set, since its apps often use browser UAs
+	BrowserRegex    *regexp.Regexp
+	RedirectAndroid bool
+	// Knocks only grant a session to user agents matching this, if set
+	KnockUserAgentRegex *regexp.Regexp
+	// Where browsers are sent after a knock instead of the stripped path
+	PostKnockRedirect *url.URL
+	// Requests with a session to LogoutPath end it
+	LogoutPath string
+	// Paths below OncePath knock with single-use tokens issued by -once
+	OncePath string
+	// Allowed addresses can request single-use login links, valid for
+	// EmailLinkTTL, from the form at EmailPath
+	AllowedEmails    map[string]bool
+	EmailPath        string
+	EmailLinkTTL     time.Duration
+	EmailRateLimiter *rateLimiter
+	// With a signing key, HMAC-signed links to SignedPath grant a session
+	SigningKey []byte
+	SignedPath string
+	// Optional query parameter (name and value) that grants a session
+	SecretQueryName  string
+	SecretQueryValue string
+	// Optional request header (name and token) that grants a session
+	KnockHeader string
+	KnockToken  string
+	UpstreamURL *url.URL
+	// Forwards the app's requests to UpstreamURL, built once with the app
+	Proxy *httputil.ReverseProxy
+	// How the app's upstream transport is set up, see upstreamTransport
+	upstream upstreamOptions
+	// Deadline of a request to the upstream, body included; 0 for none
+	UpstreamTimeout time.Duration
+	// Host header sent upstream instead of the client's, if set
+	UpstreamHost string
+	// How the client's forwarding headers reach the upstream, one of the
+	// forwardedHeaders policies
+	ForwardedHeaders string
+	// Headers set on every request to the upstream, by canonical name; their
+	// values may hold the placeholders of requestHeaderPlaceholders
+	RequestHeaders map[string]string
+	// Path prefixes or globs forwarded without a session; alternatively,
+	// only ProtectedPaths (and knock paths) require one
+	PublicPaths    []string
+	ProtectedPaths []string
+	AllowIPs       []ipMatcher
+	BlockIPs       []ipMatcher
+	// IPs given a session without expiry at startup, as if they had knocked
+	PreauthorizedIPs map[string]bool
+	AllowPrivate     bool
+	AllowASNs        map[uint]bool
 	SessionTTL       time.Duration
-	AutoRenew        bool
+	// Sessions are bound to the client IP, a session cookie or both
+	SessionMode string
+	// Apps in the same session group share their sessions
+	SessionGroup string
+	// A wildcard app's sessions are shared by all the hostnames it matches,
+	// instead of being kept per hostname
+	ShareSessions bool
+	// IP sessions cover the client's network of this size, e.g. a /64
+	SessionIPv4Prefix int
+	SessionIPv6Prefix int
+	AutoRenew         bool
+	// Sessions only work for the User-Agent (ignoring versions) that knocked
+	BindUserAgent bool
+	// What happens to requests when the session store fails, one of the
+	// storeFailure modes; grace honors sessions seen within StoreFailureGrace
+	StoreFailure      string
+	StoreFailureGrace time.Duration
+	graceSessions     *sessionGrace
+	// Proxied requests carry the session's expiry in sessionExpiresHeader
+	ExposeSessionTTL bool
+	// Sessions are renewed at most once per this fraction of their TTL
+	RenewFraction float64
+	renewals      *renewThrottle
+	// Knocks are refused while this many sessions exist; 0 means no limit
+	MaxSessions int
+	// Sessions end this long after the knock, even when renewed; 0 disables
+	MaxSessionAge  time.Duration
+	TrustedProxies []netip.Prefix
+	TrustedHops    int
+	IPHeaders      []string
+	IPFromHeaders  bool
+	// Set once a forwarding header has been ignored and logged; shared with
+	// the copies of lookupApp
+	ignoredHeaderWarned *atomic.Bool
+	AllowCountries      map[string]bool
+	DenyCountries       map[string]bool
+	// Whether IPs without a known country pass the country rules
+	GeoIPAllowUnknown bool
+	// Rendered for denied requests instead of the plain text 403
+	DenyPage    *template.Template
+	DenyContact string
+	// Rendered instead of the plain text 502 or 504 when the upstream fails
+	ErrorPage *template.Template
+	// Denied requests are redirected here instead, e.g. to a decoy site
+	DenyRedirectURL *url.URL
+	// 403, 404 (like an unknown hostname) or 444 (close the connection)
+	DenyStatus int
+	// Denied requests are held this long before being answered
+	DenyDelay time.Duration
+	// Notified of every granted session; nil when disabled
+	GrantWebhookURL *url.URL
+	// Limits unauthenticated requests per client IP; nil when disabled
+	RateLimiter *rateLimiter
+	// Per-minute caps on granted sessions and failed attempts across all
+	// clients, shared by replicas through Redis; 0 disables them
+	MaxGrantsPerMinute   int
+	MaxFailuresPerMinute int
+	// Denied requests within BanWindow that trigger a ban; 0 disables bans
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+	metrics      *appMetrics
+	// Of the app's log lines, LOG_LEVEL's unless set
+	LogLevel slog.Level
+	// Logs its lines at LogLevel, see newAppLogger
+	logger *slog.Logger
+	// The settings it was parsed from, to tell whether a reload changes it
+	config map[string]string
+	// The requested hostname, on the copies of wildcard apps lookupApp
+	// returns; empty otherwise
+	host string
 }
 
 var (
-	ctx          = context.Background()
-	redisClient  *redis.Client
+	// For Redis calls outside of requests, like background workers and
+	// startup; requests use their own context
+	backgroundContext = context.Background()
+	redisClient       redis.UniversalClient
+	// Prepended to every Redis key, see redisKey
+	redisKeyPrefix string
+	// Set for REDIS_CLUSTER_ADDRS, see hashTag
+	redisCluster bool
 	browserRegex = regexp.MustCompile(`(?i)Mozilla|Chrome|Safari|Edge|Opera|Firefox`)
-	apps         map[string]*AppConfig
+	// The apps by hostname, replaced as a whole by reloads; see currentApps
+	loadedApps atomic.Pointer[map[string]*AppConfig]
+	// Default trusted proxy ranges, used by apps that don't set their own
+	trustedProxies []netip.Prefix
+	// Default number of trusted proxy hops in front of the proxy
+	trustedHops int
+	// Default for whether client IP headers are consulted at all
+	ipFromHeaders bool
+	// Served for hostnames without an app; nil for plain text
+	notFoundPage *template.Template
+	// Default grant webhook, used by apps that don't set their own
+	grantWebhookURL *url.URL
+	// Headers consulted for the client IP, in order, unless an app sets ip_headers
+	defaultIPHeaders = []string{
+		"CF-Connecting-IP",    // Cloudflare
+		"True-Client-IP",      // Akamai
+		"X-Real-IP",           // Common
+		"X-Forwarded-For",     // Common
+		"X-Cluster-Client-IP", // Common
+		"Fastly-Client-IP",    // Fastly
+		"Forwarded",           // RFC 7239
+	}
 )
 
 func main() {
-	// Load environment config
-	listenAddress := getenv("LISTEN_ADDRESS", ":8080")
-	redisAddress := getenv("REDIS_ADDRESS", "redis:6379")
-	redisPassword := getenv("REDIS_PASSWORD", "")
+	totpHostname := flag.String("totp", "", "print the current TOTP knock path for the given app hostname and exit")
+	rotatedHostname := flag.String("rotated-path", "", "print the current rotated secret path for the given app hostname and exit")
+	signHostname := flag.String("sign", "", "print a signed knock link for the given app hostname and exit")
+	signExpires := flag.Duration("sign-expires", 24*time.Hour, "how long a link created with -sign stays valid")
+	signTTL := flag.Duration("sign-ttl", 0, "custom session TTL embedded in a link created with -sign (default: the app's session_ttl)")
+	onceHostname := flag.String("once", "", "store a one-time knock token for the given app hostname in Redis, print its link and exit")
+	onceTTL := flag.Duration("once-ttl", 7*24*time.Hour, "how long a token created with -once stays valid")
+	hashPassphrase := flag.Bool("hash-passphrase", false, "read a passphrase from stdin, print its bcrypt hash for knock_passphrase and exit")
+	validate := flag.Bool("validate", false, "check the configuration, print a summary of each app and exit, without connecting to Redis or listening")
+	dumpConfig := flag.Bool("dump-config", false, "print the effective configuration as JSON, secrets masked, and exit")
+	defineSettingFlags()
+	flag.Parse()
+
+	if *hashPassphrase {
+		passphrase, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && passphrase == "" {
+			log.Fatalf("Failed to read passphrase: %v", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(passphrase, "\r\n")), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("Failed to hash passphrase: %v", err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
+	// Load environment config, defaulting to the config file's settings
+	if err := loadSecretFiles(); err != nil {
+		log.Fatalf("Invalid secret file: %v", err)
+	}
+	var err error
+	if path := setting("CONFIG_FILE"); path != "" {
+		appsFile, err = loadConfigFile(path)
+		if err != nil {
+			log.Fatalf("Invalid CONFIG_FILE: %v", err)
+		}
+	}
+	configWatch, err := strconv.ParseBool(setting("CONFIG_WATCH"))
+	if err != nil {
+		log.Fatalf("Invalid CONFIG_WATCH: %s", setting("CONFIG_WATCH"))
+	}
+	if configWatch && appsFile == nil {
+		log.Fatalf("CONFIG_WATCH requires CONFIG_FILE")
+	}
+	listenAddress := setting("LISTEN_ADDRESS")
+	redisKeyPrefix = setting("REDIS_KEY_PREFIX")
+	storeBackend := strings.ToLower(setting("STORE"))
+	if storeBackend != "redis" && storeBackend != "memory" && storeBackend != "bolt" {
+		log.Fatalf("Invalid STORE: %s (expected redis, memory or bolt)", storeBackend)
+	}
+	storeFile := setting("STORE_FILE")
+
+	configSource = strings.ToLower(setting("CONFIG_SOURCE"))
+	if configSource != "env" && configSource != "redis" {
+		log.Fatalf("Invalid CONFIG_SOURCE: %s (expected env or redis)", configSource)
+	}
+	configRedisKey = redisKey("%s", setting("CONFIG_REDIS_KEY"))
+	configPollInterval, err := time.ParseDuration(setting("CONFIG_POLL_INTERVAL"))
+	if err != nil || configPollInterval < 0 {
+		log.Fatalf("Invalid CONFIG_POLL_INTERVAL: %s", setting("CONFIG_POLL_INTERVAL"))
+	}
+	dockerDiscovery, err := strconv.ParseBool(setting("DOCKER_DISCOVERY"))
+	if err != nil {
+		log.Fatalf("Invalid DOCKER_DISCOVERY: %s", setting("DOCKER_DISCOVERY"))
+	}
+	dockerHost := setting("DOCKER_HOST")
+	if dockerDiscovery {
+		dockerClient, dockerBaseURL, err = newDockerClient(dockerHost)
+		if err != nil {
+			log.Fatalf("Invalid DOCKER_HOST: %v", err)
+		}
+	}
+	dockerGracePeriod, err = time.ParseDuration(setting("DOCKER_GRACE_PERIOD"))
+	if err != nil || dockerGracePeriod < 0 {
+		log.Fatalf("Invalid DOCKER_GRACE_PERIOD: %s", setting("DOCKER_GRACE_PERIOD"))
+	}
+	if configSource == "redis" {
+		switch {
+		case storeBackend != "redis":
+			log.Fatalf("CONFIG_SOURCE=redis requires STORE=redis")
+		case appsFile != nil && len(appsFile.apps) > 0:
+			log.Fatalf("CONFIG_FILE can't have apps with CONFIG_SOURCE=redis")
+		case configWatch:
+			log.Fatalf("CONFIG_WATCH can't be used with CONFIG_SOURCE=redis, which is watched anyway")
+		case *validate:
+			log.Fatalf("-validate doesn't connect to Redis; check the config with APPS_CONFIG instead")
+		}
+	}
+
+	level, err := parseLogLevel(setting("LOG_LEVEL"))
+	if err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	logLevel.Set(level)
+
+	redisSettings, err := loadRedisConfig()
+	if err != nil {
+		log.Fatalf("Invalid Redis configuration: %v", err)
+	}
+
+	trustedProxies, err = parsePrefixes(setting("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	proxyProtocol, _ := strconv.ParseBool(setting("PROXY_PROTOCOL"))
+	proxyProtocolSources, err := parsePrefixes(setting("PROXY_PROTOCOL_SOURCES"))
+	if err != nil {
+		log.Fatalf("Invalid PROXY_PROTOCOL_SOURCES: %v", err)
+	}
+
+	ipFromHeaders, err = strconv.ParseBool(setting("IP_FROM_HEADERS"))
+	if err != nil {
+		log.Fatalf("Invalid IP_FROM_HEADERS: %v", err)
+	}
+
+	if err := loadUpstreamDefaults(); err != nil {
+		log.Fatalf("Invalid upstream configuration: %v", err)
+	}
+
+	trustedHops, err = strconv.Atoi(setting("TRUSTED_HOPS"))
+	if err != nil || trustedHops < 0 {
+		log.Fatalf("Invalid TRUSTED_HOPS: %s", setting("TRUSTED_HOPS"))
+	}
+
+	tarpitConnections, err := strconv.Atoi(setting("TARPIT_MAX_CONNECTIONS"))
+	if err != nil || tarpitConnections < 0 {
+		log.Fatalf("Invalid TARPIT_MAX_CONNECTIONS: %s", setting("TARPIT_MAX_CONNECTIONS"))
+	}
+	tarpitSlots = make(chan struct{}, tarpitConnections)
+
+	smtpSettings, err = loadSMTPConfig()
+	if err != nil {
+		log.Fatalf("Invalid SMTP configuration: %v", err)
+	}
+
+	metricsLogInterval, err := time.ParseDuration(setting("METRICS_LOG_INTERVAL"))
+	if err != nil || metricsLogInterval < 0 {
+		log.Fatalf("Invalid METRICS_LOG_INTERVAL: %s", setting("METRICS_LOG_INTERVAL"))
+	}
+
+	denialCacheTTL, err := time.ParseDuration(setting("DENIAL_CACHE_TTL"))
+	if err != nil || denialCacheTTL < 0 {
+		log.Fatalf("Invalid DENIAL_CACHE_TTL: %s", setting("DENIAL_CACHE_TTL"))
+	}
+	denialCacheSize, err := strconv.Atoi(setting("DENIAL_CACHE_SIZE"))
+	if err != nil || denialCacheSize < 1 {
+		log.Fatalf("Invalid DENIAL_CACHE_SIZE: %s", setting("DENIAL_CACHE_SIZE"))
+	}
+	if denialCacheTTL > 0 {
+		denials = newDenialCache(denialCacheTTL, denialCacheSize)
+	}
+
+	sessionCacheTTL, err := time.ParseDuration(setting("SESSION_CACHE_TTL"))
+	if err != nil || sessionCacheTTL < 0 {
+		log.Fatalf("Invalid SESSION_CACHE_TTL: %s", setting("SESSION_CACHE_TTL"))
+	}
+	sessionCacheSize, err := strconv.Atoi(setting("SESSION_CACHE_SIZE"))
+	if err != nil || sessionCacheSize < 1 {
+		log.Fatalf("Invalid SESSION_CACHE_SIZE: %s", setting("SESSION_CACHE_SIZE"))
+	}
+
+	sessionExpiryEvents, err = strconv.ParseBool(setting("SESSION_EXPIRY_EVENTS"))
+	if err != nil {
+		log.Fatalf("Invalid SESSION_EXPIRY_EVENTS: %s", setting("SESSION_EXPIRY_EVENTS"))
+	}
+
+	eventStream = setting("EVENT_STREAM")
+	eventStreamMaxLen, err = strconv.ParseInt(setting("EVENT_STREAM_MAXLEN"), 10, 64)
+	if err != nil || eventStreamMaxLen < 1 {
+		log.Fatalf("Invalid EVENT_STREAM_MAXLEN: %s", setting("EVENT_STREAM_MAXLEN"))
+	}
+
+	healthListenAddress := setting("HEALTH_LISTEN_ADDRESS")
+	healthRedisThreshold, err = time.ParseDuration(setting("HEALTH_REDIS_THRESHOLD"))
+	if err != nil || healthRedisThreshold < 0 {
+		log.Fatalf("Invalid HEALTH_REDIS_THRESHOLD: %s", setting("HEALTH_REDIS_THRESHOLD"))
+	}
+
+	adminListenAddress := setting("ADMIN_LISTEN_ADDRESS")
+	adminTokens, err = parseAdminTokens(setting("ADMIN_TOKENS"))
+	if err != nil {
+		log.Fatalf("Invalid ADMIN_TOKENS: %v", err)
+	}
+	if adminListenAddress != "" && len(adminTokens) == 0 {
+		log.Fatalf("ADMIN_LISTEN_ADDRESS requires ADMIN_TOKENS")
+	}
+
+	if path := setting("NOT_FOUND_PAGE"); path != "" {
+		notFoundPage, err = loadPageTemplate(path)
+		if err != nil {
+			log.Fatalf("Invalid NOT_FOUND_PAGE: %v", err)
+		}
+	}
+
+	if webhook := setting("GRANT_WEBHOOK_URL"); webhook != "" {
+		grantWebhookURL, err = parseHTTPURL(webhook)
+		if err != nil {
+			log.Fatalf("Invalid GRANT_WEBHOOK_URL: %v", err)
+		}
+	}
+
+	setUpRedis := func() {
+		redisCluster = len(redisSettings.clusterAddresses) > 0
+		redisClient = redisSettings.newClient()
+
+		if err := redisSettings.connect(); err != nil {
+			log.Fatalf("Failed to connect to Redis at %s: %s", redisSettings, redisSettings.explainConnectError(err))
+		}
+		if err := redisSettings.selfTest(); err != nil {
+			log.Fatalf("Redis self-test failed: %v", err)
+		}
+		// Ahead of the circuit breaker, which would count its failures
+		redisHealthMonitor = newRedisMonitor(redisSettings.healthInterval)
+		redisClient.AddHook(redisHealthMonitor)
+		if redisSettings.breakerThreshold > 0 {
+			redisBreaker = newCircuitBreaker(redisSettings.breakerThreshold, redisSettings.breakerCooldown)
+			redisClient.AddHook(redisBreaker)
+		}
+	}
+	// The apps can only be read once Redis is connected
+	if configSource == "redis" {
+		setUpRedis()
+	}
+
+	if dockerClient != nil {
+		if _, err := syncDockerContainers(storeBackend); err != nil {
+			log.Fatalf("Failed to list Docker containers: %v", err)
+		}
+	}
+
+	// Load app configurations
+	apps, err := loadApps(storeBackend, appsFile)
+	if err != nil {
+		log.Fatalf("Invalid app config: %v", err)
+	}
+	loadedApps.Store(&apps)
+	recordConfigLoad(nil)
+	if storeBackend != "redis" {
+		if eventStream != "" {
+			log.Fatalf("EVENT_STREAM requires STORE=redis")
+		}
+		if sessionExpiryEvents {
+			log.Fatalf("SESSION_EXPIRY_EVENTS requires STORE=redis")
+		}
+	}
+
+	if *totpHostname != "" {
+		app, exists := lookupApp(apps, *totpHostname)
+		if !exists || app.TOTPKey == nil {
+			log.Fatalf("No app with totp_secret configured for hostname: %s", *totpHostname)
+		}
+		fmt.Println(currentTOTPPath(app))
+		return
+	}
+
+	if *rotatedHostname != "" {
+		app, exists := lookupApp(apps, *rotatedHostname)
+		if !exists || app.RotationSeed == nil {
+			log.Fatalf("No app with rotation_seed configured for hostname: %s", *rotatedHostname)
+		}
+		fmt.Println(currentRotatedPath(app))
+		return
+	}
+
+	if *signHostname != "" {
+		app, exists := lookupApp(apps, *signHostname)
+		if !exists || app.SigningKey == nil {
+			log.Fatalf("No app with signing_key configured for hostname: %s", *signHostname)
+		}
+		fmt.Println(signedKnockURL(app, *signExpires, *signTTL))
+		return
+	}
+
+	// GeoIP databases; loadApps made sure the apps' rules have theirs
+	if err := loadGeoIPDatabases(); err != nil {
+		log.Fatalf("Failed to load GeoIP database: %v", err)
+	}
+
+	if *validate {
+		printValidation(apps)
+		return
+	}
+	if *dumpConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(effectiveConfig(apps, appsFile)); err != nil {
+			log.Fatalf("Failed to print the configuration: %v", err)
+		}
+		return
+	}
+
+	// Session store; the memory and bolt stores need no Redis at all
+	switch storeBackend {
+	case "memory":
+		sessionStore = newMemoryStore()
+	case "bolt":
+		store, err := openBoltStore(storeFile)
+		if err != nil {
+			log.Fatalf("Failed to open session store file %s: %v", storeFile, err)
+		}
+		sessionStore = store
+	default:
+		if redisClient == nil {
+			setUpRedis()
+		}
+		sessionStore = redisStore{}
+		// The other stores are as fast as a cache would be
+		if sessionCacheTTL > 0 {
+			cachedSessions = newSessionCache(sessionCacheTTL, sessionCacheSize)
+		}
+	}
+
+	if *onceHostname != "" {
+		app, exists := lookupApp(apps, *onceHostname)
+		if !exists || app.OncePath == "" {
+			log.Fatalf("No app with once_path configured for hostname: %s", *onceHostname)
+		}
+		link, err := createOneTimeToken(app, *onceTTL)
+		if err != nil {
+			log.Fatalf("Failed to store one-time token: %v", err)
+		}
+		fmt.Println(link)
+		return
+	}
+
+	logConfig(effectiveConfig(apps, appsFile))
+	log.Printf("Multi-app proxy started:")
+	log.Printf("  Listening on: %s", listenAddress)
+	if appsFile != nil {
+		if configWatch {
+			log.Printf("  Config file: %s (reloaded on change)", appsFile.path)
+		} else {
+			log.Printf("  Config file: %s", appsFile.path)
+		}
+	}
+	if dockerClient != nil {
+		log.Printf("  Docker discovery: %s (apps removed %s after their container stops)", dockerHost, dockerGracePeriod)
+	}
+	if configSource == "redis" {
+		log.Printf("  Config: Redis key %s (version %s)", configRedisKey, configState().Version)
+	}
+	switch storeBackend {
+	case "memory":
+		log.Printf("  Session store: memory (sessions are lost on restart)")
+	case "bolt":
+		log.Printf("  Session store: bolt (%s)", storeFile)
+	default:
+		log.Printf("  Redis Address: %s", redisSettings)
+		if redisSettings.username != "" {
+			log.Printf("  Redis user: %s", redisSettings.username)
+		}
+		log.Printf("  Redis database: %d", redisSettings.database)
+		if redisSettings.tlsConfig != nil {
+			if redisSettings.tlsConfig.InsecureSkipVerify {
+				log.Printf("  Redis TLS: enabled, WITHOUT certificate verification (REDIS_TLS_INSECURE_SKIP_VERIFY)")
+			} else {
+				log.Printf("  Redis TLS: enabled")
+			}
+		}
+		if cluster, ok := redisClient.(*redis.ClusterClient); ok {
+			reachable, total := checkClusterNodes(cluster)
+			log.Printf("  Redis cluster: %d of %d masters reachable", reachable, total)
+		}
+		if len(redisSettings.sentinelAddresses) > 0 {
+			if master, err := redisSettings.resolveMaster(); err == nil {
+				log.Printf("  Redis master: %s", master)
+			} else {
+				log.Printf("  Redis master: unknown (%v)", err)
+			}
+		}
+		log.Printf("  Redis pool: %d connections per node, %d kept idle; dial timeout %s, read timeout %s, write timeout %s",
+			redisSettings.poolSize, redisSettings.minIdleConns, redisSettings.dialTimeout, redisSettings.readTimeout, redisSettings.writeTimeout)
+		log.Printf("  Redis health monitor: pinging every %s", redisSettings.healthInterval)
+		if redisBreaker != nil {
+			log.Printf("  Redis circuit breaker: opens after %d consecutive failures, probing every %s", redisBreaker.threshold, redisBreaker.cooldown)
+		}
+		if redisKeyPrefix != "" {
+			log.Printf("  Redis key prefix: %s", redisKeyPrefix)
+		}
+	}
+	if proxyProtocol {
+		log.Printf("  PROXY protocol: required (sources: %v)", proxyProtocolSources)
+	}
+	if ipFromHeaders {
+		log.Printf("  Trusted proxies: %v (hops: %d)", trustedProxies, trustedHops)
+	} else {
+		log.Printf("  Client IP headers: disabled, using RemoteAddr only")
+	}
+	if geoIPDB != nil {
+		log.Printf("  GeoIP database: %s", geoIPDB.path)
+	}
+	if asnDB != nil {
+		log.Printf("  ASN database: %s", asnDB.path)
+	}
+	if healthListenAddress != "" {
+		log.Printf("  Health check on: %s/healthz", healthListenAddress)
+	}
+	if adminListenAddress != "" {
+		log.Printf("  Admin API on: %s (%d tokens)", adminListenAddress, len(adminTokens))
+	}
+	log.Printf("  Upstreams: %s", defaultUpstream)
+	if defaultUpstreamTimeout > 0 {
+		log.Printf("  Upstream request timeout: %s", defaultUpstreamTimeout)
+	}
+	log.Printf("  Configured apps: %d", len(sortedHostnames(apps)))
+	for _, hostname := range sortedHostnames(apps) {
+		app := apps[hostname]
+		log.Printf("    %s -> %s (secret: %s, ttl: %s)", hostname, redactedAppValue("upstream_url", app.UpstreamURL.String()), redactedAppValue("secret_path", strings.Join(app.SecretPathPrefixes, ", ")), app.SessionTTL)
+		if len(app.Aliases) > 0 {
+			log.Printf("    %s aliases: %s", hostname, strings.Join(app.Aliases, ", "))
+		}
+		if app.SessionGroup != "" {
+			log.Printf("    %s session group: %s", hostname, app.SessionGroup)
+		}
+		if app.upstream != defaultUpstream {
+			log.Printf("    %s upstream: %s", hostname, app.upstream)
+		}
+		if app.UpstreamTimeout != defaultUpstreamTimeout {
+			log.Printf("    %s upstream request timeout: %s", hostname, app.UpstreamTimeout)
+		}
+		if app.TOTPKey != nil {
+			debugf("    %s current TOTP knock path: %s", hostname, currentTOTPPath(app))
+		}
+		if app.RotationSeed != nil {
+			infof("    %s current secret path: %s (rotates every %s)", hostname, currentRotatedPath(app), app.RotationInterval)
+			go logRotations(app)
+		}
+		if len(app.PreauthorizedIPs) > 0 {
+			if err := preauthorizeSessions(app); err != nil {
+				log.Fatalf("Failed to store preauthorized sessions for %s: %v", hostname, err)
+			}
+			log.Printf("    %s preauthorized IPs: %d", hostname, len(app.PreauthorizedIPs))
+		}
+	}
+
+	go runRenewals()
+	go sweepApps()
+	go watchReloadSignal(storeBackend)
+	if configWatch {
+		if err := watchConfigFile(appsFile.path, storeBackend); err != nil {
+			log.Fatalf("Failed to watch CONFIG_FILE: %v", err)
+		}
+	}
+	if configSource == "redis" {
+		go watchRedisConfig(storeBackend, configPollInterval)
+	}
+	if dockerClient != nil {
+		go watchDockerContainers(storeBackend)
+	}
+	if eventStream != "" {
+		go runEventPublisher()
+	}
+	go reconcileActiveSessions()
+	if sessionExpiryEvents {
+		watchSessionExpiry(redisSettings.database)
+	}
+	if metricsLogInterval > 0 {
+		go logMetrics(metricsLogInterval)
+	}
+
+	listener, err := newListener(listenAddress, proxyProtocol, proxyProtocolSources)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", listenAddress, err)
+	}
+
+	if adminListenAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(adminListenAddress, newAdminHandler()))
+		}()
+	}
+	if healthListenAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(healthListenAddress, newHealthHandler(storeBackend)))
+		}()
+	}
+
+	handler := http.HandlerFunc(handleRequest)
+	log.Fatal(http.Serve(listener, handler))
+}
+
+// newListener opens the listen socket. With PROXY protocol enabled, every
+// connection must start with a valid v1/v2 PROXY header so RemoteAddr carries
+// the real client address; when sources are given, connections from any other
+// peer are dropped.
+func newListener(address string, proxyProtocol bool, sources []netip.Prefix) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil || !proxyProtocol {
+		return listener, err
+	}
+
+	return &proxyproto.Listener{
+		Listener: listener,
+		ConnPolicy: func(options proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			if len(sources) > 0 && !isTrustedProxy(normalizeIP(options.Upstream.String()), sources) {
+				warnf("Rejected connection from %s: not an allowed PROXY protocol source", options.Upstream)
+				return proxyproto.REJECT, proxyproto.ErrInvalidUpstream
+			}
+			return proxyproto.REQUIRE, nil
+		},
+	}, nil
+}
+
+// clientIP returns the client IP for the request. Forwarding headers are only
+// honored when the direct peer is one of the app's trusted proxies (or the app
+// declares a fixed number of trusted hops), otherwise anyone could spoof their
+// IP by sending e.g. X-Forwarded-For.
+func clientIP(r *http.Request, app *AppConfig) string {
+	remoteIP := normalizeIP(r.RemoteAddr)
+
+	if !app.IPFromHeaders {
+		// Warn once so a proxy that was expected to be trusted is noticed
+		if !app.ignoredHeaderWarned.Load() {
+			if header := forwardingHeader(r, app); header != "" && app.ignoredHeaderWarned.CompareAndSwap(false, true) {
+				app.warnf("Ignoring %s header from %s because client IP headers are disabled", header, remoteIP)
+			}
+		}
+		return remoteIP
+	}
+
+	if !trustsPeer(app, remoteIP) {
+		return remoteIP
+	}
+
+	for _, header := range app.IPHeaders {
+		values := r.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		var chain []string
+		switch http.CanonicalHeaderKey(header) {
+		case "X-Forwarded-For":
+			chain = strings.Split(strings.Join(values, ","), ",")
+		case "Forwarded":
+			chain = forwardedFor(values)
+		default:
+			// Single-address headers set by a CDN edge
+			if ip := normalizeIP(strings.Split(values[0], ",")[0]); ip != "" {
+				return ip
+			}
+			continue
+		}
+
+		app.debugf("%s chain from %s: %v", header, remoteIP, chain)
+		if ip := walkProxyChain(chain, app); ip != "" {
+			return ip
+		}
+	}
+
+	// Fallback to RemoteAddr
+	return remoteIP
+}
+
+// forwardingHeader returns the name of the first client IP header present on
+// the request, if any.
+func forwardingHeader(r *http.Request, app *AppConfig) string {
+	for _, headers := range [][]string{app.IPHeaders, defaultIPHeaders} {
+		for _, header := range headers {
+			if r.Header.Get(header) != "" {
+				return header
+			}
+		}
+	}
+	return ""
+}
+
+// walkProxyChain picks the client IP out of a forwarding chain. The left-most
+// entries are whatever the client sent, so the chain is walked right-to-left:
+// with a fixed number of trusted hops, the address that many entries from the
+// right wins; otherwise the first address that isn't a trusted proxy does.
+// Entries that aren't IPs (e.g. "unknown") are ignored.
+func walkProxyChain(chain []string, app *AppConfig) string {
+	var addresses []string
+	for _, entry := range chain {
+		ip := normalizeIP(entry)
+		if _, err := netip.ParseAddr(ip); err == nil {
+			addresses = append(addresses, ip)
+		}
+	}
+	if len(addresses) == 0 {
+		return ""
+	}
+
+	if app.TrustedHops > 0 {
+		if app.TrustedHops > len(addresses) {
+			return addresses[0]
+		}
+		return addresses[len(addresses)-app.TrustedHops]
+	}
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		if !isTrustedProxy(addresses[i], app.TrustedProxies) {
+			return addresses[i]
+		}
+	}
+	return addresses[0]
+}
+
+// forwardedFor extracts the "for=" parameters of RFC 7239 Forwarded headers,
+// in order.
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// normalizeIP canonicalizes an IP so every representation of the same address
+// maps to the same session key: brackets, ports and zones are stripped,
+// IPv6 is compressed and lowercased, and IPv4-mapped IPv6 is unmapped.
+// Values that don't parse as an IP are returned trimmed but otherwise as-is.
+func normalizeIP(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if addrPort, err := netip.ParseAddrPort(raw); err == nil {
+		return addrPort.Addr().WithZone("").Unmap().String()
+	}
+	raw = strings.TrimSuffix(strings.TrimPrefix(raw, "["), "]")
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return raw
+	}
+	return addr.WithZone("").Unmap().String()
+}
+
+// trustsPeer reports whether the app takes client IP headers from the peer it
+// got a request from: one of its trusted proxies, or any with trusted_hops.
+func trustsPeer(app *AppConfig, remoteIP string) bool {
+	return app.IPFromHeaders && len(app.IPHeaders) > 0 && (app.TrustedHops > 0 || isTrustedProxy(remoteIP, app.TrustedProxies))
+}
+
+func isTrustedProxy(ip string, proxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadApps loads the app configurations and checks them against each other
+// and the global settings, at startup and on every reload.
+func loadApps(storeBackend string, file *configFile) (map[string]*AppConfig, error) {
+	apps, defaults, err := loadAppConfigurations(file)
+	if err != nil {
+		return nil, err
+	}
+	if dockerClient != nil {
+		addDiscoveredApps(apps, defaults)
+	}
+	if err := checkDenyRedirectLoops(apps); err != nil {
+		return nil, err
+	}
+	if err := checkSessionGroups(apps); err != nil {
+		return nil, err
+	}
+	warnHostnameOverlaps(apps)
+	if storeBackend != "redis" {
+		for _, hostname := range sortedHostnames(apps) {
+			if settings := redisOnlySettings(apps[hostname]); len(settings) > 0 {
+				return nil, fmt.Errorf("%s can't use %s with STORE=%s", hostname, strings.Join(settings, ", "), storeBackend)
+			}
+		}
+	}
+	// GeoIP databases, required as soon as any app uses country or ASN rules
+	if err := checkGeoIPDatabases(apps); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// loadAppConfigurations loads the apps of the first method configured, and
+// returns them with the defaults they were given, for Docker discovery's.
+func loadAppConfigurations(file *configFile) (map[string]*AppConfig, map[string]string, error) {
+	apps := make(map[string]*AppConfig)
+	if configSource == "redis" {
+		jsonConfig, err := fetchRedisConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		defaults, err := loadAppsFromJSON("CONFIG_REDIS_KEY "+configRedisKey, jsonConfig, file, apps)
+		return apps, defaults, err
+	}
+
+	// A config file's apps come first
+	if file != nil && len(file.apps) > 0 {
+		defaults, err := appDefaults(file, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return apps, defaults, loadAppsFromFile(file, defaults, apps)
+	}
+
+	// Check for JSON configuration next
+	if jsonConfig := setting("APPS_CONFIG"); jsonConfig != "" {
+		defaults, err := loadAppsFromJSON("APPS_CONFIG", jsonConfig, file, apps)
+		return apps, defaults, err
+	}
+
+	// Fall back to numbered environment variables
+	defaults, err := appDefaults(file, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := loadAppsFromEnv(defaults, apps); err != nil {
+		return nil, nil, err
+	}
+
+	// Docker discovery may add them all
+	if len(apps) == 0 && dockerClient == nil {
+		return nil, nil, fmt.Errorf("no app configurations found. Set APPS_CONFIG (JSON) or use numbered environment variables (APP_1_HOSTNAME, etc.)")
+	}
+	return apps, defaults, nil
+}
+
+// loadAppsFromJSON parses the apps of a JSON array, from source for errors,
+// or of an object with the array as apps and their defaults, and returns the
+// defaults, completed by appDefaults.
+func loadAppsFromJSON(source, jsonConfig string, file *configFile, apps map[string]*AppConfig) (map[string]string, error) {
+	var document struct {
+		Defaults json.RawMessage   `json:"defaults"`
+		Apps     []json.RawMessage `json:"apps"`
+	}
+	var err error
+	if trimmed := strings.TrimSpace(jsonConfig); strings.HasPrefix(trimmed, "{") {
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&document)
+	} else {
+		err = json.Unmarshal([]byte(jsonConfig), &document.Apps)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s JSON: %v", source, err)
+	}
+
+	var block map[string]string
+	if document.Defaults != nil {
+		block, err = decodeAppConfig(document.Defaults)
+		if err == nil {
+			err = checkDefaults(block)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JSON defaults: %v", err)
+		}
+	}
+	defaults, err := appDefaults(file, block)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]string)
+	for i, rawConfig := range document.Apps {
+		config, err := decodeAppConfig(rawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("JSON[%d]: %v", i, err)
+		}
+		app, err := reuseOrParseApp(withDefaults(config, defaults))
+		if err == nil {
+			err = addApp(apps, app, fmt.Sprintf("JSON[%d]", i), entries)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JSON[%d]: %v", i, err)
+		}
+	}
+	return defaults, nil
+}
+
+// loadAppsFromEnv parses the apps of the numbered environment variables,
+// with the defaults for the variables not set.
+func loadAppsFromEnv(defaults map[string]string, apps map[string]*AppConfig) error {
+	entries := make(map[string]string)
+	for i := 1; ; i++ {
+		prefix := fmt.Sprintf("APP_%d_", i)
+		hostname := os.Getenv(prefix + "HOSTNAME")
+		if hostname == "" {
+			break // No more apps
+		}
+
+		config := map[string]string{
+			"hostname":                          hostname,
+			"aliases":                           os.Getenv(prefix + "ALIASES"),
+			"log_level":                         os.Getenv(prefix + "LOG_LEVEL"),
+			"secret_path":                       getenv(prefix+"SECRET_PATH", "/secret_path"),
+			"secret_path_match":                 os.Getenv(prefix + "SECRET_PATH_MATCH"),
+			"strip_secret_path":                 getenv(prefix+"STRIP_SECRET_PATH", "true"),
+			"secret_query":                      os.Getenv(prefix + "SECRET_QUERY"),
+			"knock_header":                      os.Getenv(prefix + "KNOCK_HEADER"),
+			"confirm_knock":                     os.Getenv(prefix + "CONFIRM_KNOCK"),
+			"confirm_knock_browsers_only":       os.Getenv(prefix + "CONFIRM_KNOCK_BROWSERS_ONLY"),
+			"knock_passphrase":                  os.Getenv(prefix + "KNOCK_PASSPHRASE"),
+			"knock_token":                       os.Getenv(prefix + "KNOCK_TOKEN"),
+			"totp_secret":                       os.Getenv(prefix + "TOTP_SECRET"),
+			"rotation_seed":                     os.Getenv(prefix + "ROTATION_SEED"),
+			"rotation_interval":                 os.Getenv(prefix + "ROTATION_INTERVAL"),
+			"rotation_overlap":                  os.Getenv(prefix + "ROTATION_OVERLAP"),
+			"totp_reject_replay":                os.Getenv(prefix + "TOTP_REJECT_REPLAY"),
+			"signing_key":                       os.Getenv(prefix + "SIGNING_KEY"),
+			"logout_path":                       os.Getenv(prefix + "LOGOUT_PATH"),
+			"once_path":                         os.Getenv(prefix + "ONCE_PATH"),
+			"allowed_emails":                    os.Getenv(prefix + "ALLOWED_EMAILS"),
+			"email_path":                        os.Getenv(prefix + "EMAIL_PATH"),
+			"email_link_ttl":                    os.Getenv(prefix + "EMAIL_LINK_TTL"),
+			"signed_path":                       os.Getenv(prefix + "SIGNED_PATH"),
+			"browser_regex":                     os.Getenv(prefix + "BROWSER_REGEX"),
+			"redirect_android":                  os.Getenv(prefix + "REDIRECT_ANDROID"),
+			"knock_user_agent_regex":            os.Getenv(prefix + "KNOCK_USER_AGENT_REGEX"),
+			"post_knock_redirect":               os.Getenv(prefix + "POST_KNOCK_REDIRECT"),
+			"public_paths":                      os.Getenv(prefix + "PUBLIC_PATHS"),
+			"protected_paths":                   os.Getenv(prefix + "PROTECTED_PATHS"),
+			"upstream_url":                      os.Getenv(prefix + "UPSTREAM_URL"),
+			"upstream_dial_timeout":             os.Getenv(prefix + "UPSTREAM_DIAL_TIMEOUT"),
+			"upstream_tls_handshake_timeout":    os.Getenv(prefix + "UPSTREAM_TLS_HANDSHAKE_TIMEOUT"),
+			"upstream_response_header_timeout":  os.Getenv(prefix + "UPSTREAM_RESPONSE_HEADER_TIMEOUT"),
+			"upstream_timeout":                  os.Getenv(prefix + "UPSTREAM_TIMEOUT"),
+			"upstream_max_idle_conns":           os.Getenv(prefix + "UPSTREAM_MAX_IDLE_CONNS"),
+			"upstream_max_idle_conns_per_host":  os.Getenv(prefix + "UPSTREAM_MAX_IDLE_CONNS_PER_HOST"),
+			"upstream_idle_conn_timeout":        os.Getenv(prefix + "UPSTREAM_IDLE_CONN_TIMEOUT"),
+			"upstream_max_conns_per_host":       os.Getenv(prefix + "UPSTREAM_MAX_CONNS_PER_HOST"),
+			"upstream_http2":                    os.Getenv(prefix + "UPSTREAM_HTTP2"),
+			"upstream_host":                     os.Getenv(prefix + "UPSTREAM_HOST"),
+			"forwarded_headers":                 os.Getenv(prefix + "FORWARDED_HEADERS"),
+			"request_headers":                   os.Getenv(prefix + "REQUEST_HEADERS"),
+			"upstream_tls_ca_file":              os.Getenv(prefix + "UPSTREAM_TLS_CA_FILE"),
+			"upstream_tls_cert_file":            os.Getenv(prefix + "UPSTREAM_TLS_CERT_FILE"),
+			"upstream_tls_key_file":             os.Getenv(prefix + "UPSTREAM_TLS_KEY_FILE"),
+			"upstream_tls_insecure_skip_verify": os.Getenv(prefix + "UPSTREAM_TLS_INSECURE_SKIP_VERIFY"),
+			"allow_ips":                         os.Getenv(prefix + "ALLOW_IPS"),
+			"block_ips":                         os.Getenv(prefix + "BLOCK_IPS"),
+			"preauthorized_ips":                 os.Getenv(prefix + "PREAUTHORIZED_IPS"),
+			"allow_private":                     getenv(prefix+"ALLOW_PRIVATE", "false"),
+			"allow_asns":                        os.Getenv(prefix + "ALLOW_ASNS"),
+			"session_mode":                      os.Getenv(prefix + "SESSION_MODE"),
+			"session_group":                     os.Getenv(prefix + "SESSION_GROUP"),
+			"share_sessions":                    os.Getenv(prefix + "SHARE_SESSIONS"),
+			"session_ipv4_prefix":               os.Getenv(prefix + "SESSION_IPV4_PREFIX"),
+			"session_ipv6_prefix":               os.Getenv(prefix + "SESSION_IPV6_PREFIX"),
+			"session_ttl":                       getenv(prefix+"SESSION_TTL", "10m"),
+			"max_sessions":                      os.Getenv(prefix + "MAX_SESSIONS"),
+			"max_session_age":                   os.Getenv(prefix + "MAX_SESSION_AGE"),
+			"auto_renew":                        getenv(prefix+"AUTO_RENEW", "true"),
+			"renew_fraction":                    os.Getenv(prefix + "RENEW_FRACTION"),
+			"bind_user_agent":                   os.Getenv(prefix + "BIND_USER_AGENT"),
+			"expose_session_ttl":                os.Getenv(prefix + "EXPOSE_SESSION_TTL"),
+			"store_failure":                     os.Getenv(prefix + "STORE_FAILURE"),
+			"store_failure_grace":               os.Getenv(prefix + "STORE_FAILURE_GRACE"),
+			"trusted_proxies":                   os.Getenv(prefix + "TRUSTED_PROXIES"),
+			"trusted_hops":                      os.Getenv(prefix + "TRUSTED_HOPS"),
+			"ip_headers":                        os.Getenv(prefix + "IP_HEADERS"),
+			"ip_from_headers":                   os.Getenv(prefix + "IP_FROM_HEADERS"),
+			"allow_countries":                   os.Getenv(prefix + "ALLOW_COUNTRIES"),
+			"deny_countries":                    os.Getenv(prefix + "DENY_COUNTRIES"),
+			"geoip_unknown":                     os.Getenv(prefix + "GEOIP_UNKNOWN"),
+			"deny_page":                         os.Getenv(prefix + "DENY_PAGE"),
+			"deny_contact":                      os.Getenv(prefix + "DENY_CONTACT"),
+			"deny_redirect_url":                 os.Getenv(prefix + "DENY_REDIRECT_URL"),
+			"deny_status":                       os.Getenv(prefix + "DENY_STATUS"),
+			"error_page":                        os.Getenv(prefix + "ERROR_PAGE"),
+			"deny_delay":                        os.Getenv(prefix + "DENY_DELAY"),
+			"grant_webhook_url":                 os.Getenv(prefix + "GRANT_WEBHOOK_URL"),
+			"rate_limit":                        os.Getenv(prefix + "RATE_LIMIT"),
+			"max_grants_per_minute":             os.Getenv(prefix + "MAX_GRANTS_PER_MINUTE"),
+			"max_failures_per_minute":           os.Getenv(prefix + "MAX_FAILURES_PER_MINUTE"),
+			"ban_threshold":                     os.Getenv(prefix + "BAN_THRESHOLD"),
+			"ban_window":                        os.Getenv(prefix + "BAN_WINDOW"),
+			"ban_duration":                      os.Getenv(prefix + "BAN_DURATION"),
+		}
+
+		for name, value := range defaults {
+			if _, set := os.LookupEnv(prefix + strings.ToUpper(name)); !set {
+				config[name] = value
+			}
+		}
+
+		app, err := reuseOrParseApp(config)
+		if err == nil {
+			err = addApp(apps, app, fmt.Sprintf("APP_%d", i), entries)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// addApp adds a parsed app to the apps being loaded, under its hostname and
+// aliases, refusing any configured twice, which would otherwise silently
+// replace the first app. Hostnames are lowercase by then, so ones differing
+// only in case are caught too. entries records which config entry, like
+// JSON[0], each name comes from, for the errors to name both.
+func addApp(apps map[string]*AppConfig, app *AppConfig, entry string, entries map[string]string) error {
+	configuredBy := func(name string) string {
+		if entries[name] == "" {
+			return ""
+		}
+		return " by " + entries[name]
+	}
+	if _, found := apps[app.Hostname]; found {
+		if app.Hostname == "*" {
+			return fmt.Errorf("hostname * is already configured%s; there can only be one default app", configuredBy("*"))
+		}
+		return fmt.Errorf("hostname %s is already configured%s", app.Hostname, configuredBy(app.Hostname))
+	}
+	for _, alias := range app.Aliases {
+		if _, found := apps[alias]; found {
+			return fmt.Errorf("aliases entry %s is already configured%s", alias, configuredBy(alias))
+		}
+	}
+	apps[app.Hostname] = app
+	entries[app.Hostname] = entry
+	for _, alias := range app.Aliases {
+		apps[alias] = app
+		entries[alias] = "the aliases of " + entry
+	}
+	return nil
+}
+
+// reuseOrParseApp expands the variables in the config, then returns the
+// running app of the config's hostname if the config is unchanged, so a
+// reload keeps its state, like rate limits, else parses it.
+func reuseOrParseApp(config map[string]string) (*AppConfig, error) {
+	config, err := expandVariables(config)
+	if err != nil {
+		return nil, err
+	}
+	if app, found := currentApps()[strings.ToLower(config["hostname"])]; found && maps.Equal(app.config, config) {
+		return app, nil
+	}
+	return parseAppConfig(config)
+}
+
+func parseAppConfig(config map[string]string) (*AppConfig, error) {
+	// Misspelt settings would silently be left at their defaults
+	if err := checkUnknownSettings(config); err != nil {
+		return nil, err
+	}
+	app := &AppConfig{
+		// Like Host headers, hostnames are case-insensitive
+		Hostname: strings.ToLower(config["hostname"]),
+		metrics:  &appMetrics{},
+		config:   config,
+
+		ignoredHeaderWarned: &atomic.Bool{},
+	}
+
+	if app.Hostname == "" {
+		return nil, fmt.Errorf("hostname is required")
+	}
+	app.LogLevel = logLevel.Level()
+	if level := config["log_level"]; level != "" {
+		var err error
+		if app.LogLevel, err = parseLogLevel(level); err != nil {
+			return nil, fmt.Errorf("invalid log_level: %v", err)
+		}
+	}
+	app.logger = newAppLogger(app.LogLevel, app.Hostname)
+
+	if !validHostname(app.Hostname) {
+		return nil, fmt.Errorf("invalid hostname: %s (wildcards must be a leading *., like *.apps.example.com, or * for the default app)", app.Hostname)
+	}
+	for _, alias := range strings.Split(strings.ToLower(config["aliases"]), ",") {
+		if alias = strings.TrimSpace(alias); alias == "" {
+			continue
+		}
+		// Wildcards would key sessions by the requested hostname
+		if strings.Contains(alias, "*") {
+			return nil, fmt.Errorf("invalid aliases entry %s (wildcards can only be the hostname)", alias)
+		}
+		if alias == app.Hostname || slices.Contains(app.Aliases, alias) {
+			return nil, fmt.Errorf("aliases entry %s is listed twice", alias)
+		}
+		app.Aliases = append(app.Aliases, alias)
+	}
+
+	if config["upstream_url"] == "" {
+		return nil, fmt.Errorf("upstream_url is required")
+	}
+
+	for _, secretPath := range strings.Split(defaultString(config["secret_path"], "/secret_path"), ",") {
+		if secretPath = strings.TrimSpace(secretPath); secretPath != "" {
+			app.SecretPathPrefixes = append(app.SecretPathPrefixes, secretPath)
+		}
+	}
+	if len(app.SecretPathPrefixes) == 0 {
+		return nil, fmt.Errorf("secret_path must not be empty")
+	}
+
+	switch strings.ToLower(config["secret_path_match"]) {
+	case "", "prefix":
+		app.SecretPathExact = false
+	case "exact":
+		app.SecretPathExact = true
+	default:
+		return nil, fmt.Errorf("invalid secret_path_match: %s (expected exact or prefix)", config["secret_path_match"])
+	}
+
+	if totpSecret := config["totp_secret"]; totpSecret != "" {
+		key, err := parseTOTPSecret(totpSecret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid totp_secret: %v", err)
+		}
+		app.TOTPKey = key
+		if totpRejectReplay := config["totp_reject_replay"]; totpRejectReplay != "" {
+			app.TOTPRejectReplay, err = strconv.ParseBool(totpRejectReplay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid totp_reject_replay: %s", totpRejectReplay)
+			}
+		}
+	}
+
+	if rotationSeed := config["rotation_seed"]; rotationSeed != "" {
+		if app.TOTPKey != nil {
+			return nil, fmt.Errorf("rotation_seed and totp_secret can't be combined")
+		}
+		app.RotationSeed = []byte(rotationSeed)
+		var err error
+		app.RotationInterval, err = time.ParseDuration(defaultString(config["rotation_interval"], "168h"))
+		if err != nil || app.RotationInterval < time.Minute {
+			return nil, fmt.Errorf("invalid rotation_interval: %s (minimum 1m)", config["rotation_interval"])
+		}
+		app.RotationOverlap, err = time.ParseDuration(defaultString(config["rotation_overlap"], "24h"))
+		if err != nil || app.RotationOverlap < 0 || app.RotationOverlap >= app.RotationInterval {
+			return nil, fmt.Errorf("invalid rotation_overlap: %s (must be shorter than rotation_interval)", config["rotation_overlap"])
+		}
+	}
+
+	app.StripSecretPath = true
+	if stripSecretPath := config["strip_secret_path"]; stripSecretPath != "" {
+		var err error
+		app.StripSecretPath, err = strconv.ParseBool(stripSecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid strip_secret_path: %s", stripSecretPath)
+		}
+	}
+	// TOTP codes and rotated segments mean nothing to the upstream
+	if !app.StripSecretPath && (app.TOTPKey != nil || app.RotationSeed != nil) {
+		return nil, fmt.Errorf("strip_secret_path=false can't be combined with totp_secret or rotation_seed")
+	}
+
+	if signingKey := config["signing_key"]; signingKey != "" {
+		app.SigningKey = []byte(signingKey)
+		app.SignedPath = defaultString(config["signed_path"], "/knock")
+		if !strings.HasPrefix(app.SignedPath, "/") {
+			return nil, fmt.Errorf("signed_path must start with '/'")
+		}
+	}
+
+	app.LogoutPath = defaultString(config["logout_path"], strings.TrimSuffix(app.SecretPathPrefixes[0], "/")+"/logout")
+	if !strings.HasPrefix(app.LogoutPath, "/") {
+		return nil, fmt.Errorf("logout_path must start with '/'")
+	}
+
+	if app.OncePath = config["once_path"]; app.OncePath != "" && !strings.HasPrefix(app.OncePath, "/") {
+		return nil, fmt.Errorf("once_path must start with '/'")
+	}
+
+	if allowedEmails := config["allowed_emails"]; allowedEmails != "" {
+		var err error
+		app.AllowedEmails, err = parseAllowedEmails(allowedEmails)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_emails: %v", err)
+		}
+		if smtpSettings == nil {
+			return nil, fmt.Errorf("allowed_emails requires SMTP_HOST")
+		}
+		if app.SigningKey == nil {
+			return nil, fmt.Errorf("allowed_emails requires a signing_key to sign login links")
+		}
+		app.EmailPath = defaultString(config["email_path"], "/email-login")
+		if !strings.HasPrefix(app.EmailPath, "/") || app.EmailPath == app.SignedPath {
+			return nil, fmt.Errorf("email_path must start with '/' and differ from signed_path")
+		}
+		app.EmailLinkTTL, err = time.ParseDuration(defaultString(config["email_link_ttl"], "15m"))
+		if err != nil || app.EmailLinkTTL <= 0 {
+			return nil, fmt.Errorf("invalid email_link_ttl: %s", config["email_link_ttl"])
+		}
+		app.EmailRateLimiter = newRateLimiter(emailRateLimit)
+	}
+
+	if secretQuery := config["secret_query"]; secretQuery != "" {
+		var found bool
+		app.SecretQueryName, app.SecretQueryValue, found = strings.Cut(secretQuery, "=")
+		if !found || app.SecretQueryName == "" || app.SecretQueryValue == "" {
+			// Don't echo the value, it's a secret
+			return nil, fmt.Errorf("secret_query must have the form name=value")
+		}
+	}
+
+	if knockHeader, knockToken := config["knock_header"], config["knock_token"]; knockHeader != "" || knockToken != "" {
+		if knockHeader == "" || knockToken == "" {
+			return nil, fmt.Errorf("knock_header and knock_token must be set together")
+		}
+		app.KnockHeader = http.CanonicalHeaderKey(knockHeader)
+		app.KnockToken = knockToken
+	}
+
+	var err error
+	app.PublicPaths, err = parsePathPatterns(config["public_paths"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public_paths: %v", err)
+	}
+	app.ProtectedPaths, err = parsePathPatterns(config["protected_paths"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid protected_paths: %v", err)
+	}
+	if len(app.PublicPaths) > 0 && len(app.ProtectedPaths) > 0 {
+		return nil, fmt.Errorf("public_paths and protected_paths are mutually exclusive")
+	}
+	if err := checkKnockPathsReachable(app); err != nil {
+		return nil, err
+	}
+	if err := checkKnockPathsDistinct(app); err != nil {
+		return nil, err
+	}
+
+	app.BrowserRegex = browserRegex
+	if browserRegexConfig := config["browser_regex"]; browserRegexConfig != "" {
+		app.BrowserRegex, err = regexp.Compile(browserRegexConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid browser_regex: %v", err)
+		}
+	}
+	if knockUserAgentRegex := config["knock_user_agent_regex"]; knockUserAgentRegex != "" {
+		app.KnockUserAgentRegex, err = regexp.Compile(knockUserAgentRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid knock_user_agent_regex: %v", err)
+		}
+	}
+	if knockPassphrase := config["knock_passphrase"]; knockPassphrase != "" {
+		if _, err := bcrypt.Cost([]byte(knockPassphrase)); err != nil {
+			return nil, fmt.Errorf("knock_passphrase must be a bcrypt hash (see -hash-passphrase): %v", err)
+		}
+		app.KnockPassphrase = []byte(knockPassphrase)
+	}
+	if confirmKnock := config["confirm_knock"]; confirmKnock != "" {
+		app.ConfirmKnock, err = strconv.ParseBool(confirmKnock)
+		if err != nil {
+			return nil, fmt.Errorf("invalid confirm_knock: %s", confirmKnock)
+		}
+	}
+	if confirmBrowsersOnly := config["confirm_knock_browsers_only"]; confirmBrowsersOnly != "" {
+		app.ConfirmBrowsersOnly, err = strconv.ParseBool(confirmBrowsersOnly)
+		if err != nil {
+			return nil, fmt.Errorf("invalid confirm_knock_browsers_only: %s", confirmBrowsersOnly)
+		}
+	}
+	if redirectAndroidConfig := config["redirect_android"]; redirectAndroidConfig != "" {
+		app.RedirectAndroid, err = strconv.ParseBool(redirectAndroidConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect_android: %s", redirectAndroidConfig)
+		}
+	}
+
+	if postKnockRedirect := config["post_knock_redirect"]; postKnockRedirect != "" {
+		app.PostKnockRedirect, err = url.Parse(postKnockRedirect)
+		if err != nil {
+			return nil, fmt.Errorf("invalid post_knock_redirect: %v", err)
+		}
+		if app.PostKnockRedirect.IsAbs() && app.PostKnockRedirect.Scheme != "http" && app.PostKnockRedirect.Scheme != "https" {
+			return nil, fmt.Errorf("invalid post_knock_redirect: scheme must be http or https")
+		}
+	}
+
+	if denyPage := config["deny_page"]; denyPage != "" {
+		app.DenyPage, err = loadPageTemplate(denyPage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny_page: %v", err)
+		}
+	}
+	app.DenyContact = config["deny_contact"]
+	if errorPage := config["error_page"]; errorPage != "" {
+		app.ErrorPage, err = loadPageTemplate(errorPage)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error_page: %v", err)
+		}
+	}
+	app.DenyStatus, err = strconv.Atoi(defaultString(config["deny_status"], "403"))
+	if err != nil || app.DenyStatus != http.StatusForbidden && app.DenyStatus != http.StatusNotFound && app.DenyStatus != statusCloseConnection {
+		return nil, fmt.Errorf("invalid deny_status: %s (expected 403, 404 or 444)", config["deny_status"])
+	}
+	if denyDelay := config["deny_delay"]; denyDelay != "" {
+		app.DenyDelay, err = time.ParseDuration(denyDelay)
+		if err != nil || app.DenyDelay < 0 {
+			return nil, fmt.Errorf("invalid deny_delay: %s", denyDelay)
+		}
+	}
+	if denyRedirectURL := config["deny_redirect_url"]; denyRedirectURL != "" {
+		app.DenyRedirectURL, err = parseHTTPURL(denyRedirectURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny_redirect_url: %v", err)
+		}
+	}
 
-	// Load app configurations
-	apps = make(map[string]*AppConfig)
-	loadAppConfigurations()
+	// "none" opts an app out of the global grant webhook
+	app.GrantWebhookURL = grantWebhookURL
+	switch webhook := config["grant_webhook_url"]; webhook {
+	case "":
+	case "none":
+		app.GrantWebhookURL = nil
+	default:
+		app.GrantWebhookURL, err = parseHTTPURL(webhook)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grant_webhook_url: %v", err)
+		}
+	}
 
-	// Redis client
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     redisAddress,
-		Password: redisPassword,
-		DB:       0,
-	})
+	app.UpstreamURL, err = parseUpstreamURL(config["upstream_url"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream_url %v", err)
+	}
+	if err := parseUpstreamSettings(app, config); err != nil {
+		return nil, err
+	}
 
-	_, err := redisClient.Ping(ctx).Result()
+	app.SessionTTL, err = time.ParseDuration(config["session_ttl"])
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis at %s: %v", redisAddress, err)
+		return nil, fmt.Errorf("invalid session_ttl: %v", err)
 	}
 
-	log.Printf("Multi-app proxy started:")
-	log.Printf("  Listening on: %s", listenAddress)
-	log.Printf("  Redis Address: %s", redisAddress)
-	log.Printf("  Configured apps: %d", len(apps))
-	for hostname, app := range apps {
-		log.Printf("    %s -> %s (secret: %s, ttl: %s)", hostname, app.UpstreamURL, app.SecretPathPrefix, app.SessionTTL)
+	switch app.SessionMode = strings.ToLower(defaultString(config["session_mode"], sessionModeIP)); app.SessionMode {
+	case sessionModeIP, sessionModeCookie, sessionModeBoth:
+	default:
+		return nil, fmt.Errorf("invalid session_mode: %s (expected ip, cookie or both)", config["session_mode"])
+	}
+	if app.SessionGroup = config["session_group"]; app.SessionGroup != "" {
+		if strings.ContainsAny(app.SessionGroup, ": \t") {
+			return nil, fmt.Errorf("invalid session_group: %s (must not contain colons or spaces)", app.SessionGroup)
+		}
+		// Session cookies are host-only, so only IP sessions can be shared
+		if app.SessionMode != sessionModeIP {
+			return nil, fmt.Errorf("session_group requires session_mode ip")
+		}
+	}
+	if shareSessions := config["share_sessions"]; shareSessions != "" {
+		app.ShareSessions, err = strconv.ParseBool(shareSessions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid share_sessions: %s", shareSessions)
+		}
+		if app.ShareSessions && !isWildcardHostname(app.Hostname) {
+			return nil, fmt.Errorf("share_sessions requires a wildcard hostname")
+		}
+		// Like session groups
+		if app.ShareSessions && app.SessionMode != sessionModeIP {
+			return nil, fmt.Errorf("share_sessions requires session_mode ip")
+		}
+	}
+	app.SessionIPv4Prefix, err = strconv.Atoi(defaultString(config["session_ipv4_prefix"], "32"))
+	if err != nil || app.SessionIPv4Prefix < 24 || app.SessionIPv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid session_ipv4_prefix: %s (expected 24 to 32)", config["session_ipv4_prefix"])
+	}
+	app.SessionIPv6Prefix, err = strconv.Atoi(defaultString(config["session_ipv6_prefix"], "128"))
+	if err != nil || app.SessionIPv6Prefix < 56 || app.SessionIPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid session_ipv6_prefix: %s (expected 56 to 128)", config["session_ipv6_prefix"])
 	}
 
-	handler := http.HandlerFunc(handleRequest)
-	log.Fatal(http.ListenAndServe(listenAddress, handler))
-}
+	if maxSessionsConfig := config["max_sessions"]; maxSessionsConfig != "" {
+		app.MaxSessions, err = strconv.Atoi(maxSessionsConfig)
+		if err != nil || app.MaxSessions < 0 {
+			return nil, fmt.Errorf("invalid max_sessions: %s", maxSessionsConfig)
+		}
+	}
 
-func clientIP(r *http.Request) string {
-	headers := []string{
-		"CF-Connecting-IP",    // Cloudflare
-		"True-Client-IP",      // Akamai
-		"X-Real-IP",           // Common
-		"X-Forwarded-For",     // Common
-		"X-Cluster-Client-IP", // Common
-		"Fastly-Client-IP",    // Fastly
-		"Forwarded",           // RFC 7239
+	if maxSessionAgeConfig := config["max_session_age"]; maxSessionAgeConfig != "" {
+		app.MaxSessionAge, err = time.ParseDuration(maxSessionAgeConfig)
+		if err != nil || app.MaxSessionAge < 0 {
+			return nil, fmt.Errorf("invalid max_session_age: %s", maxSessionAgeConfig)
+		}
 	}
 
-	for _, header := range headers {
-		if ip := r.Header.Get(header); ip != "" {
-			return strings.TrimSpace(strings.Split(ip, ",")[0])
+	if autoRenew := config["auto_renew"]; autoRenew != "" {
+		app.AutoRenew, err = strconv.ParseBool(autoRenew)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auto_renew: %s", autoRenew)
+		}
+	}
+	if bindUserAgent := config["bind_user_agent"]; bindUserAgent != "" {
+		app.BindUserAgent, err = strconv.ParseBool(bindUserAgent)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind_user_agent: %s", bindUserAgent)
+		}
+	}
+	if exposeSessionTTL := config["expose_session_ttl"]; exposeSessionTTL != "" {
+		app.ExposeSessionTTL, err = strconv.ParseBool(exposeSessionTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expose_session_ttl: %s", exposeSessionTTL)
+		}
+	}
+	switch app.StoreFailure = strings.ToLower(defaultString(config["store_failure"], storeFailureClosed)); app.StoreFailure {
+	case storeFailureClosed, storeFailureOpen:
+	case storeFailureGrace:
+		app.StoreFailureGrace, err = time.ParseDuration(defaultString(config["store_failure_grace"], "5m"))
+		if err != nil || app.StoreFailureGrace <= 0 {
+			return nil, fmt.Errorf("invalid store_failure_grace: %s", config["store_failure_grace"])
+		}
+		app.graceSessions = newSessionGrace(app.StoreFailureGrace)
+	default:
+		return nil, fmt.Errorf("invalid store_failure: %s (expected closed, open or grace)", config["store_failure"])
+	}
+	app.RenewFraction, err = strconv.ParseFloat(defaultString(config["renew_fraction"], "0.1"), 64)
+	if err != nil || app.RenewFraction < 0 || app.RenewFraction >= 1 {
+		return nil, fmt.Errorf("invalid renew_fraction: %s (expected 0 to below 1)", config["renew_fraction"])
+	}
+	if app.AutoRenew && app.RenewFraction > 0 {
+		app.renewals = newRenewThrottle(time.Duration(app.RenewFraction*float64(app.SessionTTL)), app.SessionTTL)
+	}
+	if allowPrivate := config["allow_private"]; allowPrivate != "" {
+		app.AllowPrivate, err = strconv.ParseBool(allowPrivate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_private: %s", allowPrivate)
 		}
 	}
 
-	// Fallback to RemoteAddr
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
-}
+	// Parse allowed IPs
+	app.AllowIPs, err = parseIPMatchers(config["allow_ips"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_ips: %v", err)
+	}
 
-func loadAppConfigurations() {
-	// Check for JSON configuration first
-	if jsonConfig := os.Getenv("APPS_CONFIG"); jsonConfig != "" {
-		loadAppsFromJSON(jsonConfig)
-		return
+	app.AllowASNs, err = parseASNs(config["allow_asns"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_asns: %v", err)
 	}
 
-	// Fall back to numbered environment variables
-	loadAppsFromEnv()
+	// Parse blocked IPs
+	app.BlockIPs, err = parseIPMatchers(config["block_ips"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid block_ips: %v", err)
+	}
 
-	if len(apps) == 0 {
-		log.Fatal("No app configurations found. Set APPS_CONFIG (JSON) or use numbered environment variables (APP_1_HOSTNAME, etc.)")
+	if preauthorizedIPs := config["preauthorized_ips"]; preauthorizedIPs != "" {
+		// Cookie sessions can't be created without a client to set the cookie on
+		if app.SessionMode != sessionModeIP {
+			return nil, fmt.Errorf("preauthorized_ips requires session_mode ip")
+		}
+		// There is no hostname to key them by
+		if isWildcardHostname(app.Hostname) && !app.ShareSessions && app.SessionGroup == "" {
+			return nil, fmt.Errorf("preauthorized_ips on a wildcard hostname requires share_sessions or session_group")
+		}
+		app.PreauthorizedIPs = make(map[string]bool)
+		for _, entry := range strings.Split(preauthorizedIPs, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid preauthorized_ips entry %q: expected a single IP", entry)
+			}
+			app.PreauthorizedIPs[sessionIP(app, addr.WithZone("").Unmap().String())] = true
+		}
 	}
-}
 
-func loadAppsFromJSON(jsonConfig string) {
-	var appConfigs []map[string]string
-	if err := json.Unmarshal([]byte(jsonConfig), &appConfigs); err != nil {
-		log.Fatalf("Failed to parse APPS_CONFIG JSON: %v", err)
+	// Parse trusted proxies, falling back to the global TRUSTED_PROXIES
+	app.TrustedProxies = trustedProxies
+	if trustedProxiesConfig := config["trusted_proxies"]; trustedProxiesConfig != "" {
+		app.TrustedProxies, err = parsePrefixes(trustedProxiesConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies: %v", err)
+		}
+	}
+
+	app.TrustedHops = trustedHops
+	if trustedHopsConfig := config["trusted_hops"]; trustedHopsConfig != "" {
+		app.TrustedHops, err = strconv.Atoi(trustedHopsConfig)
+		if err != nil || app.TrustedHops < 0 {
+			return nil, fmt.Errorf("invalid trusted_hops: %s", trustedHopsConfig)
+		}
 	}
 
-	for i, config := range appConfigs {
-		app, err := parseAppConfig(config)
+	app.IPFromHeaders = ipFromHeaders
+	if ipFromHeadersConfig := config["ip_from_headers"]; ipFromHeadersConfig != "" {
+		app.IPFromHeaders, err = strconv.ParseBool(ipFromHeadersConfig)
 		if err != nil {
-			log.Fatalf("Invalid app config in JSON[%d]: %v", i, err)
+			return nil, fmt.Errorf("invalid ip_from_headers: %s", ipFromHeadersConfig)
 		}
-		apps[app.Hostname] = app
 	}
-}
 
-func loadAppsFromEnv() {
-	for i := 1; ; i++ {
-		prefix := fmt.Sprintf("APP_%d_", i)
-		hostname := os.Getenv(prefix + "HOSTNAME")
-		if hostname == "" {
-			break // No more apps
+	// Parse client IP headers; "none" means only RemoteAddr is used
+	app.IPHeaders = defaultIPHeaders
+	if ipHeadersConfig := strings.TrimSpace(config["ip_headers"]); ipHeadersConfig != "" {
+		app.IPHeaders = nil
+		if !strings.EqualFold(ipHeadersConfig, "none") {
+			for _, header := range strings.Split(ipHeadersConfig, ",") {
+				if header = strings.TrimSpace(header); header != "" {
+					app.IPHeaders = append(app.IPHeaders, header)
+				}
+			}
 		}
+	}
 
-		config := map[string]string{
-			"hostname":     hostname,
-			"secret_path":  getenv(prefix+"SECRET_PATH", "/secret_path"),
-			"upstream_url": os.Getenv(prefix + "UPSTREAM_URL"),
-			"allow_ips":    os.Getenv(prefix + "ALLOW_IPS"),
-			"session_ttl":  getenv(prefix+"SESSION_TTL", "10m"),
-			"auto_renew":   getenv(prefix+"AUTO_RENEW", "true"),
+	// Parse the unauthenticated request rate limit (requests per minute)
+	if rateLimitConfig := config["rate_limit"]; rateLimitConfig != "" {
+		rateLimit, err := strconv.Atoi(rateLimitConfig)
+		if err != nil || rateLimit < 0 {
+			return nil, fmt.Errorf("invalid rate_limit: %s", rateLimitConfig)
+		}
+		if rateLimit > 0 {
+			app.RateLimiter = newRateLimiter(rateLimit)
 		}
+	}
 
-		app, err := parseAppConfig(config)
-		if err != nil {
-			log.Fatalf("Invalid app config %s: %v", prefix, err)
+	// Parse the app-wide knock limits (per minute)
+	if maxGrantsConfig := config["max_grants_per_minute"]; maxGrantsConfig != "" {
+		app.MaxGrantsPerMinute, err = strconv.Atoi(maxGrantsConfig)
+		if err != nil || app.MaxGrantsPerMinute < 0 {
+			return nil, fmt.Errorf("invalid max_grants_per_minute: %s", maxGrantsConfig)
+		}
+	}
+	if maxFailuresConfig := config["max_failures_per_minute"]; maxFailuresConfig != "" {
+		app.MaxFailuresPerMinute, err = strconv.Atoi(maxFailuresConfig)
+		if err != nil || app.MaxFailuresPerMinute < 0 {
+			return nil, fmt.Errorf("invalid max_failures_per_minute: %s", maxFailuresConfig)
 		}
-		apps[app.Hostname] = app
 	}
-}
 
-func parseAppConfig(config map[string]string) (*AppConfig, error) {
-	app := &AppConfig{
-		Hostname:         config["hostname"],
-		SecretPathPrefix: config["secret_path"],
+	// Parse temporary ban settings
+	if banThresholdConfig := config["ban_threshold"]; banThresholdConfig != "" {
+		app.BanThreshold, err = strconv.Atoi(banThresholdConfig)
+		if err != nil || app.BanThreshold < 0 {
+			return nil, fmt.Errorf("invalid ban_threshold: %s", banThresholdConfig)
+		}
+	}
+	if app.BanThreshold > 0 {
+		app.BanWindow, err = time.ParseDuration(defaultString(config["ban_window"], "10m"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ban_window: %v", err)
+		}
+		app.BanDuration, err = time.ParseDuration(defaultString(config["ban_duration"], "1h"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ban_duration: %v", err)
+		}
 	}
 
-	if app.Hostname == "" {
-		return nil, fmt.Errorf("hostname is required")
+	// Parse country rules
+	app.AllowCountries = parseCountries(config["allow_countries"])
+	app.DenyCountries = parseCountries(config["deny_countries"])
+	switch strings.ToLower(config["geoip_unknown"]) {
+	case "", "allow":
+		app.GeoIPAllowUnknown = true
+	case "deny":
+		app.GeoIPAllowUnknown = false
+	default:
+		return nil, fmt.Errorf("invalid geoip_unknown: %s (expected allow or deny)", config["geoip_unknown"])
 	}
 
-	if config["upstream_url"] == "" {
-		return nil, fmt.Errorf("upstream_url is required")
+	return app, nil
+}
+
+// parseCountries parses a comma-separated list of ISO country codes.
+func parseCountries(list string) map[string]bool {
+	countries := make(map[string]bool)
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			countries[code] = true
+		}
 	}
+	return countries
+}
 
-	var err error
-	app.UpstreamURL, err = url.Parse(config["upstream_url"])
-	if err != nil {
-		return nil, fmt.Errorf("invalid upstream_url: %v", err)
+// parseASNs parses a comma-separated list of AS numbers, with or without the
+// "AS" prefix.
+func parseASNs(list string) (map[uint]bool, error) {
+	asns := make(map[uint]bool)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		number := strings.TrimPrefix(strings.ToUpper(entry), "AS")
+		asn, err := strconv.ParseUint(number, 10, 32)
+		if err != nil || asn == 0 {
+			return nil, fmt.Errorf("invalid ASN '%s'", entry)
+		}
+		asns[uint(asn)] = true
 	}
+	return asns, nil
+}
 
-	app.SessionTTL, err = time.ParseDuration(config["session_ttl"])
-	if err != nil {
-		return nil, fmt.Errorf("invalid session_ttl: %v", err)
+// parsePrefixes parses a comma-separated list of CIDRs or plain IPs. Plain IPs
+// are treated as single-address prefixes.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
 	}
+	return prefixes, nil
+}
 
-	app.AutoRenew, _ = strconv.ParseBool(config["auto_renew"])
+// parseIPMatchers parses a comma-separated list of CIDRs, exact IPs and
+// "regex:" prefixed patterns.
+func parseIPMatchers(list string) ([]ipMatcher, error) {
+	var matchers []ipMatcher
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
 
-	// Parse allowed IPs
-	if allowIPsConfig := config["allow_ips"]; allowIPsConfig != "" {
-		for _, pattern := range strings.Split(allowIPsConfig, ",") {
-			escapedPattern := strings.ReplaceAll(strings.TrimSpace(pattern), ".", `\.`)
-			regex, err := regexp.Compile(escapedPattern)
+		if expression, isRegex := strings.CutPrefix(pattern, "regex:"); isRegex {
+			regex, err := regexp.Compile(expression)
 			if err != nil {
 				return nil, fmt.Errorf("invalid IP regex pattern '%s': %v", pattern, err)
 			}
-			app.AllowIPs = append(app.AllowIPs, regex)
+			matchers = append(matchers, ipMatcher{pattern: pattern, regex: regex})
+			continue
+		}
+
+		prefix, err := parsePrefix(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, ipMatcher{pattern: pattern, prefix: prefix})
+	}
+	return matchers, nil
+}
+
+func (m ipMatcher) Match(ip string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(ip)
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return m.prefix.Contains(addr.Unmap())
+}
+
+// allowListMatch returns the allow rule matching ip, if any.
+func allowListMatch(app *AppConfig, ip string) (string, bool) {
+	if app.AllowPrivate && isPrivateIP(ip) {
+		return "private", true
+	}
+	for _, matcher := range app.AllowIPs {
+		if matcher.Match(ip) {
+			return matcher.pattern, true
+		}
+	}
+	if len(app.AllowASNs) > 0 {
+		if asn := asnDB.asn(ip); app.AllowASNs[asn] {
+			return fmt.Sprintf("AS%d", asn), true
 		}
 	}
+	return "", false
+}
 
-	return app, nil
+// isPrivateIP reports whether ip is a loopback, link-local, RFC 1918 or
+// unique local (fc00::/7) address.
+func isPrivateIP(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast()
+}
+
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR '%s': %v", entry, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP '%s': %v", entry, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
 }
 
 func handleRequest(responseWriter http.ResponseWriter, request *http.Request) {
@@ -193,70 +1825,249 @@ func handleRequest(responseWriter http.ResponseWriter, request *http.Request) {
 		hostname = hostname[:colonIndex]
 	}
 
-	app, exists := apps[hostname]
+	app, exists := lookupApp(currentApps(), hostname)
 	if !exists {
-		log.Printf("No app configured for hostname: %s", hostname)
-		http.Error(responseWriter, "Not Found", http.StatusNotFound)
+		infof("No app configured for hostname: %s", hostname)
+		notFound(responseWriter, hostname)
 		return
 	}
 
-	ip := clientIP(request)
-	log.Printf("[%s] Request from %s %s %s", hostname, ip, request.Method, request.URL.Path)
+	ip := clientIP(request, app)
+	app.infof("Request from %s %s %s", ip, request.Method, logPath(app, request.URL.Path))
+	if app.ExposeSessionTTL {
+		// Only set by checkSession, never passed on from the client
+		request.Header.Del(sessionExpiresHeader)
+	}
 
-	// Check if IP matches any of the app's allowIPs patterns
-	isAllowedIP := false
-	for _, regex := range app.AllowIPs {
-		if regex.MatchString(ip) {
-			log.Printf("[%s] IP %s matches allow list. Forwarding directly to upstream.", hostname, ip)
-			isAllowedIP = true
-			break
+	// Blocked IPs are denied before anything else, even on the secret path
+	for _, matcher := range app.BlockIPs {
+		if matcher.Match(ip) {
+			app.warnf("IP %s matches block list (%s). Access denied.", ip, matcher.pattern)
+			denyAccess(responseWriter, request, app, ip)
+			return
 		}
 	}
 
-	if !isAllowedIP {
-		cacheKey := fmt.Sprintf("app:%s:ip:%s", hostname, ip)
-		ipExistsInCache, ipExistsCheckError := redisClient.Exists(ctx, cacheKey).Result()
+	// The upstream gets the path the path rules are checked against, so
+	// neither /admin/../public nor /admin%2F..%2Fpublic reaches /admin. The
+	// escaped form of paths without dot segments or duplicate slashes is kept.
+	if normalized := normalizePath(request.URL.Path); normalized != request.URL.Path {
+		request.URL.Path, request.URL.RawPath = normalized, ""
+	}
 
-		// If the IP is not in cache and the request is to the secret path, allow access
-		if ipExistsInCache == 0 && strings.HasPrefix(request.URL.Path, app.SecretPathPrefix) {
-			err := redisClient.Set(ctx, cacheKey, "1", app.SessionTTL).Err()
-			if err != nil {
-				log.Printf("[%s] Redis error: %v", hostname, err)
+	// Public (or, with protected_paths, unprotected) paths are forwarded
+	// without a session, like allow-listed IPs
+	publicPath := isPublicPath(app, request.URL.Path)
+	if publicPath {
+		app.debugf("Path %s is public. Forwarding directly to upstream.", request.URL.Path)
+	}
+
+	// Check if IP is on the app's allow list
+	isAllowedIP := false
+	if rule, matched := allowListMatch(app, ip); !publicPath && matched {
+		app.infof("IP %s matches allow list (%s). Forwarding directly to upstream.", ip, rule)
+		isAllowedIP = true
+	}
+
+	if !isAllowedIP && !publicPath {
+		// Country rules apply before the secret path or an existing session is honored
+		if len(app.AllowCountries) > 0 || len(app.DenyCountries) > 0 {
+			if allowed, country := countryAllowed(app, ip); !allowed {
+				app.infof("Access denied to %s from country %s", ip, country)
+				denyAccess(responseWriter, request, app, ip)
+				return
+			}
+		}
+
+		// Clients that keep getting denied are turned away before Redis is
+		// queried, unless they have a session known without asking it:
+		// others behind the same IP, like a NAT, can't get a cookie session's
+		// holder limited
+		if app.RateLimiter != nil && !rateLimitExempt(app, request, ip) {
+			if wait := app.RateLimiter.retryAfter(ip); wait > 0 {
+				app.debugf("Rate limit exceeded for %s", ip)
+				responseWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(responseWriter, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		if isBanned(request.Context(), app, ip) {
+			app.infof("Access denied to %s (banned)", ip)
+			denyAccess(responseWriter, request, app, ip)
+			return
+		}
+
+		sessionKeys, missingFactors, sessionCheckError := checkSession(app, request, ip)
+		if sessionCheckError != nil {
+			if keys, allowed := storeFailureAllows(app, request, ip, sessionCheckError); allowed {
+				sessionKeys, missingFactors, sessionCheckError = keys, nil, nil
+			}
+		}
+
+		// Once an app-wide knock limit is reached, only existing sessions get through
+		if len(missingFactors) > 0 && sessionCheckError == nil {
+			if wait := knockLimitRetryAfter(request.Context(), app); wait > 0 {
+				app.debugf("Knock limit reached, turning away %s", ip)
+				responseWriter.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(responseWriter, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		// The logout path ends a session; without one it is denied like any
+		// other path, and never knocks
+		isLogout := request.URL.Path == app.LogoutPath
+		if isLogout && sessionCheckError == nil && len(missingFactors) == 0 && len(sessionKeys) > 0 {
+			if err := endSession(request.Context(), app, sessionKeys); err != nil {
+				app.errorf("Redis error: %v", err)
 				http.Error(responseWriter, "Internal error", http.StatusInternalServerError)
 				return
 			}
-			log.Printf("[%s] Access granted to %s via secret path", hostname, ip)
+			clearSessionCookie(responseWriter, request)
+			app.infof("Session of %s ended via logout path", ip)
+			app.metrics.activeSessions.Add(-1)
+			publishEvent(app, eventRevoke, ip, request.URL.Path)
+			serveLogout(responseWriter, app)
+			return
+		}
+
+		// If there is no session and the request knocks, allow access
+		var knock *knockRequest
+		if len(missingFactors) > 0 && !isLogout {
+			knock = detectKnock(app, request, ip)
+		}
+		// Knocks from other clients are denied like any request without a session
+		if knock != nil && !knockUserAgentAllowed(app, request) {
+			app.infof("Ignored %s from %s (User-Agent doesn't match knock_user_agent_regex)", knock.description, ip)
+			knock = nil
+		}
+		// Link previewers only GET, so they never get past the confirmation page
+		if knock != nil && knock.confirm && !confirmKnock(responseWriter, request, app, ip, knock) {
+			return
+		}
+		// Checked before claiming, so a refused knock doesn't use up its token
+		if knock != nil && app.MaxSessions > 0 {
+			reached, err := sessionLimitReached(request.Context(), app)
+			if err != nil {
+				app.errorf("Redis error: %v", err)
+				if app.StoreFailure == storeFailureClosed {
+					http.Error(responseWriter, "Internal error", http.StatusInternalServerError)
+					return
+				}
+			}
+			if reached {
+				app.warnf("Refused %s from %s: max_sessions (%d) reached", knock.description, ip, app.MaxSessions)
+				denyAccess(responseWriter, request, app, ip)
+				return
+			}
+		}
+		if knock != nil && knock.claim != nil && !knock.claim() {
+			app.infof("Rejected %s from %s (unknown or already used)", knock.description, ip)
+			knock = nil
+		}
+		// Without a session, the email path shows the login link form
+		if knock == nil && len(missingFactors) > 0 && app.EmailPath != "" && request.URL.Path == app.EmailPath && !isEmailLink(app, request) {
+			serveEmailLogin(responseWriter, request, app, ip)
+			return
+		}
+		stripKnockParameters(app, request)
+		if knock != nil {
+			sessionTTL := app.SessionTTL
+			if knock.ttl > 0 {
+				sessionTTL = knock.ttl
+			}
+			// The session records which knock granted it
+			err := grantSession(app, responseWriter, request, ip, knock.via, sessionTTL)
+			// Simultaneous knocks, e.g. a browser's parallel requests, grant
+			// the session only once
+			concurrent := errors.Is(err, errConcurrentGrant)
+			if err != nil && !concurrent {
+				app.errorf("Redis error: %v", err)
+				if app.StoreFailure == storeFailureClosed {
+					http.Error(responseWriter, "Internal error", http.StatusInternalServerError)
+					return
+				}
+				app.errorf("Granting %s anyway (store_failure %s)", ip, app.StoreFailure)
+			}
+			if concurrent {
+				app.debugf("Session of %s was just granted by a concurrent %s", ip, knock.description)
+			} else {
+				app.infof("Access granted to %s via %s", ip, knock.description)
+				app.metrics.grants.Add(1)
+				app.metrics.activeSessions.Add(1)
+				publishEvent(app, eventGrant, ip, request.URL.Path)
+				notifyGrant(app, ip, request.Header.Get("User-Agent"), sessionTTL)
+				countKnockGrant(request.Context(), app)
+				clearFailedAttempts(request.Context(), app, ip)
+				if app.RateLimiter != nil {
+					app.RateLimiter.reset(ip)
+				}
+			}
+			if app.ExposeSessionTTL {
+				setSessionExpires(request, time.Now().Add(sessionTTL))
+			}
 
-			// Check if the request comes from a browser
+			// Check if the request comes from a browser; header knocks are
+			// scripted and always proxied directly, while confirmation POSTs
+			// are ours and always redirected
 			userAgent := request.Header.Get("User-Agent")
-			if browserRegex.MatchString(userAgent) && !strings.Contains(strings.ToLower(userAgent), "android") {
-				// Remove the secretPathPrefix from the URL and redirect
-				newPath := strings.TrimPrefix(request.URL.Path, app.SecretPathPrefix)
+			if knock.confirm || !knock.proxy && isRedirectableBrowser(app, userAgent) {
+				// Remove the knock prefix from the URL and redirect
+				newPath := strings.TrimPrefix(request.URL.Path, knock.stripPrefix)
 				if newPath == "" {
 					newPath = "/"
 				}
-				log.Printf("[%s] Detected User-Agent %s. Redirecting %s to %s", hostname, userAgent, ip, newPath)
-				http.Redirect(responseWriter, request, newPath, http.StatusFound)
+				newPath = knockRedirectTarget(app, newPath, request.URL.RawQuery)
+				app.infof("Detected User-Agent %s. Redirecting %s to %s", userAgent, ip, newPath)
+				status := http.StatusFound
+				if knock.confirm {
+					status = http.StatusSeeOther
+				}
+				http.Redirect(responseWriter, request, newPath, status)
 				return
 			}
 		}
 
-		// If the IP is not in cache and not accessing the secret path, deny access
-		if ipExistsCheckError != nil || ipExistsInCache == 0 {
-			log.Printf("[%s] Access denied to %s", hostname, ip)
-			http.Error(responseWriter, "Access denied", http.StatusForbidden)
+		// If there is no session and the request didn't just knock, deny access
+		if knock == nil && (sessionCheckError != nil || len(missingFactors) > 0) {
+			if app.SessionMode == sessionModeBoth && sessionCheckError == nil {
+				app.infof("Access denied to %s (no %s session)", ip, strings.Join(missingFactors, " or "))
+			} else {
+				app.infof("Access denied to %s", ip)
+			}
+			// Only genuine failed attempts count, not Redis errors
+			if sessionCheckError == nil {
+				if app.RateLimiter != nil {
+					app.RateLimiter.consume(ip)
+				}
+				recordFailedAttempt(request.Context(), app, ip)
+				if slices.Contains(missingFactors, "cookie") {
+					clearSessionCookie(responseWriter, request)
+				}
+			}
+			denyAccess(responseWriter, request, app, ip)
 			return
 		}
 
-		// If auto-renew is enabled, renew the session TTL
-		if app.AutoRenew {
-			_ = redisClient.Expire(ctx, cacheKey, app.SessionTTL).Err()
+		// If auto-renew is enabled, renew the session TTL of existing sessions
+		if app.AutoRenew && knock == nil && len(sessionKeys) > 0 && !app.PreauthorizedIPs[sessionIP(app, ip)] {
+			if renewSession(app, sessionKeys, ip, request.URL.Path) && app.ExposeSessionTTL {
+				setSessionExpires(request, time.Now().Add(app.SessionTTL))
+			}
 		}
 
-		// Strip secretPathPrefix from URL.Path and URL.RawPath
-		request.URL.Path = strings.TrimPrefix(request.URL.Path, app.SecretPathPrefix)
+		// Strip the knock or matching secret path prefix from URL.Path and URL.RawPath
+		var secretPath string
+		if app.StripSecretPath {
+			secretPath, _ = matchSecretPath(app, request.URL.Path)
+		}
+		if knock != nil {
+			secretPath = knock.stripPrefix
+		}
+		request.URL.Path = strings.TrimPrefix(request.URL.Path, secretPath)
 		if request.URL.RawPath != "" {
-			request.URL.RawPath = strings.TrimPrefix(request.URL.RawPath, app.SecretPathPrefix)
+			request.URL.RawPath = strings.TrimPrefix(request.URL.RawPath, secretPath)
 		}
 		if request.URL.Path == "" {
 			request.URL.Path = "/"
@@ -266,16 +2077,173 @@ func handleRequest(responseWriter http.ResponseWriter, request *http.Request) {
 		}
 	}
 
-	log.Printf("[%s] Forwarding request from %s %s %s", hostname, ip, request.Method, request.URL.Path)
+	app.infof("Forwarding request from %s %s %s", ip, request.Method, logPath(app, request.URL.Path))
+	stripSessionCookie(request)
+
+	// For the proxy, which wildcard apps' copies share
+	ctx := context.WithValue(request.Context(), proxiedRequestKey{}, &proxiedRequest{app: app, clientIP: ip})
+	if app.UpstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.UpstreamTimeout)
+		defer cancel()
+	}
+	app.Proxy.ServeHTTP(responseWriter, request.WithContext(ctx))
+}
+
+// parseHTTPURL validates a URL that must be absolute http(s).
+func parseHTTPURL(raw string) (*url.URL, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return nil, fmt.Errorf("must be an absolute http or https URL")
+	}
+	return parsed, nil
+}
+
+// parseUpstreamURL validates an app's upstream_url like parseHTTPURL, also
+// refusing a fragment, which would never reach the upstream. Errors start
+// with the value, its password masked, to tell what is wrong with it: e.g.
+// localhost:3000 parses, as a URL of scheme localhost. A path is kept rather
+// than warned about, as the proxy prepends it to every request's (see
+// httputil.ProxyRequest.SetURL), mounting the app below it.
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	parsed, err := parseHTTPURL(raw)
+	switch {
+	case parsed == nil && strings.HasPrefix(fmt.Sprint(err), "parse "):
+		// Quotes the value already
+		return nil, err
+	case err != nil:
+		if masked, parseErr := url.Parse(raw); parseErr == nil && masked.User != nil {
+			raw = masked.Redacted()
+		}
+		return nil, fmt.Errorf("%q: %v", raw, err)
+	case parsed.Fragment != "" || strings.HasSuffix(raw, "#"):
+		return nil, fmt.Errorf("%q: must not have a #fragment", parsed.Redacted())
+	}
+	return parsed, nil
+}
+
+func defaultString(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
+
+// redisKey builds a Redis key from format and args under REDIS_KEY_PREFIX.
+// Every key mithrandir reads or writes goes through it, so several
+// environments or tools can share a Redis database.
+func redisKey(format string, args ...any) string {
+	return redisKeyPrefix + fmt.Sprintf(format, args...)
+}
+
+// appKey builds a key of app's own state, like bans or one-time tokens, with
+// redisKey.
+func appKey(app *AppConfig, format string, args ...any) string {
+	return redisKey("%s:%s", hashTag("app:"+app.Hostname), fmt.Sprintf(format, args...))
+}
+
+// hashTag wraps name in braces in a Redis Cluster, so all keys starting with
+// it map to the same slot and can be used together in transactions, scripts
+// and multi-key commands. Elsewhere names stay as they are, so keys written
+// before don't change.
+func hashTag(name string) string {
+	if redisCluster {
+		return "{" + name + "}"
+	}
+	return name
+}
+
+// currentApps returns the configured apps by hostname. The map is never
+// modified, a reload replaces it.
+func currentApps() map[string]*AppConfig {
+	if apps := loadedApps.Load(); apps != nil {
+		return *apps
+	}
+	return nil
+}
+
+// lookupApp returns the app serving hostname: the one configured for it,
+// else the wildcard app with the longest suffix of it, e.g. *.apps.example.com
+// before *.example.com for pr-1.apps.example.com, else the default app of
+// hostname *, if any. Wildcard and default apps come as a copy knowing the
+// hostname, which their sessions and links are for.
+func lookupApp(apps map[string]*AppConfig, hostname string) (*AppConfig, bool) {
+	hostname = strings.ToLower(hostname)
+	if app, found := apps[hostname]; found {
+		return app, true
+	}
+	for suffix := hostname; ; {
+		var more bool
+		_, suffix, more = strings.Cut(suffix, ".")
+		pattern := "*." + suffix
+		if !more {
+			pattern = "*"
+		}
+		if app, found := apps[pattern]; found {
+			instance := *app
+			instance.host = hostname
+			instance.logger = newAppLogger(app.LogLevel, hostname)
+			return &instance, true
+		}
+		if !more {
+			return nil, false
+		}
+	}
+}
+
+// warnHostnameOverlaps warns of the hostnames, aliases and wildcards that a
+// broader wildcard of another app also matches: lookupApp sends their
+// requests to the more specific app, which is worth knowing if it wasn't
+// meant. The default app is left out, as matching the rest is its point.
+func warnHostnameOverlaps(apps map[string]*AppConfig) {
+	for _, name := range slices.Sorted(maps.Keys(apps)) {
+		for suffix := strings.TrimPrefix(name, "*."); ; {
+			var more bool
+			if _, suffix, more = strings.Cut(suffix, "."); !more {
+				break
+			}
+			if other, found := apps["*."+suffix]; found && other != apps[name] {
+				warnf("%s is also matched by *.%s, whose app won't get its requests", name, suffix)
+				break
+			}
+		}
+	}
+}
+
+// validHostname reports whether hostname is one, a wildcard with a leading *.
+// in front of one, or the * of the default app.
+func validHostname(hostname string) bool {
+	if hostname == "*" {
+		return true
+	}
+	pattern := strings.TrimPrefix(hostname, "*.")
+	return pattern != "" && !strings.Contains(pattern, "*")
+}
+
+func isWildcardHostname(hostname string) bool {
+	return strings.HasPrefix(hostname, "*")
+}
 
-	// Create a reverse proxy for this specific app
-	proxy := httputil.NewSingleHostReverseProxy(app.UpstreamURL)
-	proxy.ServeHTTP(responseWriter, request)
+// requestHost returns the hostname the app's links are for: the requested one
+// for wildcard apps, resolved by lookupApp.
+func (app *AppConfig) requestHost() string {
+	return defaultString(app.host, app.Hostname)
 }
 
+// getenv returns the value of a variable: its flag, for a global setting,
+// else the environment, else the config file, else fallback.
 func getenv(key, fallback string) string {
+	if val, found := flagSettings[key]; found {
+		return val
+	}
 	if val := os.Getenv(key); val != "" {
 		return val
 	}
+	if val, found := appsFile.setting(key); found {
+		return val
+	}
 	return fallback
 }
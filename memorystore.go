@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the memory store drops expired sessions
+const memorySweepInterval = time.Minute
+
+// memoryStore keeps sessions in this process, for single instances without
+// Redis. Sessions are lost on restart.
+type memoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+}
+
+type memorySession struct {
+	metadata map[string]string
+	// Zero for sessions without expiry
+	expires time.Time
+	granted time.Time
+	// Only the first key of a session is listed and counted
+	indexed bool
+}
+
+func newMemoryStore() *memoryStore {
+	store := &memoryStore{sessions: make(map[string]*memorySession)}
+	go store.sweep()
+	return store
+}
+
+func (s *memoryStore) sweep() {
+	for range time.Tick(memorySweepInterval) {
+		s.mu.Lock()
+		now := time.Now()
+		for key, session := range s.sessions {
+			if session.expired(now) {
+				delete(s.sessions, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (session *memorySession) expired(now time.Time) bool {
+	return !session.expires.IsZero() && now.After(session.expires)
+}
+
+// lookup returns the live session under key. The caller holds s.mu.
+func (s *memoryStore) lookup(key string, now time.Time) *memorySession {
+	session, exists := s.sessions[key]
+	if !exists {
+		return nil
+	}
+	if session.expired(now) {
+		delete(s.sessions, key)
+		return nil
+	}
+	return session
+}
+
+// describe copies what storedSession needs from the session under key. For
+// the memory store, the caller holds s.mu.
+func (session *memorySession) describe(app *AppConfig, key string, now time.Time) storedSession {
+	described := storedSession{key: key, exists: true, ttl: -1, metadata: make(map[string]string, len(session.metadata))}
+	for field, value := range session.metadata {
+		described.metadata[field] = value
+	}
+	if !session.expires.IsZero() {
+		described.ttl = session.expires.Sub(now)
+	}
+	described.aged = app.MaxSessionAge > 0 && (session.expires.IsZero() || now.Sub(session.granted) > app.MaxSessionAge)
+	return described
+}
+
+func (s *memoryStore) Exists(ctx context.Context, app *AppConfig, keys []string) ([]storedSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]storedSession, len(keys))
+	for i, key := range keys {
+		if session := s.lookup(key, now); session != nil {
+			sessions[i] = session.describe(app, key, now)
+		} else {
+			sessions[i] = storedSession{key: key}
+		}
+	}
+	return sessions, nil
+}
+
+func (s *memoryStore) Grant(ctx context.Context, app *AppConfig, keys []string, metadata map[string]any, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing := s.lookup(keys[0], now); existing != nil && existing.granted.Unix() >= now.Unix() {
+		return errConcurrentGrant
+	}
+	for i, key := range keys {
+		s.sessions[key] = newMemorySession(metadata, ttl, now, i == 0)
+	}
+	return nil
+}
+
+func newMemorySession(metadata map[string]any, ttl time.Duration, now time.Time, indexed bool) *memorySession {
+	session := &memorySession{metadata: make(map[string]string, len(metadata)), granted: now, indexed: indexed}
+	for field, value := range metadata {
+		session.metadata[field] = fmt.Sprint(value)
+	}
+	if ttl > 0 {
+		session.expires = now.Add(ttl)
+	}
+	return session
+}
+
+func (s *memoryStore) Renew(ctx context.Context, renewals []*renewal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, queued := range renewals {
+		for _, key := range queued.keys {
+			session := s.lookup(key, now)
+			if session == nil {
+				continue
+			}
+			session.renew(queued, now)
+		}
+	}
+	return nil
+}
+
+// renew extends the session by its app's TTL and counts the renewal's
+// requests.
+func (session *memorySession) renew(queued *renewal, now time.Time) {
+	session.expires = now.Add(queued.app.SessionTTL)
+	session.metadata["last_seen"] = strconv.FormatInt(now.Unix(), 10)
+	count, _ := strconv.ParseInt(session.metadata["request_count"], 10, 64)
+	session.metadata["request_count"] = strconv.FormatInt(count+queued.requests, 10)
+}
+
+func (s *memoryStore) Revoke(ctx context.Context, app *AppConfig, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.sessions, key)
+	}
+	return nil
+}
+
+// List pages through the app's sessions in key order, with the cursor
+// counting the sessions already listed.
+func (s *memoryStore) List(ctx context.Context, app *AppConfig, cursor uint64, count int) ([]storedSession, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	keys := s.indexed(app, now)
+	sessions := []storedSession{}
+	for i := cursor; i < uint64(len(keys)) && len(sessions) < count; i++ {
+		sessions = append(sessions, s.sessions[keys[i]].describe(app, keys[i], now))
+	}
+	next := cursor + uint64(len(sessions))
+	if next >= uint64(len(keys)) {
+		next = 0
+	}
+	return sessions, next, nil
+}
+
+func (s *memoryStore) Count(ctx context.Context, app *AppConfig) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.indexed(app, time.Now())), nil
+}
+
+// indexed returns the sorted keys of the app's live sessions. The caller
+// holds s.mu.
+func (s *memoryStore) indexed(app *AppConfig, now time.Time) []string {
+	prefix := sessionNamespace(app) + ":"
+	var keys []string
+	for key, session := range s.sessions {
+		if session.indexed && strings.HasPrefix(key, prefix) && !session.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
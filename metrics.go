@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Sessions expire in Redis without mithrandir noticing, so the active
+// session gauge is recounted from the session index this often
+const metricsReconcileInterval = time.Minute
+
+// appMetrics counts what happened to an app since startup.
+type appMetrics struct {
+	grants   atomic.Int64
+	denies   atomic.Int64
+	renewals atomic.Int64
+	// Renewals skipped because the renewal queue was full
+	droppedRenewals atomic.Int64
+	activeSessions  atomic.Int64
+	// Session and ban lookups answered by, or missing from, the denial cache
+	denialCacheHits   atomic.Int64
+	denialCacheMisses atomic.Int64
+	// Session lookups answered by, or missing from, the session cache
+	sessionCacheHits   atomic.Int64
+	sessionCacheMisses atomic.Int64
+}
+
+// metricsSnapshot is a copy of an app's metrics at one point in time.
+type metricsSnapshot struct {
+	grants, denies, renewals, droppedRenewals, activeSessions int64
+	denialCacheHits, denialCacheMisses                        int64
+	sessionCacheHits, sessionCacheMisses                      int64
+}
+
+func (m *appMetrics) snapshot() metricsSnapshot {
+	return metricsSnapshot{
+		grants:             m.grants.Load(),
+		denies:             m.denies.Load(),
+		renewals:           m.renewals.Load(),
+		droppedRenewals:    m.droppedRenewals.Load(),
+		activeSessions:     m.activeSessions.Load(),
+		denialCacheHits:    m.denialCacheHits.Load(),
+		denialCacheMisses:  m.denialCacheMisses.Load(),
+		sessionCacheHits:   m.sessionCacheHits.Load(),
+		sessionCacheMisses: m.sessionCacheMisses.Load(),
+	}
+}
+
+// reconcileActiveSessions periodically sets every app's active session gauge to
+// the number of live sessions in its index.
+func reconcileActiveSessions() {
+	for {
+		apps := currentApps()
+		for _, hostname := range sortedHostnames(apps) {
+			app := apps[hostname]
+			count, err := sessionStore.Count(backgroundContext, app)
+			if err != nil {
+				app.errorf("Redis error: %v", err)
+				continue
+			}
+			app.metrics.activeSessions.Store(int64(count))
+		}
+		time.Sleep(metricsReconcileInterval)
+	}
+}
+
+// logMetrics logs a summary line per app every interval, with the counters'
+// increase since the previous summary.
+func logMetrics(interval time.Duration) {
+	previous := make(map[string]metricsSnapshot)
+	for range time.Tick(interval) {
+		apps := currentApps()
+		for _, hostname := range sortedHostnames(apps) {
+			app := apps[hostname]
+			current := app.metrics.snapshot()
+			last := previous[hostname]
+			app.infof("Last %s: %d grants, %d denies, %d renewals (%d dropped); %d active sessions", interval,
+				current.grants-last.grants, current.denies-last.denies, current.renewals-last.renewals,
+				current.droppedRenewals-last.droppedRenewals, current.activeSessions)
+			previous[hostname] = current
+		}
+	}
+}
+
+// serveMetrics answers GET /metrics on the admin listener in the Prometheus
+// text format.
+func serveMetrics(responseWriter http.ResponseWriter, request *http.Request, caller string) {
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	apps := currentApps()
+	hostnames := sortedHostnames(apps)
+	for _, metric := range []struct {
+		name, kind, help string
+		value            func(metricsSnapshot) int64
+	}{
+		{"mithrandir_grants_total", "counter", "Sessions granted.", func(s metricsSnapshot) int64 { return s.grants }},
+		{"mithrandir_denies_total", "counter", "Requests denied.", func(s metricsSnapshot) int64 { return s.denies }},
+		{"mithrandir_renewals_total", "counter", "Session renewals sent to Redis.", func(s metricsSnapshot) int64 { return s.renewals }},
+		{"mithrandir_renewals_dropped_total", "counter", "Session renewals skipped because the renewal queue was full.", func(s metricsSnapshot) int64 { return s.droppedRenewals }},
+		{"mithrandir_active_sessions", "gauge", "Sessions currently active.", func(s metricsSnapshot) int64 { return s.activeSessions }},
+		{"mithrandir_denial_cache_hits_total", "counter", "Session and ban lookups answered by the denial cache.", func(s metricsSnapshot) int64 { return s.denialCacheHits }},
+		{"mithrandir_denial_cache_misses_total", "counter", "Session and ban lookups sent to Redis with the denial cache enabled.", func(s metricsSnapshot) int64 { return s.denialCacheMisses }},
+		{"mithrandir_session_cache_hits_total", "counter", "Session lookups answered by the session cache.", func(s metricsSnapshot) int64 { return s.sessionCacheHits }},
+		{"mithrandir_session_cache_misses_total", "counter", "Session lookups sent to Redis with the session cache enabled.", func(s metricsSnapshot) int64 { return s.sessionCacheMisses }},
+	} {
+		fmt.Fprintf(responseWriter, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, hostname := range hostnames {
+			fmt.Fprintf(responseWriter, "%s{app=%q} %d\n", metric.name, hostname, metric.value(apps[hostname].metrics.snapshot()))
+		}
+	}
+	if redisBreaker != nil {
+		open := 0
+		if redisBreaker.isOpen() {
+			open = 1
+		}
+		fmt.Fprintf(responseWriter, "# HELP mithrandir_redis_circuit_open Whether the Redis circuit breaker is failing Redis calls.\n# TYPE mithrandir_redis_circuit_open gauge\nmithrandir_redis_circuit_open %d\n", open)
+	}
+}
+
+// sortedHostnames returns the apps' hostnames, sorted, leaving out their
+// aliases, so each app comes once.
+func sortedHostnames(apps map[string]*AppConfig) []string {
+	hostnames := make([]string, 0, len(apps))
+	for hostname, app := range apps {
+		if hostname == app.Hostname {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/redis/go-redis/v9"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Longer path segments can't be tokens issued by -once and are ignored
+const maxOneTimeTokenLength = 64
+
+// matchOneTimePath extracts the token from a path of the form
+// <once_path>/<token>[/rest], returning the knock path to strip with it.
+func matchOneTimePath(app *AppConfig, path string) (token, knockPath string, found bool) {
+	if app.OncePath == "" {
+		return "", "", false
+	}
+	base := strings.TrimSuffix(app.OncePath, "/") + "/"
+	rest, found := strings.CutPrefix(path, base)
+	if !found {
+		return "", "", false
+	}
+	token, _, _ = strings.Cut(rest, "/")
+	if token == "" || len(token) > maxOneTimeTokenLength {
+		return "", "", false
+	}
+	return token, base + token, true
+}
+
+// consumeOneTimeToken atomically deletes a one-time token, reporting whether
+// it existed. GETDEL makes sure two racing requests can't both use it. Redis
+// errors fail closed.
+func consumeOneTimeToken(ctx context.Context, app *AppConfig, token string) bool {
+	_, err := redisClient.GetDel(ctx, oneTimeTokenKey(app, token)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			app.errorf("Redis error: %v", err)
+		}
+		return false
+	}
+	return true
+}
+
+// createOneTimeToken stores a new random token that grants one session within
+// validFor and returns the knock link using it.
+func createOneTimeToken(app *AppConfig, validFor time.Duration) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	if err := redisClient.Set(backgroundContext, oneTimeTokenKey(app, token), "1", validFor).Err(); err != nil {
+		return "", err
+	}
+
+	link := url.URL{Scheme: "https", Host: app.requestHost(), Path: strings.TrimSuffix(app.OncePath, "/") + "/" + token}
+	return link.String(), nil
+}
+
+func oneTimeTokenKey(app *AppConfig, token string) string {
+	return appKey(app, "otp:%s", token)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var pageTemplates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+// serveKnockForm answers a knock that needs confirmation with a page whose
+// form POSTs back to the same URL: a plain confirmation button, or the
+// passphrase form when the app has a knock passphrase.
+func serveKnockForm(responseWriter http.ResponseWriter, request *http.Request, app *AppConfig, message string, status int) {
+	name := "confirm.html"
+	if app.KnockPassphrase != nil {
+		name = "passphrase.html"
+	}
+	servePage(responseWriter, name, status, map[string]string{
+		"Hostname": app.requestHost(),
+		"Action":   request.URL.RequestURI(),
+		"Error":    message,
+	})
+}
+
+// serveLogout confirms that a session was ended.
+func serveLogout(responseWriter http.ResponseWriter, app *AppConfig) {
+	servePage(responseWriter, "logout.html", http.StatusOK, map[string]string{"Hostname": app.requestHost()})
+}
+
+// servePage renders one of the embedded templates. Pages may carry knock
+// credentials in their URLs, so they are never cached, indexed or referred.
+func servePage(responseWriter http.ResponseWriter, name string, status int, data any) {
+	header := responseWriter.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	header.Set("Referrer-Policy", "no-referrer")
+	header.Set("X-Robots-Tag", "noindex, nofollow")
+	responseWriter.WriteHeader(status)
+	if err := pageTemplates.ExecuteTemplate(responseWriter, name, data); err != nil {
+		errorf("Rendering %s failed: %v", name, err)
+	}
+}
+
+// loadPageTemplate parses a user-provided page template once at startup.
+func loadPageTemplate(path string) (*template.Template, error) {
+	return template.ParseFiles(path)
+}
+
+// notFound answers requests for hostnames without an app, with the global
+// not-found page if there is one. Apps with deny_status 404 use it as well, so
+// their denials are indistinguishable from an unknown hostname.
+func notFound(responseWriter http.ResponseWriter, hostname string) {
+	data := map[string]string{"Hostname": hostname}
+	if notFoundPage == nil || !writeTemplate(responseWriter, notFoundPage, http.StatusNotFound, data) {
+		http.Error(responseWriter, "Not Found", http.StatusNotFound)
+	}
+}
+
+// writeTemplate renders a template into a buffer first, so a failing
+// template leaves the response untouched for the plain text fallback.
+func writeTemplate(responseWriter http.ResponseWriter, page *template.Template, status int, data any) bool {
+	var buffer bytes.Buffer
+	if err := page.Execute(&buffer, data); err != nil {
+		errorf("Rendering %s failed: %v", page.Name(), err)
+		return false
+	}
+	responseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	responseWriter.WriteHeader(status)
+	_, _ = buffer.WriteTo(responseWriter)
+	return true
+}
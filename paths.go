@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// normalizePath resolves dot segments and duplicate slashes the way the
+// upstream will, so path rules can't be bypassed with /public/../private.
+// A trailing slash is kept since prefixes may rely on it.
+func normalizePath(requestPath string) string {
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// parsePathPatterns parses a comma-separated list of path prefixes or glob
+// patterns (as understood by path.Match).
+func parsePathPatterns(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("path pattern %s must start with '/'", pattern)
+		}
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %s: %v", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchPathPattern reports whether a normalized path matches a pattern. Glob
+// patterns must match the whole path; prefixes match the path itself and
+// anything below it, but not /prefixfoo.
+func matchPathPattern(pattern, requestPath string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, _ := path.Match(pattern, requestPath)
+		return matched
+	}
+	prefix := strings.TrimSuffix(pattern, "/")
+	return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+// isPublicPath reports whether a request path is exempt from the session
+// check: it matches public_paths or, when protected_paths is set, doesn't
+// match any of them. Knock paths always stay protected so knocking works.
+func isPublicPath(app *AppConfig, requestPath string) bool {
+	normalized := normalizePath(requestPath)
+	if len(app.ProtectedPaths) > 0 {
+		return !matchAnyPathPattern(app.ProtectedPaths, normalized) && !isKnockPath(app, requestPath)
+	}
+	return matchAnyPathPattern(app.PublicPaths, normalized)
+}
+
+func matchAnyPathPattern(patterns []string, requestPath string) bool {
+	for _, pattern := range patterns {
+		if matchPathPattern(pattern, requestPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// knockPaths returns the path prefixes below which requests may knock.
+func knockPaths(app *AppConfig) []string {
+	paths := append([]string{}, app.SecretPathPrefixes...)
+	for _, knockPath := range []string{app.OncePath, app.SignedPath, app.EmailPath, app.LogoutPath} {
+		if knockPath != "" {
+			paths = append(paths, knockPath)
+		}
+	}
+	return paths
+}
+
+// isKnockPath reports whether a raw request path starts with a knock path,
+// using the same plain prefix match as the knock detection.
+func isKnockPath(app *AppConfig, requestPath string) bool {
+	for _, knockPath := range knockPaths(app) {
+		if strings.HasPrefix(requestPath, knockPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKnockPathsReachable makes sure no public path covers a path used for
+// knocking, which would otherwise be proxied without ever granting a session.
+func checkKnockPathsReachable(app *AppConfig) error {
+	for _, knockPath := range knockPaths(app) {
+		// Also check below the path, where TOTP codes and tokens go
+		below := strings.TrimSuffix(knockPath, "/") + "/x"
+		if isPublicPath(app, knockPath) || isPublicPath(app, below) {
+			return fmt.Errorf("public_paths must not cover the knock path %s", knockPath)
+		}
+	}
+	return nil
+}
+
+// checkKnockPathsDistinct makes sure no knock path lies below one checked
+// before it, which would take its requests: a one-time link below a plain
+// secret path would knock as the secret path, and keep working after use.
+func checkKnockPathsDistinct(app *AppConfig) error {
+	type knockPath struct{ name, path string }
+	linkPaths := []knockPath{{"signed_path", app.SignedPath}, {"email_path", app.EmailPath}}
+	for _, link := range linkPaths {
+		if _, _, found := matchOneTimePath(app, link.path); link.path != "" && found {
+			return fmt.Errorf("%s must not be below once_path %s", link.name, app.OncePath)
+		}
+	}
+	// TOTP codes and rotated segments never look like these paths
+	if app.TOTPKey != nil || app.RotationSeed != nil {
+		return nil
+	}
+	if app.OncePath != "" {
+		// Where the tokens go
+		linkPaths = append(linkPaths, knockPath{"once_path", strings.TrimSuffix(app.OncePath, "/") + "/token"})
+	}
+	for _, link := range linkPaths {
+		if secretPath, found := matchSecretPath(app, link.path); link.path != "" && found {
+			return fmt.Errorf("%s must not be below the secret path %s", link.name, secretPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsPublicPathSharedPrefix(t *testing.T) {
+	public := &AppConfig{PublicPaths: []string{"/admin", "/static/"}}
+	protected := &AppConfig{ProtectedPaths: []string{"/admin"}, SecretPathPrefixes: []string{"/knock"}}
+	tests := []struct {
+		path              string
+		public, protected bool
+	}{
+		{"/admin", true, false},
+		{"/admin/", true, false},
+		{"/admin/users", true, false},
+		{"/administrator", false, true},
+		{"/admin-panel", false, true},
+		{"/adminx/../admin/users", true, false},
+		{"/static/app.js", true, true},
+		{"/static", true, true},
+		{"/staticfiles/app.js", false, true},
+		{"/knock", false, false},
+	}
+	for _, test := range tests {
+		if got := isPublicPath(public, test.path); got != test.public {
+			t.Errorf("isPublicPath(%q) with public_paths %v = %t, want %t", test.path, public.PublicPaths, got, test.public)
+		}
+		if got := isPublicPath(protected, test.path); got != test.protected {
+			t.Errorf("isPublicPath(%q) with protected_paths %v = %t, want %t", test.path, protected.ProtectedPaths, got, test.protected)
+		}
+	}
+}
+
+// pathRecordingApp serves an app with the given path rule settings for the
+// test, whose upstream records the escaped path of the requests it gets.
+// Clients have no session.
+func pathRecordingApp(t *testing.T, settings map[string]string) *[]string {
+	var forwarded []string
+	upstream, _ := countingUpstream(t, func(responseWriter http.ResponseWriter, request *http.Request) {
+		forwarded = append(forwarded, request.URL.EscapedPath())
+		responseWriter.Write([]byte("ok"))
+	})
+	config := map[string]string{
+		"hostname":     "app.example.com",
+		"upstream_url": upstream.URL,
+		"secret_path":  "/knock",
+		"session_ttl":  "1h",
+		"log_level":    "warn",
+	}
+	maps.Copy(config, settings)
+	useSessionStore(t, newMemoryStore())
+	useApp(t, config)
+	return &forwarded
+}
+
+func TestProtectedPathsForwardNormalizedPath(t *testing.T) {
+	forwarded := pathRecordingApp(t, map[string]string{"protected_paths": "/admin"})
+	tests := []struct {
+		target string
+		// "" for denied
+		want string
+	}{
+		{"/admin/../public", "/public"},
+		{"/admin%2F..%2Fpublic", "/public"},
+		{"/admin//..//public/", "/public/"},
+		{"/public/../admin", ""},
+		{"/public%2F..%2Fadmin", ""},
+		{"/public%2F%2E%2E%2Fadmin", ""},
+		// Kept escaped, as it is what was checked
+		{"/public/a%2Fb", "/public/a%2Fb"},
+	}
+	for _, test := range tests {
+		*forwarded = nil
+		recorder := httptest.NewRecorder()
+		handleRequest(recorder, httptest.NewRequest(http.MethodGet, "http://app.example.com"+test.target, nil))
+		switch {
+		case test.want == "" && len(*forwarded) > 0:
+			t.Errorf("%s without a session forwarded as %v, want denied", test.target, *forwarded)
+		case test.want != "" && (len(*forwarded) != 1 || (*forwarded)[0] != test.want):
+			t.Errorf("%s forwarded as %v (%d), want %s", test.target, *forwarded, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestPublicPathsForwardNormalizedPath(t *testing.T) {
+	forwarded := pathRecordingApp(t, map[string]string{"public_paths": "/public"})
+	for _, target := range []string{"/public/../admin", "/public/..%2Fadmin", "/public%2F..%2Fadmin", "/public/%2E%2E/admin"} {
+		*forwarded = nil
+		handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://app.example.com"+target, nil))
+		if len(*forwarded) > 0 {
+			t.Errorf("%s without a session forwarded as %v, want denied", target, *forwarded)
+		}
+	}
+	handleRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://app.example.com/admin/..%2Fpublic/hook", nil))
+	if len(*forwarded) != 1 || (*forwarded)[0] != "/public/hook" {
+		t.Errorf("/admin/..%%2Fpublic/hook forwarded as %v, want /public/hook", *forwarded)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rateLimiter is an in-process token bucket limiter keyed by client IP. Only
+// unauthenticated (denied) requests consume tokens, so clients holding a valid
+// session are never limited.
+type rateLimiter struct {
+	perSecond float64
+	burst     float64
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter allows bursts of perMinute requests, refilled evenly over a
+// minute.
+func newRateLimiter(perMinute int) *rateLimiter {
+	limiter := &rateLimiter{
+		perSecond: float64(perMinute) / 60,
+		burst:     float64(perMinute),
+		buckets:   make(map[string]*tokenBucket),
+	}
+	return limiter
+}
+
+// refill brings a bucket up to date. Callers must hold the lock.
+func (l *rateLimiter) refill(key string, now time.Time) *tokenBucket {
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.perSecond)
+	bucket.updated = now
+	return bucket
+}
+
+// retryAfter returns how long key has to wait before its next unauthenticated
+// request is accepted, or zero if it isn't limited.
+func (l *rateLimiter) retryAfter(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.refill(key, time.Now())
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / l.perSecond * float64(time.Second))
+}
+
+// consume takes one token from key's bucket.
+func (l *rateLimiter) consume(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.refill(key, time.Now())
+	bucket.tokens = max(0, bucket.tokens-1)
+}
+
+// reset forgets key, e.g. after it was granted a session.
+func (l *rateLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+// rateLimitExempt reports whether a request has a session that can be told
+// without a round trip to Redis: every factor's key is in the session cache,
+// or with STORE=memory or bolt, in the store itself. Holders of a session
+// that isn't cached yet are limited like clients without one.
+func rateLimitExempt(app *AppConfig, request *http.Request, ip string) bool {
+	var keys []string
+	for _, factor := range sessionFactors(app, request, ip) {
+		if factor.key == "" {
+			return false
+		}
+		keys = append(keys, factor.key)
+	}
+	if _, remote := sessionStore.(redisStore); !remote {
+		sessions, err := sessionStore.Exists(request.Context(), app, keys)
+		return err == nil && !slices.ContainsFunc(sessions, func(session storedSession) bool { return !session.exists })
+	}
+	for _, key := range keys {
+		if _, found := cachedSessions.get(key); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sweep drops buckets that have refilled completely, since they are
+// indistinguishable from new ones. See sweepApps.
+func (l *rateLimiter) sweep(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key := range l.buckets {
+		if l.refill(key, now).tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitSparesRedis(t *testing.T) {
+	server := useMiniredis(t)
+	useSessionStore(t, redisStore{})
+	previousCache := cachedSessions
+	cachedSessions = newSessionCache(time.Minute, 100)
+	t.Cleanup(func() { cachedSessions = previousCache })
+	captureLogs(t)
+	upstream, _ := countingUpstream(t, nil)
+	app := useApp(t, map[string]string{
+		"hostname":     "app.example.com",
+		"upstream_url": upstream.URL,
+		"secret_path":  "/knock",
+		"session_ttl":  "1h",
+		"session_mode": "cookie",
+		"rate_limit":   "1",
+		// Every request without a session looks up its ban
+		"ban_threshold": "100",
+	})
+	knock := httptest.NewRecorder()
+	if err := grantSession(app, knock, httptest.NewRequest(http.MethodGet, "http://app.example.com/knock", nil), "192.0.2.1", "secret_path", app.SessionTTL); err != nil {
+		t.Fatal(err)
+	}
+	cookie := knock.Result().Cookies()[0]
+	// All from 192.0.2.1, one with the session, the other without
+	request := func(withSession bool) int {
+		request := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		if withSession {
+			request.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		handleRequest(recorder, request)
+		return recorder.Code
+	}
+
+	if code := request(true); code != http.StatusOK {
+		t.Fatalf("session holder got %d, want 200", code)
+	}
+	// Uses up the budget of the IP
+	request(false)
+	// For the grant's sampleSessionIndex
+	time.Sleep(100 * time.Millisecond)
+	commands := server.CommandCount()
+	for range 10 {
+		if code := request(false); code != http.StatusTooManyRequests {
+			t.Fatalf("flooding client got %d, want 429", code)
+		}
+	}
+	if sent := server.CommandCount() - commands; sent != 0 {
+		t.Errorf("10 rate limited requests sent %d Redis commands, want none", sent)
+	}
+	if code := request(true); code != http.StatusOK {
+		t.Errorf("session holder behind the limited IP got %d, want 200", code)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// redisConfig holds how to reach Redis: a single address, the master
+// monitored by a set of Sentinels, or a Redis Cluster.
+type redisConfig struct {
+	// tcp, or unix for REDIS_ADDRESS=unix:///path/to/redis.sock
+	network  string
+	address  string
+	username string
+	password string
+	database int
+	// Nil without REDIS_TLS
+	tlsConfig *tls.Config
+	// How long to wait for Redis at startup
+	connectTimeout time.Duration
+	// Deadline of every Redis call; 0 for none
+	opTimeout time.Duration
+	// Circuit breaker settings, see circuitBreaker; 0 failures disables it
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// How often the health monitor pings Redis
+	healthInterval time.Duration
+	// Connection pool of each Redis node; the defaults are go-redis'
+	poolSize     int
+	minIdleConns int
+	dialTimeout  time.Duration
+	// Socket timeouts of calls without a deadline, i.e. with REDIS_OP_TIMEOUT=0
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// Cluster mode when set
+	clusterAddresses []string
+	// Sentinel mode when set
+	sentinelAddresses []string
+	masterName        string
+	sentinelPassword  string
+}
+
+// loadRedisConfig reads the Redis connection settings from the environment.
+func loadRedisConfig() (*redisConfig, error) {
+	config := &redisConfig{
+		network:          "tcp",
+		address:          setting("REDIS_ADDRESS"),
+		username:         setting("REDIS_USERNAME"),
+		password:         setting("REDIS_PASSWORD"),
+		masterName:       setting("REDIS_MASTER_NAME"),
+		sentinelPassword: setting("REDIS_SENTINEL_PASSWORD"),
+	}
+	var err error
+	if path, found := strings.CutPrefix(config.address, "unix://"); found {
+		if err := checkRedisSocket(path); err != nil {
+			return nil, err
+		}
+		config.network, config.address = "unix", path
+	}
+	if config.connectTimeout, err = time.ParseDuration(setting("REDIS_CONNECT_TIMEOUT")); err != nil || config.connectTimeout < 0 {
+		return nil, fmt.Errorf("invalid REDIS_CONNECT_TIMEOUT: %s", setting("REDIS_CONNECT_TIMEOUT"))
+	}
+	if config.opTimeout, err = time.ParseDuration(setting("REDIS_OP_TIMEOUT")); err != nil || config.opTimeout < 0 {
+		return nil, fmt.Errorf("invalid REDIS_OP_TIMEOUT: %s", setting("REDIS_OP_TIMEOUT"))
+	}
+	if config.breakerThreshold, err = strconv.Atoi(setting("REDIS_BREAKER_THRESHOLD")); err != nil || config.breakerThreshold < 0 {
+		return nil, fmt.Errorf("invalid REDIS_BREAKER_THRESHOLD: %s", setting("REDIS_BREAKER_THRESHOLD"))
+	}
+	if config.breakerCooldown, err = time.ParseDuration(setting("REDIS_BREAKER_COOLDOWN")); err != nil || config.breakerCooldown <= 0 {
+		return nil, fmt.Errorf("invalid REDIS_BREAKER_COOLDOWN: %s", setting("REDIS_BREAKER_COOLDOWN"))
+	}
+	if config.healthInterval, err = time.ParseDuration(setting("REDIS_HEALTH_INTERVAL")); err != nil || config.healthInterval <= 0 {
+		return nil, fmt.Errorf("invalid REDIS_HEALTH_INTERVAL: %s", setting("REDIS_HEALTH_INTERVAL"))
+	}
+	if config.poolSize, err = strconv.Atoi(getenv("REDIS_POOL_SIZE", strconv.Itoa(10*runtime.GOMAXPROCS(0)))); err != nil || config.poolSize < 1 {
+		return nil, fmt.Errorf("invalid REDIS_POOL_SIZE: %s", setting("REDIS_POOL_SIZE"))
+	}
+	if config.minIdleConns, err = strconv.Atoi(setting("REDIS_MIN_IDLE_CONNS")); err != nil || config.minIdleConns < 0 {
+		return nil, fmt.Errorf("invalid REDIS_MIN_IDLE_CONNS: %s", setting("REDIS_MIN_IDLE_CONNS"))
+	}
+	if config.minIdleConns > config.poolSize {
+		return nil, fmt.Errorf("REDIS_MIN_IDLE_CONNS (%d) can't exceed REDIS_POOL_SIZE (%d)", config.minIdleConns, config.poolSize)
+	}
+	if config.dialTimeout, err = time.ParseDuration(setting("REDIS_DIAL_TIMEOUT")); err != nil || config.dialTimeout <= 0 {
+		return nil, fmt.Errorf("invalid REDIS_DIAL_TIMEOUT: %s", setting("REDIS_DIAL_TIMEOUT"))
+	}
+	if config.readTimeout, err = time.ParseDuration(setting("REDIS_READ_TIMEOUT")); err != nil || config.readTimeout <= 0 {
+		return nil, fmt.Errorf("invalid REDIS_READ_TIMEOUT: %s", setting("REDIS_READ_TIMEOUT"))
+	}
+	if config.writeTimeout, err = time.ParseDuration(getenv("REDIS_WRITE_TIMEOUT", config.readTimeout.String())); err != nil || config.writeTimeout <= 0 {
+		return nil, fmt.Errorf("invalid REDIS_WRITE_TIMEOUT: %s", setting("REDIS_WRITE_TIMEOUT"))
+	}
+	if config.database, err = strconv.Atoi(setting("REDIS_DB")); err != nil || config.database < 0 {
+		return nil, fmt.Errorf("invalid REDIS_DB: %s", setting("REDIS_DB"))
+	}
+	if config.sentinelAddresses, err = parseRedisAddresses("REDIS_SENTINEL_ADDRS"); err != nil {
+		return nil, err
+	}
+	if config.clusterAddresses, err = parseRedisAddresses("REDIS_CLUSTER_ADDRS"); err != nil {
+		return nil, err
+	}
+	if len(config.clusterAddresses) > 0 && len(config.sentinelAddresses) > 0 {
+		return nil, fmt.Errorf("REDIS_CLUSTER_ADDRS and REDIS_SENTINEL_ADDRS are mutually exclusive")
+	}
+	// Redis Cluster only has database 0
+	if len(config.clusterAddresses) > 0 && config.database != 0 {
+		return nil, fmt.Errorf("REDIS_DB can't be used with REDIS_CLUSTER_ADDRS")
+	}
+	if len(config.sentinelAddresses) > 0 && config.masterName == "" {
+		return nil, fmt.Errorf("REDIS_SENTINEL_ADDRS requires REDIS_MASTER_NAME")
+	}
+	if len(config.sentinelAddresses) == 0 && config.masterName != "" {
+		return nil, fmt.Errorf("REDIS_MASTER_NAME requires REDIS_SENTINEL_ADDRS")
+	}
+	if config.tlsConfig, err = loadRedisTLSConfig(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// checkRedisSocket catches unix socket paths that can't be right. A missing
+// socket is fine while its directory exists, as Redis may not have started
+// yet.
+func checkRedisSocket(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("invalid REDIS_ADDRESS: unix socket path %s must be absolute, e.g. unix:///var/run/redis/redis.sock", path)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return fmt.Errorf("invalid REDIS_ADDRESS: directory of unix socket %s doesn't exist; check the path and that it is mounted", path)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("invalid REDIS_ADDRESS: %s isn't a unix socket", path)
+	}
+	return nil
+}
+
+// loadRedisTLSConfig reads the REDIS_TLS settings. The server name to verify
+// is taken from each node's address.
+func loadRedisTLSConfig() (*tls.Config, error) {
+	enabled, err := strconv.ParseBool(setting("REDIS_TLS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_TLS: %s", setting("REDIS_TLS"))
+	}
+	if !enabled {
+		for _, name := range []string{"REDIS_TLS_CA_FILE", "REDIS_TLS_CERT_FILE", "REDIS_TLS_KEY_FILE", "REDIS_TLS_INSECURE_SKIP_VERIFY"} {
+			// Set by flag, environment or config file, whatever its default
+			if getenv(name, "") != "" {
+				return nil, fmt.Errorf("%s requires REDIS_TLS=true", name)
+			}
+		}
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := setting("REDIS_TLS_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_TLS_CA_FILE: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid REDIS_TLS_CA_FILE: no PEM certificates in %s", caFile)
+		}
+	}
+	certFile, keyFile := setting("REDIS_TLS_CERT_FILE"), setting("REDIS_TLS_KEY_FILE")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if config.InsecureSkipVerify, err = strconv.ParseBool(setting("REDIS_TLS_INSECURE_SKIP_VERIFY")); err != nil {
+		return nil, fmt.Errorf("invalid REDIS_TLS_INSECURE_SKIP_VERIFY: %s", setting("REDIS_TLS_INSECURE_SKIP_VERIFY"))
+	}
+	return config, nil
+}
+
+// parseRedisAddresses parses the comma-separated host:port list in the
+// environment variable name.
+func parseRedisAddresses(name string) ([]string, error) {
+	var addresses []string
+	for _, address := range strings.Split(setting(name), ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid %s entry %s: %v", name, address, err)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// newClient returns a client for the configured Redis. With Sentinels, it
+// follows the master through failovers; in a cluster, it routes every
+// command to the node owning its key. Every call is limited to
+// REDIS_OP_TIMEOUT and, for requests, to its request's lifetime; with
+// ContextTimeoutEnabled, socket deadlines follow the call's context.
+func (config *redisConfig) newClient() redis.UniversalClient {
+	client := config.newUniversalClient()
+	if config.opTimeout > 0 {
+		client.AddHook(opTimeoutHook{config.opTimeout})
+	}
+	return client
+}
+
+func (config *redisConfig) newUniversalClient() redis.UniversalClient {
+	if len(config.clusterAddresses) > 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:                 config.clusterAddresses,
+			Username:              config.username,
+			Password:              config.password,
+			TLSConfig:             config.tlsConfig,
+			PoolSize:              config.poolSize,
+			MinIdleConns:          config.minIdleConns,
+			DialTimeout:           config.dialTimeout,
+			ReadTimeout:           config.readTimeout,
+			WriteTimeout:          config.writeTimeout,
+			ContextTimeoutEnabled: true,
+		})
+	}
+	if len(config.sentinelAddresses) > 0 {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:            config.masterName,
+			SentinelAddrs:         config.sentinelAddresses,
+			SentinelPassword:      config.sentinelPassword,
+			Username:              config.username,
+			Password:              config.password,
+			DB:                    config.database,
+			TLSConfig:             config.tlsConfig,
+			PoolSize:              config.poolSize,
+			MinIdleConns:          config.minIdleConns,
+			DialTimeout:           config.dialTimeout,
+			ReadTimeout:           config.readTimeout,
+			WriteTimeout:          config.writeTimeout,
+			ContextTimeoutEnabled: true,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Network:               config.network,
+		Addr:                  config.address,
+		Username:              config.username,
+		Password:              config.password,
+		DB:                    config.database,
+		TLSConfig:             config.tlsConfig,
+		PoolSize:              config.poolSize,
+		MinIdleConns:          config.minIdleConns,
+		DialTimeout:           config.dialTimeout,
+		ReadTimeout:           config.readTimeout,
+		WriteTimeout:          config.writeTimeout,
+		ContextTimeoutEnabled: true,
+	})
+}
+
+// opTimeoutHook gives every Redis command and pipeline a deadline, so a hung
+// Redis fails requests per store_failure instead of holding them.
+type opTimeoutHook struct {
+	timeout time.Duration
+}
+
+func (hook opTimeoutHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (hook opTimeoutHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+		defer cancel()
+		return next(ctx, cmd)
+	}
+}
+
+func (hook opTimeoutHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, hook.timeout)
+		defer cancel()
+		return next(ctx, cmds)
+	}
+}
+
+// String describes the configured Redis for logs.
+func (config *redisConfig) String() string {
+	if len(config.clusterAddresses) > 0 {
+		return "cluster " + strings.Join(config.clusterAddresses, ", ")
+	}
+	if len(config.sentinelAddresses) > 0 {
+		return fmt.Sprintf("master %s via Sentinels %s", config.masterName, strings.Join(config.sentinelAddresses, ", "))
+	}
+	if config.network == "unix" {
+		return "unix socket " + config.address
+	}
+	return config.address + " (TCP)"
+}
+
+// resolveMaster asks the Sentinels for the current address of the master,
+// for the startup log. The failover client does the same on its own.
+func (config *redisConfig) resolveMaster() (string, error) {
+	var lastErr error
+	for _, address := range config.sentinelAddresses {
+		sentinel := redis.NewSentinelClient(&redis.Options{Addr: address, Password: config.sentinelPassword, TLSConfig: config.tlsConfig})
+		master, err := sentinel.GetMasterAddrByName(backgroundContext, config.masterName).Result()
+		sentinel.Close()
+		if err == nil && len(master) == 2 {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+		lastErr = err
+	}
+	return "", fmt.Errorf("no Sentinel knows master %s: %v", config.masterName, lastErr)
+}
+
+// checkClusterNodes pings every master of the cluster and returns how many
+// answered and how many there are. Unreachable nodes are logged: their slots
+// fail while the rest of the cluster keeps working.
+func checkClusterNodes(cluster *redis.ClusterClient) (int, int) {
+	var reachable, total atomic.Int64
+	_ = cluster.ForEachMaster(backgroundContext, func(ctx context.Context, node *redis.Client) error {
+		total.Add(1)
+		if err := node.Ping(ctx).Err(); err != nil {
+			warnf("Redis cluster node %s unreachable: %v", node.Options().Addr, err)
+		} else {
+			reachable.Add(1)
+		}
+		return nil
+	})
+	return int(reachable.Load()), int(total.Load())
+}
+
+// connect pings Redis until it answers or REDIS_CONNECT_TIMEOUT passes, so
+// mithrandir can start before Redis, as with docker-compose. Replies and
+// certificate errors won't go away by waiting and fail right away.
+func (config *redisConfig) connect() error {
+	deadline := time.Now().Add(config.connectTimeout)
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := redisClient.Ping(backgroundContext).Err()
+		if err == nil {
+			return nil
+		}
+		var reply redis.Error
+		var certificate *tls.CertificateVerificationError
+		if errors.As(err, &reply) || errors.As(err, &certificate) {
+			return err
+		}
+		wait := min(backoff, time.Until(deadline))
+		if wait <= 0 {
+			return err
+		}
+		warnf("Redis at %s not ready (attempt %d): %v; retrying in %s", config, attempt, err, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
+
+// selfTest writes, reads, expires and deletes a throwaway key, so a Redis
+// user lacking the permissions mithrandir needs is caught at startup rather
+// than on the first knock.
+func (config *redisConfig) selfTest() error {
+	hostname, _ := os.Hostname()
+	key := redisKey("selftest:%s:%d", hostname, os.Getpid())
+	if err := redisClient.Set(backgroundContext, key, "ok", time.Minute).Err(); err != nil {
+		return config.explainPermissionError("SET", err)
+	}
+	value, err := redisClient.Get(backgroundContext, key).Result()
+	if err != nil {
+		return config.explainPermissionError("GET", err)
+	}
+	if value != "ok" {
+		return fmt.Errorf("GET %s returned %q instead of the value written", key, value)
+	}
+	if err := redisClient.Expire(backgroundContext, key, time.Second).Err(); err != nil {
+		return config.explainPermissionError("EXPIRE", err)
+	}
+	if err := redisClient.Del(backgroundContext, key).Err(); err != nil {
+		return config.explainPermissionError("DEL", err)
+	}
+	return nil
+}
+
+func (config *redisConfig) explainPermissionError(command string, err error) error {
+	if strings.HasPrefix(err.Error(), "NOPERM") {
+		user := config.username
+		if user == "" {
+			user = "default"
+		}
+		return fmt.Errorf("%s failed: %v (the ACL of Redis user %s must allow the commands mithrandir uses on keys matching %s*)", command, err, user, redisKeyPrefix)
+	}
+	return fmt.Errorf("%s failed: %v", command, err)
+}
+
+// explainConnectError adds a hint on what to change to an error connecting to
+// Redis, for the common TLS mistakes.
+func (config *redisConfig) explainConnectError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var notTLS tls.RecordHeaderError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return fmt.Sprintf("%v (the server's certificate isn't signed by a trusted CA; set REDIS_TLS_CA_FILE to the CA certificate)", err)
+	case errors.As(err, &hostname):
+		return fmt.Sprintf("%v (connect using a name the certificate is issued for)", err)
+	case errors.As(err, &invalid):
+		return fmt.Sprintf("%v (the server's certificate is expired, not yet valid or not usable for TLS servers)", err)
+	case errors.As(err, &notTLS):
+		return fmt.Sprintf("%v (the server doesn't speak TLS; unset REDIS_TLS or use its TLS port)", err)
+	case config.network == "unix" && errors.Is(err, syscall.ENOENT):
+		return fmt.Sprintf("%v (no socket at that path; check that Redis' unixsocket setting matches and the socket is shared with this container)", err)
+	case config.network == "unix" && errors.Is(err, syscall.EACCES):
+		return fmt.Sprintf("%v (check unixsocketperm in Redis and the user mithrandir runs as)", err)
+	case errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET):
+		// What a server hangs up with when only one side speaks TLS
+		if config.tlsConfig != nil {
+			return fmt.Sprintf("%v (if the server doesn't speak TLS, unset REDIS_TLS or use its TLS port)", err)
+		}
+		return fmt.Sprintf("%v (if the server requires TLS, set REDIS_TLS=true)", err)
+	}
+	return err.Error()
+}
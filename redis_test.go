@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisKeyPrefix(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		previousPrefix, previousCluster := redisKeyPrefix, redisCluster
+		redisKeyPrefix, redisCluster = "staging:", cluster
+		app := &AppConfig{Hostname: "app.example.com", SessionIPv4Prefix: 32, SessionIPv6Prefix: 128}
+		grouped := &AppConfig{Hostname: "other.example.com", SessionGroup: "family", SessionIPv4Prefix: 32}
+		keys := map[string]string{
+			"appKey":             appKey(app, "custom"),
+			"failedAttemptsKey":  failedAttemptsKey(app, "192.0.2.1"),
+			"banKey":             banKey(app, "192.0.2.1"),
+			"knockLimitKey":      knockLimitKey(app, "grant", time.Now()),
+			"oneTimeTokenKey":    oneTimeTokenKey(app, "token"),
+			"emailNonceKey":      emailNonceKey(app, "nonce"),
+			"emailResendKey":     emailResendKey(app, "user@example.com"),
+			"ipSessionKey":       ipSessionKey(app, "192.0.2.1"),
+			"sessionIDKey":       sessionIDKey(app, "id"),
+			"sessionSetKey":      sessionSetKey(app),
+			"sessionAgeKey":      sessionAgeKey(ipSessionKey(app, "192.0.2.1")),
+			"group ipSessionKey": ipSessionKey(grouped, "192.0.2.1"),
+			"redisKey":           redisKey("%s", "config:apps"),
+		}
+		for builder, key := range keys {
+			if !strings.HasPrefix(key, "staging:") {
+				t.Errorf("%s (cluster %t) = %q, without the prefix", builder, cluster, key)
+			}
+		}
+		redisKeyPrefix, redisCluster = previousPrefix, previousCluster
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	// CONFIG_SOURCE: "env" for CONFIG_FILE, APPS_CONFIG or the numbered
+	// environment variables, "redis" for the JSON in configRedisKey
+	configSource   string
+	configRedisKey string
+	// Of the config read from Redis by the load in progress; it becomes
+	// configVersion once the apps turn out valid
+	loadingConfigVersion string
+)
+
+// fetchRedisConfig reads the apps, a JSON array like APPS_CONFIG, from the
+// Redis key CONFIG_REDIS_KEY.
+func fetchRedisConfig() (string, error) {
+	data, err := redisClient.Get(backgroundContext, configRedisKey).Result()
+	if err == redis.Nil {
+		return "", fmt.Errorf("CONFIG_REDIS_KEY %s not found in Redis", configRedisKey)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read CONFIG_REDIS_KEY %s: %v", configRedisKey, err)
+	}
+	loadingConfigVersion = redisConfigVersion(data)
+	return data, nil
+}
+
+// redisConfigVersion identifies a config read from Redis: the start of its
+// SHA-256, so replicas running the same config report the same version
+// whoever wrote it.
+func redisConfigVersion(data string) string {
+	checksum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(checksum[:8])
+}
+
+// watchRedisConfig reloads the apps whenever the config in Redis changes.
+// Writers publish anything to the channel named after the key once they have
+// set it, and replicas also check the key every pollInterval, if not 0, as
+// Pub/Sub drops the messages sent while they are disconnected. Reloads only
+// happen when the content differs from what was last seen, so a broken config
+// is reported once and the apps before it keep serving.
+func watchRedisConfig(storeBackend string, pollInterval time.Duration) {
+	messages := redisClient.Subscribe(backgroundContext, configRedisKey).Channel()
+	var poll <-chan time.Time
+	if pollInterval > 0 {
+		poll = time.NewTicker(pollInterval).C
+	}
+	last := configState().Version
+	for {
+		select {
+		case <-messages:
+		case <-poll:
+		}
+		data, err := redisClient.Get(backgroundContext, configRedisKey).Result()
+		if err != nil && err != redis.Nil {
+			debugf("Reading %s: %v", configRedisKey, err)
+			continue
+		}
+		// A deleted key is a change too, whose reload reports it
+		version := redisConfigVersion(data)
+		if err == redis.Nil {
+			version = ""
+		}
+		if version == last {
+			continue
+		}
+		last = version
+		infof("%s changed in Redis, reloading the app configuration", configRedisKey)
+		reloadApps(storeBackend)
+	}
+}
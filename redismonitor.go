@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returned for Redis commands while the health monitor finds Redis unreachable
+var errRedisDown = errors.New("Redis unreachable")
+
+// redisMonitor pings Redis every interval in the background and tracks
+// whether it answers, logging once when it stops and once when it recovers.
+// While it is down, Redis commands fail right away, so requests go to their
+// app's store_failure without each waiting for a timeout. It is installed as
+// a go-redis hook, so it covers every command.
+type redisMonitor struct {
+	interval time.Duration
+	healthy  atomic.Bool
+	mu       sync.Mutex
+	// Of the last ping
+	latency time.Duration
+	lastErr error
+	// Zero while healthy
+	downSince time.Time
+}
+
+// Set with STORE=redis
+var redisHealthMonitor *redisMonitor
+
+// newRedisMonitor returns a monitor of a Redis that just answered, and starts
+// pinging it.
+func newRedisMonitor(interval time.Duration) *redisMonitor {
+	monitor := &redisMonitor{interval: interval}
+	monitor.healthy.Store(true)
+	go monitor.run()
+	return monitor
+}
+
+func (m *redisMonitor) run() {
+	// Also let through by the circuit breaker, which would otherwise hide
+	// Redis coming back
+	probeContext := context.WithValue(backgroundContext, redisProbeKey{}, true)
+	for range time.Tick(m.interval) {
+		started := time.Now()
+		err := redisClient.Ping(probeContext).Err()
+		m.record(started, err)
+	}
+}
+
+// record updates the state with a ping started at started, logging the
+// transitions.
+func (m *redisMonitor) record(started time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastErr = err
+	if err != nil {
+		if m.downSince.IsZero() {
+			m.downSince = started
+			m.healthy.Store(false)
+			errorf("Redis unreachable: %v; failing Redis calls until a ping every %s gets through", err, m.interval)
+		}
+		return
+	}
+	m.latency = time.Since(started)
+	if !m.downSince.IsZero() {
+		infof("Redis reachable again after %s (down since %s)", time.Since(m.downSince).Round(time.Second), m.downSince.Format(time.RFC3339))
+		m.downSince = time.Time{}
+		m.healthy.Store(true)
+	}
+}
+
+// isHealthy reports whether Redis answered the last ping. A nil monitor is
+// always healthy.
+func (m *redisMonitor) isHealthy() bool {
+	return m == nil || m.healthy.Load()
+}
+
+// allow reports whether a command may be sent to Redis.
+func (m *redisMonitor) allow(ctx context.Context) bool {
+	return ctx.Value(redisProbeKey{}) != nil || m.isHealthy()
+}
+
+func (m *redisMonitor) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (m *redisMonitor) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !m.allow(ctx) {
+			cmd.SetErr(errRedisDown)
+			return errRedisDown
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (m *redisMonitor) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !m.allow(ctx) {
+			for _, cmd := range cmds {
+				cmd.SetErr(errRedisDown)
+			}
+			return errRedisDown
+		}
+		return next(ctx, cmds)
+	}
+}
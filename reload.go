@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/fsnotify/fsnotify"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long the config file must be left alone before a change is reloaded,
+// as editors and configmap updates write it in several steps
+const configWatchDebounce = 500 * time.Millisecond
+
+var (
+	// One reload at a time
+	reloadMu sync.Mutex
+	// When the running apps were loaded, and why the last reload failed, if
+	// it did; for the health check
+	configLoadedAt time.Time
+	configError    string
+	// Of the running apps' config, with CONFIG_SOURCE=redis
+	configVersion string
+)
+
+// recordConfigLoad notes how loading the apps went.
+func recordConfigLoad(err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	recordConfigLoadLocked(err)
+}
+
+func recordConfigLoadLocked(err error) {
+	if err != nil {
+		configError = err.Error()
+		return
+	}
+	configLoadedAt, configError, configVersion = time.Now(), "", loadingConfigVersion
+}
+
+// configState returns when the running apps were loaded, their config's
+// version and the error of the last reload, if it failed.
+func configState() configHealth {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	return configHealth{LoadedAt: configLoadedAt, Version: configVersion, Error: configError}
+}
+
+// watchReloadSignal reloads the app configuration on every SIGHUP.
+func watchReloadSignal(storeBackend string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		infof("SIGHUP received, reloading the app configuration")
+		reloadApps(storeBackend)
+	}
+}
+
+// reloadApps loads the app configuration again, re-reading the secret files,
+// CONFIG_FILE or the config in Redis, and swaps it in; requests already being served finish with the apps they
+// started with. An invalid configuration is logged and the current one keeps
+// serving. Apps whose settings didn't change are kept as they are, and
+// changed ones keep their metrics; sessions are keyed by hostname or session
+// group, so they carry over. Global settings only change on restart.
+func reloadApps(storeBackend string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := loadSecretFiles(); err != nil {
+		errorf("Reload failed, keeping the current apps: invalid secret file: %v", err)
+		recordConfigLoadLocked(err)
+		return err
+	}
+	file := appsFile
+	if appsFile != nil {
+		var err error
+		if file, err = loadConfigFile(appsFile.path); err != nil {
+			errorf("Reload failed, keeping the current apps: %v", err)
+			recordConfigLoadLocked(err)
+			return err
+		}
+		if !maps.Equal(file.settings, appsFile.settings) {
+			warnf("Global settings in %s changed; they only apply after a restart", file.path)
+		}
+	}
+	next, err := loadApps(storeBackend, file)
+	if err != nil {
+		errorf("Reload failed, keeping the current apps: invalid app config: %v", err)
+		recordConfigLoadLocked(err)
+		return err
+	}
+	recordConfigLoadLocked(nil)
+
+	previous := currentApps()
+	var added, changed, removed []string
+	for _, hostname := range sortedHostnames(next) {
+		app := next[hostname]
+		// Not another app's alias before
+		old, found := previous[hostname]
+		switch {
+		case !found || old.Hostname != hostname:
+			added = append(added, hostname)
+		case old != app:
+			changed = append(changed, hostname)
+			app.metrics = old.metrics
+		}
+	}
+	for _, hostname := range sortedHostnames(previous) {
+		if app, found := next[hostname]; !found || app.Hostname != hostname {
+			removed = append(removed, hostname)
+		}
+	}
+	loadedApps.Store(&next)
+	releaseUpstreamTransports(previous, next)
+
+	if len(added)+len(changed)+len(removed) == 0 {
+		infof("Reloaded the app configuration: no changes")
+		return nil
+	}
+	infof("Reloaded the app configuration: %d added, %d changed, %d removed", len(added), len(changed), len(removed))
+	for _, hostname := range added {
+		infof("  + %s -> %s", hostname, redactedAppValue("upstream_url", next[hostname].UpstreamURL.String()))
+	}
+	for _, hostname := range changed {
+		// Only the names, values may be secrets
+		infof("  ~ %s (%s)", hostname, strings.Join(changedSettings(previous[hostname].config, next[hostname].config), ", "))
+	}
+	for _, hostname := range removed {
+		infof("  - %s", hostname)
+	}
+
+	for _, hostname := range append(added, changed...) {
+		startApp(next[hostname])
+	}
+	revokeStalePreauthorizations(previous, next)
+	return nil
+}
+
+// watchConfigFile reloads the apps whenever the config file at path
+// changes. It watches the file's directory rather than the file: editors and
+// Kubernetes configmap mounts replace the file by renaming another one over
+// it, which would end a watch on the file itself. Events of other files are
+// told apart by the file's content.
+func watchConfigFile(path, storeBackend string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		last := configChecksum(path)
+		var settled <-chan time.Time
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				settled = time.After(configWatchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				errorf("Watching %s: %v", path, err)
+			case <-settled:
+				settled = nil
+				checksum := configChecksum(path)
+				// Missing while being replaced, or unchanged
+				if checksum == nil || bytes.Equal(checksum, last) {
+					continue
+				}
+				last = checksum
+				infof("%s changed, reloading the app configuration", path)
+				reloadApps(storeBackend)
+			}
+		}
+	}()
+	return nil
+}
+
+// configChecksum returns the SHA-256 of the file at path, or nil if it can't
+// be read.
+func configChecksum(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		debugf("Reading %s: %v", path, err)
+		return nil
+	}
+	checksum := sha256.Sum256(data)
+	return checksum[:]
+}
+
+// startApp starts what a newly configured app needs beyond its config, at
+// reloads like at startup.
+func startApp(app *AppConfig) {
+	if app.RotationSeed != nil {
+		app.infof("Current secret path: %s (rotates every %s)", currentRotatedPath(app), app.RotationInterval)
+		go logRotations(app)
+	}
+	if len(app.PreauthorizedIPs) > 0 {
+		if err := preauthorizeSessions(app); err != nil {
+			app.errorf("Failed to store preauthorized sessions: %v", err)
+		}
+	}
+}
+
+// sweepApps periodically sweeps the in-memory state of the running apps:
+// their rate limiters, renew throttles and store_failure grace. It's one loop
+// over whichever apps are loaded, so the state of apps replaced by a reload
+// goes with them.
+func sweepApps() {
+	for now := range time.Tick(time.Minute) {
+		apps := currentApps()
+		for _, hostname := range sortedHostnames(apps) {
+			app := apps[hostname]
+			app.RateLimiter.sweep(now)
+			app.EmailRateLimiter.sweep(now)
+			app.renewals.sweep(now)
+			app.graceSessions.sweep(now)
+		}
+	}
+}
+
+// revokeStalePreauthorizations revokes the sessions without expiry of IPs no
+// longer preauthorized, which would never end otherwise. Apps of a session
+// group share them, so they are only revoked once no app of the group has
+// the IP preauthorized.
+func revokeStalePreauthorizations(previous, next map[string]*AppConfig) {
+	kept := make(map[string]bool)
+	for _, app := range next {
+		for ip := range app.PreauthorizedIPs {
+			kept[ipSessionKey(app, ip)] = true
+		}
+	}
+	revoked := make(map[string]bool)
+	for _, hostname := range sortedHostnames(previous) {
+		app := previous[hostname]
+		for ip := range app.PreauthorizedIPs {
+			key := ipSessionKey(app, ip)
+			if kept[key] || revoked[key] {
+				continue
+			}
+			revoked[key] = true
+			if err := endSession(backgroundContext, app, []string{key}); err != nil {
+				app.errorf("Redis error: %v", err)
+				continue
+			}
+			app.infof("Session of %s revoked (no longer preauthorized)", ip)
+		}
+	}
+}
+
+// changedSettings returns the names of the settings that differ between two
+// app configs, sorted.
+func changedSettings(before, after map[string]string) []string {
+	var names []string
+	for name, value := range after {
+		if before[name] != value {
+			names = append(names, name)
+		}
+	}
+	for name := range before {
+		if _, found := after[name]; !found && before[name] != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReloadStartsNoGoroutines(t *testing.T) {
+	useSessionStore(t, newMemoryStore())
+	captureLogs(t)
+	previous := loadedApps.Load()
+	t.Cleanup(func() { loadedApps.Store(previous) })
+	for name, value := range map[string]string{
+		"APP_1_HOSTNAME":            "app.example.com",
+		"APP_1_UPSTREAM_URL":        "http://127.0.0.1:8080",
+		"APP_1_SECRET_PATH":         "/knock",
+		"APP_1_SESSION_TTL":         "1h",
+		"APP_1_AUTO_RENEW":          "true",
+		"APP_1_STORE_FAILURE":       "grace",
+		"APP_1_STORE_FAILURE_GRACE": "5m",
+	} {
+		t.Setenv(name, value)
+	}
+	// Every reload changes the app, which is parsed again
+	reload := func(i int) {
+		t.Setenv("APP_1_RATE_LIMIT", strconv.Itoa(10+i))
+		if err := reloadApps("memory"); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	}
+
+	reload(0)
+	before := runtime.NumGoroutine()
+	for i := range 20 {
+		reload(i + 1)
+	}
+	app := currentApps()["app.example.com"]
+	if app.RateLimiter == nil || app.renewals == nil || app.graceSessions == nil {
+		t.Fatalf("app without rate limiter, renew throttle or grace: %+v", app)
+	}
+	// Goroutines of earlier tests may still be finishing
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("20 reloads left %d goroutines running, %d before", after, before)
+	}
+}
+
+func TestReloadRereadsSecretFiles(t *testing.T) {
+	useSessionStore(t, newMemoryStore())
+	captureLogs(t)
+	previous := loadedApps.Load()
+	t.Cleanup(func() { loadedApps.Store(previous) })
+	path := filepath.Join(t.TempDir(), "secret_path")
+	rotate := func(secretPath string) {
+		if err := os.WriteFile(path, []byte(secretPath+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, value := range map[string]string{
+		"APP_1_HOSTNAME":         "app.example.com",
+		"APP_1_UPSTREAM_URL":     "http://127.0.0.1:8080",
+		"APP_1_SECRET_PATH_FILE": path,
+		"APP_1_SESSION_TTL":      "1h",
+	} {
+		t.Setenv(name, value)
+	}
+	os.Unsetenv("APP_1_SECRET_PATH")
+	t.Cleanup(func() { os.Unsetenv("APP_1_SECRET_PATH") })
+
+	for _, secretPath := range []string{"/old-knock", "/new-knock"} {
+		rotate(secretPath)
+		if err := reloadApps("memory"); err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+		if prefixes := currentApps()["app.example.com"].SecretPathPrefixes; !slices.Equal(prefixes, []string{secretPath}) {
+			t.Errorf("secret paths after reload = %v, want [%s]", prefixes, secretPath)
+		}
+	}
+
+	// A secret file gone keeps the current apps
+	os.Remove(path)
+	if err := reloadApps("memory"); err == nil {
+		t.Errorf("reload without the secret file succeeded")
+	}
+	if prefixes := currentApps()["app.example.com"].SecretPathPrefixes; !slices.Equal(prefixes, []string{"/new-knock"}) {
+		t.Errorf("secret paths after a failed reload = %v, want [/new-knock]", prefixes)
+	}
+}
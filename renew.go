@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// renewThrottle remembers when each session was last renewed by this replica,
+// so auto-renew only calls EXPIRE once a fraction of the TTL has passed
+// instead of on every request. Requests in between are counted and added to
+// the session's request_count with the next renewal.
+type renewThrottle struct {
+	interval time.Duration
+	ttl      time.Duration
+	mu       sync.Mutex
+	sessions map[string]*renewState
+}
+
+type renewState struct {
+	renewed  time.Time
+	requests int64
+}
+
+func newRenewThrottle(interval, ttl time.Duration) *renewThrottle {
+	return &renewThrottle{interval: interval, ttl: ttl, sessions: make(map[string]*renewState)}
+}
+
+// due counts a request of the session under key and reports whether it should
+// be renewed now, along with the number of requests since the last renewal.
+// Sessions this replica hasn't seen yet are always renewed.
+func (t *renewThrottle) due(key string, now time.Time) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, exists := t.sessions[key]
+	if !exists {
+		t.sessions[key] = &renewState{renewed: now}
+		return 1, true
+	}
+	state.requests++
+	if now.Sub(state.renewed) < t.interval {
+		return 0, false
+	}
+	requests := state.requests
+	state.renewed, state.requests = now, 0
+	return requests, true
+}
+
+// sweep drops sessions that weren't renewed for longer than the session TTL,
+// since they have expired in Redis by then. See sweepApps.
+func (t *renewThrottle) sweep(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, state := range t.sessions {
+		if now.Sub(state.renewed) > t.ttl {
+			delete(t.sessions, key)
+		}
+	}
+}
+
+// forget drops what this replica knows about the session under key, so its
+// next request renews it.
+func (t *renewThrottle) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, key)
+}
+
+const (
+	renewQueueSize     = 4096
+	renewFlushInterval = 250 * time.Millisecond
+)
+
+// renewal is a queued renewal of one session's keys, with the number of
+// requests it covers and the client and path of the latest one.
+type renewal struct {
+	app      *AppConfig
+	keys     []string
+	ip       string
+	path     string
+	requests int64
+}
+
+// Renewals wait here for runRenewals, so requests never wait for Redis to
+// renew their session
+var renewQueue = make(chan renewal, renewQueueSize)
+
+// runRenewals collects queued renewals and sends them to the session store in
+// a single batch, for Redis a single pipeline, every renewFlushInterval. Renewals of the same session queued in
+// between are merged.
+func runRenewals() {
+	pending := make(map[string]*renewal)
+	ticker := time.NewTicker(renewFlushInterval)
+	for {
+		select {
+		case next := <-renewQueue:
+			id := next.app.Hostname + " " + next.keys[0]
+			if queued, exists := pending[id]; exists {
+				queued.requests += next.requests
+				queued.ip, queued.path = next.ip, next.path
+			} else {
+				pending[id] = &next
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				flushRenewals(pending)
+				pending = make(map[string]*renewal)
+			}
+		}
+	}
+}
+
+func flushRenewals(pending map[string]*renewal) {
+	renewals := make([]*renewal, 0, len(pending))
+	for _, queued := range pending {
+		renewals = append(renewals, queued)
+		queued.app.metrics.renewals.Add(1)
+		publishEvent(queued.app, eventRenewal, queued.ip, queued.path)
+	}
+	if err := sessionStore.Renew(backgroundContext, renewals); err != nil {
+		errorf("Redis error renewing %d sessions: %v", len(pending), err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Length of the hex path segment derived for each rotation period
+const rotatedSegmentLength = 16
+
+// rotationPeriod returns the number of the rotation period now falls in.
+func rotationPeriod(app *AppConfig, now time.Time) int64 {
+	return now.Unix() / int64(app.RotationInterval.Seconds())
+}
+
+// rotatedSegment derives the secret path segment for a rotation period from
+// the app's seed, so every instance and restart agrees on it without storing
+// any state.
+func rotatedSegment(app *AppConfig, period int64) string {
+	mac := hmac.New(sha256.New, app.RotationSeed)
+	fmt.Fprintf(mac, "%s\n%d", app.Hostname, period)
+	return hex.EncodeToString(mac.Sum(nil))[:rotatedSegmentLength]
+}
+
+// validRotatedSegments returns the segments accepted right now: the current
+// one, plus the previous one during the overlap after a rotation.
+func validRotatedSegments(app *AppConfig, now time.Time) []string {
+	period := rotationPeriod(app, now)
+	segments := []string{rotatedSegment(app, period)}
+	rotatedAt := time.Unix(period*int64(app.RotationInterval.Seconds()), 0)
+	if now.Sub(rotatedAt) < app.RotationOverlap {
+		segments = append(segments, rotatedSegment(app, period-1))
+	}
+	return segments
+}
+
+// matchRotatedPath checks whether path starts with one of the app's secret
+// path prefixes followed by a currently valid rotated segment, returning the
+// full knock path that should be stripped before proxying.
+func matchRotatedPath(app *AppConfig, path string) (string, bool) {
+	segments := validRotatedSegments(app, time.Now())
+	for _, prefix := range app.SecretPathPrefixes {
+		base := strings.TrimSuffix(prefix, "/") + "/"
+		rest, found := strings.CutPrefix(path, base)
+		if !found {
+			continue
+		}
+		segment, remainder, _ := strings.Cut(rest, "/")
+		if len(segment) != rotatedSegmentLength || app.SecretPathExact && remainder != "" {
+			continue
+		}
+		valid := false
+		for _, candidate := range segments {
+			// Check every candidate so timing doesn't reveal which one matched
+			if secretEqual(segment, candidate) {
+				valid = true
+			}
+		}
+		if valid {
+			return base + segment, true
+		}
+	}
+	return "", false
+}
+
+// currentRotatedPath returns the knock path of the current rotation period.
+func currentRotatedPath(app *AppConfig) string {
+	return strings.TrimSuffix(app.SecretPathPrefixes[0], "/") + "/" + rotatedSegment(app, rotationPeriod(app, time.Now()))
+}
+
+// logRotations announces each new secret path at INFO when its period starts.
+func logRotations(app *AppConfig) {
+	for {
+		next := time.Unix((rotationPeriod(app, time.Now())+1)*int64(app.RotationInterval.Seconds()), 0)
+		time.Sleep(time.Until(next))
+		// Replaced or removed by a reload
+		if currentApps()[app.Hostname] != app {
+			return
+		}
+		app.infof("Secret path rotated to %s (previous path accepted for %s)", currentRotatedPath(app), app.RotationOverlap)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The apps' variables, numbered or defaults, like APP_1_KNOCK_PASSPHRASE
+var appVariablePattern = regexp.MustCompile(`^APP_(\d+|DEFAULT)_([A-Z0-9_]+)$`)
+
+// The variables set by loadSecretFiles, read again from their files on reload
+var secretFileVariables = map[string]bool{}
+
+// loadSecretFiles sets each variable named by a <NAME>_FILE variable from
+// the file it points to, without its trailing newline, the way Docker and
+// Kubernetes mount secrets, e.g. REDIS_PASSWORD from REDIS_PASSWORD_FILE, so
+// secrets needn't show in docker inspect. A variable set directly wins. It
+// applies to the global settings, APPS_CONFIG and the apps' variables, though
+// not to those ending in _FILE themselves, like STORE_FILE. It runs at
+// startup and on each reload, so rotated secrets apply without a restart.
+func loadSecretFiles() error {
+	for _, variable := range os.Environ() {
+		name, path, _ := strings.Cut(variable, "=")
+		setting, found := strings.CutSuffix(name, "_FILE")
+		if !found || path == "" || isSettingVariable(name) || !isSettingVariable(setting) ||
+			(os.Getenv(setting) != "" && !secretFileVariables[setting]) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if err := os.Setenv(setting, strings.TrimRight(string(data), "\r\n")); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		secretFileVariables[setting] = true
+	}
+	return nil
+}
+
+// isSettingVariable reports whether name is the environment variable of a
+// setting.
+func isSettingVariable(name string) bool {
+	if isGlobalSetting(name) {
+		return true
+	}
+	match := appVariablePattern.FindStringSubmatch(name)
+	return match != nil && slices.Contains(appSettings, strings.ToLower(match[2]))
+}
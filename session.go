@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session modes: sessions are bound to the client IP, to a random ID kept in
+// a cookie, which works behind CGNAT and for clients whose IP changes, or to
+// both at once
+const (
+	sessionModeIP     = "ip"
+	sessionModeCookie = "cookie"
+	sessionModeBoth   = "both"
+)
+
+// The __Host- prefix makes browsers reject the cookie unless it's Secure,
+// host-only and scoped to /, so no other subdomain can set or read it
+const sessionCookieName = "__Host-mithrandir_session"
+
+// Number of session index members checked for expiry after every grant
+const sessionIndexSample = 10
+
+// Version of the session record format, stored in each session hash's v
+// field. Version 1 sessions are plain strings, written before sessions had
+// metadata; checkSession still honors them and rewrites older records in
+// place.
+const sessionVersion = 2
+
+// Request header telling the upstream when the session expires, as a Unix
+// timestamp, for apps with expose_session_ttl
+const sessionExpiresHeader = "X-Mithrandir-Session-Expires"
+
+// Version numbers are left out of User-Agent hashes, so browsers updating
+// themselves mid-session keep their session
+var userAgentVersions = regexp.MustCompile(`\d+([._]\d+)*`)
+
+// sessionFactor is one Redis key a session consists of, named after what it
+// binds the session to ("cookie" or "ip"). The key is empty when the request
+// doesn't carry the factor at all, like a missing cookie.
+type sessionFactor struct {
+	name string
+	key  string
+}
+
+// sessionFactors returns the factors that make up the request's session in
+// the app's session mode.
+func sessionFactors(app *AppConfig, request *http.Request, ip string) []sessionFactor {
+	var factors []sessionFactor
+	if app.SessionMode != sessionModeIP {
+		key := ""
+		if sessionID := sessionCookie(request); sessionID != "" {
+			key = sessionIDKey(app, sessionID)
+		}
+		factors = append(factors, sessionFactor{name: "cookie", key: key})
+	}
+	if app.SessionMode != sessionModeCookie {
+		factors = append(factors, sessionFactor{name: "ip", key: ipSessionKey(app, ip)})
+	}
+	return factors
+}
+
+// checkSession looks up the request's session in a single round trip to the
+// session store. It returns the keys that exist, for renewal, and the names of
+// the factors that are missing; the request has a session when none are. On
+// store errors all factors count as missing. Sessions older than the app's
+// max_session_age count as missing too, and are deleted; sessions bound to a
+// different User-Agent are kept, but count as missing for this request. With
+// expose_session_ttl, the session's TTL is passed on in sessionExpiresHeader.
+func checkSession(app *AppConfig, request *http.Request, ip string) ([]string, []string, error) {
+	factors := sessionFactors(app, request, ip)
+	sessions := make(map[string]storedSession, len(factors))
+	var lookups []string
+	for _, factor := range factors {
+		if factor.key == "" {
+			continue
+		}
+		// Sessions in use are looked up once per SESSION_CACHE_TTL, see sessionCache
+		if session, found := cachedSessions.get(factor.key); found {
+			app.metrics.sessionCacheHits.Add(1)
+			sessions[factor.key] = session
+			continue
+		}
+		if cachedSessions != nil {
+			app.metrics.sessionCacheMisses.Add(1)
+		}
+		// Recently missing keys are still missing, see denialCache
+		if _, found := denials.get(factor.key); found {
+			app.metrics.denialCacheHits.Add(1)
+			continue
+		}
+		if denials != nil {
+			app.metrics.denialCacheMisses.Add(1)
+		}
+		lookups = append(lookups, factor.key)
+	}
+	if len(lookups) > 0 {
+		found, err := sessionStore.Exists(request.Context(), app, lookups)
+		if err != nil {
+			var missing []string
+			for _, factor := range factors {
+				missing = append(missing, factor.name)
+			}
+			return nil, missing, err
+		}
+		for _, session := range found {
+			if session.exists {
+				cachedSessions.put(session)
+			} else {
+				denials.put(session.key, false)
+			}
+			sessions[session.key] = session
+		}
+	}
+
+	// Preauthorized sessions ignore max_session_age
+	preauthorized := app.PreauthorizedIPs[sessionIP(app, ip)]
+	var keys, missing, aged []string
+	var ttl time.Duration
+	for _, factor := range factors {
+		session := sessions[factor.key]
+		switch {
+		case !session.exists:
+			missing = append(missing, factor.name)
+		case session.aged && !preauthorized:
+			// Still renewed, but granted longer than max_session_age ago
+			missing = append(missing, factor.name)
+			aged = append(aged, factor.key)
+		case app.BindUserAgent && session.metadata["user_agent_hash"] != "" && session.metadata["user_agent_hash"] != userAgentHash(request.Header.Get("User-Agent")):
+			// Sessions granted before bind_user_agent was enabled have no hash
+			app.infof("Session of %s used with a different User-Agent: %s", ip, request.Header.Get("User-Agent"))
+			missing = append(missing, factor.name)
+		default:
+			keys = append(keys, factor.key)
+			// In session_mode both, the session ends with its first factor
+			if session.ttl > 0 && (ttl == 0 || session.ttl < ttl) {
+				ttl = session.ttl
+			}
+		}
+	}
+	if len(missing) == 0 {
+		app.graceSessions.remember(keys...)
+	}
+	// Sessions without expiry, like preauthorized ones, get no header
+	if app.ExposeSessionTTL && len(missing) == 0 && ttl > 0 {
+		setSessionExpires(request, time.Now().Add(ttl))
+	}
+	if len(aged) > 0 {
+		app.infof("Session of %s expired (max age %s)", ip, app.MaxSessionAge)
+		if err := endSession(request.Context(), app, aged); err != nil {
+			app.errorf("Redis error: %v", err)
+		}
+		publishEvent(app, eventExpire, ip, request.URL.Path)
+	}
+	return keys, missing, nil
+}
+
+// grantSession stores a new session under every key of the app's session
+// mode, as a hash recording when, how and by whom it was granted. In cookie
+// modes it generates a new session ID and sets the session cookie.
+func grantSession(app *AppConfig, responseWriter http.ResponseWriter, request *http.Request, ip, via string, ttl time.Duration) error {
+	var keys []string
+	if app.SessionMode != sessionModeIP {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		sessionID := hex.EncodeToString(random)
+		keys = append(keys, sessionIDKey(app, sessionID))
+		// No expiry: the session ends when its Redis key expires
+		http.SetCookie(responseWriter, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    sessionID,
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if app.SessionMode != sessionModeCookie {
+		keys = append(keys, ipSessionKey(app, ip))
+	}
+
+	now := time.Now().Unix()
+	metadata := sessionMetadata(now, via, ip, request.Header.Get("User-Agent"))
+	if app.BindUserAgent {
+		metadata["user_agent_hash"] = userAgentHash(request.Header.Get("User-Agent"))
+	}
+	err := sessionStore.Grant(request.Context(), app, keys, metadata, ttl)
+	// The client's next request must not be denied from the cache, nor find
+	// a session this one replaced
+	denials.forget(keys...)
+	cachedSessions.forget(keys...)
+	// Even if storing failed, so store_failure grace honors the session
+	app.graceSessions.remember(keys...)
+	return err
+}
+
+func sessionMetadata(now int64, via, ip, userAgent string) map[string]any {
+	return map[string]any{
+		"v":             sessionVersion,
+		"granted_at":    now,
+		"last_seen":     now,
+		"granted_via":   via,
+		"ip":            ip,
+		"user_agent":    userAgent,
+		"request_count": 1,
+	}
+}
+
+// userAgentHash identifies a User-Agent for bind_user_agent, ignoring its
+// version numbers.
+func userAgentHash(userAgent string) string {
+	sum := sha256.Sum256([]byte(userAgentVersions.ReplaceAllString(userAgent, "")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// preauthorizeSessions stores sessions without expiry for the app's
+// preauthorized IPs, replacing any existing sessions of these IPs. They are
+// never renewed and ignore max_session_age, but can be revoked like any
+// other session.
+func preauthorizeSessions(app *AppConfig) error {
+	metadata := sessionMetadata(time.Now().Unix(), "preauthorized_ips", "", "")
+	metadata["request_count"] = 0
+	for ip := range app.PreauthorizedIPs {
+		metadata["ip"] = ip
+		// Another replica starting at the same time already stored it
+		err := sessionStore.Grant(backgroundContext, app, []string{ipSessionKey(app, ip)}, metadata, 0)
+		if err != nil && !errors.Is(err, errConcurrentGrant) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionLimitReached reports whether the app already has MaxSessions live
+// sessions.
+func sessionLimitReached(ctx context.Context, app *AppConfig) (bool, error) {
+	count, err := sessionStore.Count(ctx, app)
+	return count >= app.MaxSessions, err
+}
+
+// renewSession queues the renewal of an existing session's keys, unless the
+// session was renewed too recently, and reports whether it did. The renewal
+// itself happens in the background, see runRenewals.
+func renewSession(app *AppConfig, keys []string, ip, path string) bool {
+	requests := int64(1)
+	if app.renewals != nil {
+		var due bool
+		if requests, due = app.renewals.due(keys[0], time.Now()); !due {
+			return false
+		}
+	}
+	select {
+	case renewQueue <- renewal{app: app, keys: keys, ip: ip, path: path, requests: requests}:
+		return true
+	default:
+		// The next request retries, long before the session expires
+		app.metrics.droppedRenewals.Add(1)
+		if app.renewals != nil {
+			app.renewals.forget(keys[0])
+		}
+		app.debugf("Renewal queue full, skipped renewing %s", keys[0])
+		return false
+	}
+}
+
+// endSession deletes a session's keys, so the client has to knock again.
+func endSession(ctx context.Context, app *AppConfig, keys []string) error {
+	cachedSessions.forget(keys...)
+	return sessionStore.Revoke(ctx, app, keys)
+}
+
+// endSessions ends the app's sessions granted to ip, or all of its sessions
+// when ip is empty, and returns how many there were. Sessions are found
+// through the session index, plus the IP's own key for sessions granted
+// before it existed.
+func endSessions(ctx context.Context, app *AppConfig, ip string) (int, error) {
+	var keys []string
+	seen := make(map[string]bool)
+	revoked := 0
+	var cursor uint64
+	for {
+		page, next, err := sessionStore.List(ctx, app, cursor, 1000)
+		if err != nil {
+			return 0, err
+		}
+		for _, session := range page {
+			// Cookie sessions only know their IP from the metadata
+			owner, isIPKey := strings.CutPrefix(session.key, ipSessionKey(app, ""))
+			if !isIPKey {
+				owner = session.metadata["ip"]
+			}
+			if ip != "" && owner != ip {
+				continue
+			}
+			keys = append(keys, session.key)
+			seen[session.key] = true
+			// In both mode the IP key belongs to the same session
+			if !isIPKey && app.SessionMode == sessionModeBoth && owner != "" {
+				keys = append(keys, ipSessionKey(app, owner))
+				seen[ipSessionKey(app, owner)] = true
+			}
+			revoked++
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if ip != "" && !seen[ipSessionKey(app, ip)] {
+		found, err := sessionStore.Exists(ctx, app, []string{ipSessionKey(app, ip)})
+		if err != nil {
+			return 0, err
+		}
+		if found[0].exists {
+			keys = append(keys, found[0].key)
+			revoked++
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return revoked, endSession(ctx, app, keys)
+}
+
+// sessionCookie returns the well-formed session ID from the request's cookie,
+// if any.
+func sessionCookie(request *http.Request) string {
+	cookie, err := request.Cookie(sessionCookieName)
+	if err != nil || len(cookie.Value) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(cookie.Value); err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// clearSessionCookie tells the browser to drop a session cookie whose session
+// no longer exists.
+func clearSessionCookie(responseWriter http.ResponseWriter, request *http.Request) {
+	if _, err := request.Cookie(sessionCookieName); err != nil {
+		return
+	}
+	http.SetCookie(responseWriter, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", Secure: true, HttpOnly: true, MaxAge: -1})
+}
+
+// stripSessionCookie removes the session cookie from the request so the
+// session ID never reaches the upstream, keeping its other cookies.
+// The header is filtered as text, since re-serializing parsed cookies would
+// drop or rewrite values net/http considers invalid.
+func stripSessionCookie(request *http.Request) {
+	if _, err := request.Cookie(sessionCookieName); err != nil {
+		return
+	}
+	var kept []string
+	for _, header := range request.Header.Values("Cookie") {
+		for _, cookie := range strings.Split(header, ";") {
+			name, _, _ := strings.Cut(strings.TrimSpace(cookie), "=")
+			if name != sessionCookieName && strings.TrimSpace(cookie) != "" {
+				kept = append(kept, strings.TrimSpace(cookie))
+			}
+		}
+	}
+	request.Header.Del("Cookie")
+	if len(kept) > 0 {
+		request.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// setSessionExpires tells the upstream the session expires at expires, unless
+// the client keeps renewing it.
+func setSessionExpires(request *http.Request, expires time.Time) {
+	request.Header.Set(sessionExpiresHeader, strconv.FormatInt(expires.Unix(), 10))
+}
+
+// sessionAgeKey returns the companion key recording when the session under
+// sessionKey was granted.
+func sessionAgeKey(sessionKey string) string {
+	return sessionKey + ":age"
+}
+
+func sessionSetKey(app *AppConfig) string {
+	return sessionNamespace(app) + ":sessions"
+}
+
+func ipSessionKey(app *AppConfig, ip string) string {
+	return fmt.Sprintf("%s:ip:%s", sessionNamespace(app), sessionIP(app, ip))
+}
+
+// sessionNamespace returns the prefix of the app's session keys, shared by all
+// apps of its session group. Wildcard apps keep the sessions of each hostname
+// apart, like apps of their own, unless they share them.
+func sessionNamespace(app *AppConfig) string {
+	if app.SessionGroup != "" {
+		return redisKey("%s", hashTag("group:"+app.SessionGroup))
+	}
+	if app.ShareSessions {
+		return redisKey("%s", hashTag("app:"+app.Hostname))
+	}
+	return redisKey("%s", hashTag("app:"+app.requestHost()))
+}
+
+// checkSessionGroups makes sure the apps of each session group agree on how
+// their shared sessions are granted, renewed and checked, so a session
+// behaves the same whichever member it is used on.
+func checkSessionGroups(apps map[string]*AppConfig) error {
+	first := make(map[string]*AppConfig)
+	for _, hostname := range sortedHostnames(apps) {
+		app := apps[hostname]
+		if app.SessionGroup == "" {
+			continue
+		}
+		other, exists := first[app.SessionGroup]
+		if !exists {
+			first[app.SessionGroup] = app
+			continue
+		}
+		for _, setting := range []struct {
+			name  string
+			equal bool
+		}{
+			{"session_ttl", app.SessionTTL == other.SessionTTL},
+			{"auto_renew", app.AutoRenew == other.AutoRenew},
+			{"renew_fraction", app.RenewFraction == other.RenewFraction},
+			{"max_session_age", app.MaxSessionAge == other.MaxSessionAge},
+			{"max_sessions", app.MaxSessions == other.MaxSessions},
+			{"session_ipv4_prefix", app.SessionIPv4Prefix == other.SessionIPv4Prefix},
+			{"session_ipv6_prefix", app.SessionIPv6Prefix == other.SessionIPv6Prefix},
+			{"bind_user_agent", app.BindUserAgent == other.BindUserAgent},
+			{"preauthorized_ips", maps.Equal(app.PreauthorizedIPs, other.PreauthorizedIPs)},
+		} {
+			if !setting.equal {
+				return fmt.Errorf("%s and %s are in session group %s but differ in %s", other.Hostname, app.Hostname, app.SessionGroup, setting.name)
+			}
+		}
+	}
+	return nil
+}
+
+// sessionIP returns what an IP session of ip is bound to: the IP itself, or
+// the network around it when the app's session prefix is shorter than an
+// address. Anything that isn't a plain IP is returned unchanged.
+func sessionIP(app *AppConfig, ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	bits := app.SessionIPv6Prefix
+	if addr.Is4() {
+		bits = app.SessionIPv4Prefix
+	}
+	if bits >= addr.BitLen() {
+		return ip
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.Masked().String()
+}
+
+func sessionIDKey(app *AppConfig, sessionID string) string {
+	return fmt.Sprintf("%s:sid:%s", sessionNamespace(app), sessionID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var renewalsStarted sync.Once
+
+// startRenewals runs runRenewals, as main does, for the rest of the tests.
+func startRenewals() {
+	renewalsStarted.Do(func() { go runRenewals() })
+}
+
+// waitForRenewals returns once the queued renewals have been sent to the
+// session store.
+func waitForRenewals() {
+	for len(renewQueue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(2 * renewFlushInterval)
+}
+
+// BenchmarkAutoRenew measures the Redis commands an authenticated request
+// costs with auto_renew, renewing on every request and once a tenth of the
+// session TTL has passed, and the share of requests that queue a renewal.
+func BenchmarkAutoRenew(b *testing.B) {
+	const sessions = 1000
+	for _, fraction := range []string{"0", "0.1"} {
+		b.Run("renew_fraction="+fraction, func(b *testing.B) {
+			server := useMiniredis(b)
+			useSessionStore(b, redisStore{})
+			startRenewals()
+			app, err := parseAppConfig(map[string]string{
+				"hostname":       "app.example.com",
+				"upstream_url":   "http://127.0.0.1:8080",
+				"secret_path":    "/knock",
+				"session_ttl":    "1h",
+				"auto_renew":     "true",
+				"renew_fraction": fraction,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ips := make([]string, sessions)
+			for i := range ips {
+				ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+				request := httptest.NewRequest("GET", "http://app.example.com/knock", nil)
+				if err := grantSession(app, httptest.NewRecorder(), request, ips[i], "secret_path", app.SessionTTL); err != nil {
+					b.Fatal(err)
+				}
+			}
+			waitForRenewals()
+
+			request := httptest.NewRequest("GET", "http://app.example.com/", nil)
+			commands := server.CommandCount()
+			renewals := 0
+			b.ResetTimer()
+			for i := range b.N {
+				ip := ips[i%sessions]
+				keys, missing, err := checkSession(app, request, ip)
+				if err != nil || len(missing) > 0 {
+					b.Fatalf("session of %s not found: missing %v, error %v", ip, missing, err)
+				}
+				if renewSession(app, keys, ip, request.URL.Path) {
+					renewals++
+				}
+			}
+			b.StopTimer()
+			waitForRenewals()
+			b.ReportMetric(float64(server.CommandCount()-commands)/float64(b.N), "redis-cmds/op")
+			b.ReportMetric(float64(renewals)/float64(b.N), "renewals/op")
+		})
+	}
+}
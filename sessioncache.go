@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// sessionCache remembers for a short while the sessions found in Redis, so
+// the many requests of a page load don't each look their session up. A
+// session revoked through this replica is forgotten right away; on other
+// replicas it keeps working for up to the cache's TTL. A nil cache remembers
+// nothing.
+type sessionCache struct {
+	ttl  time.Duration
+	size int
+	mu   sync.Mutex
+	// Most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type sessionCacheEntry struct {
+	session storedSession
+	cached  time.Time
+}
+
+// Shared by all apps; nil when SESSION_CACHE_TTL is 0
+var cachedSessions *sessionCache
+
+func newSessionCache(ttl time.Duration, size int) *sessionCache {
+	return &sessionCache{ttl: ttl, size: size, order: list.New(), entries: make(map[string]*list.Element, size)}
+}
+
+// get returns the session remembered under key, with its TTL reduced by the
+// time since it was looked up.
+func (c *sessionCache) get(key string) (storedSession, bool) {
+	if c == nil {
+		return storedSession{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return storedSession{}, false
+	}
+	entry := element.Value.(*sessionCacheEntry)
+	age := time.Since(entry.cached)
+	if age > c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return storedSession{}, false
+	}
+	c.order.MoveToFront(element)
+	session := entry.session
+	if session.ttl > 0 {
+		session.ttl -= age
+	}
+	return session, true
+}
+
+// put remembers an existing session. When the cache is full, the least
+// recently used session is dropped.
+func (c *sessionCache) put(session storedSession) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[session.key]; found {
+		c.order.Remove(element)
+	} else if len(c.entries) >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sessionCacheEntry).session.key)
+	}
+	c.entries[session.key] = c.order.PushFront(&sessionCacheEntry{session: session, cached: time.Now()})
+}
+
+// forget drops the sessions under keys, e.g. once they were revoked or
+// replaced.
+func (c *sessionCache) forget(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if element, found := c.entries[key]; found {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strings"
+)
+
+// globalSetting is a setting of the whole proxy, rather than of an app. It is
+// read from its flag, then its environment variable, then the config file,
+// falling back to its default. The flag is the variable's name in lower case
+// with hyphens, e.g. -redis-db, unless it has a shorter one.
+type globalSetting struct {
+	name     string
+	flag     string
+	fallback string
+	usage    string
+}
+
+// The global settings, by environment variable name. Those computed at
+// startup have no default here and say what it is in their usage.
+var globalSettings = []globalSetting{
+	{"ADMIN_LISTEN_ADDRESS", "", "", "IP:Port of the admin API (empty = disabled)"},
+	{"ADMIN_TOKENS", "", "", "comma-separated name:token pairs accepted by the admin API"},
+	{"APPS_CONFIG", "", "", "JSON array of the apps, or an object with defaults and apps"},
+	{"CONFIG_FILE", "config", "", "YAML, TOML or JSON file with the apps and global settings"},
+	{"CONFIG_POLL_INTERVAL", "", "30s", "how often the apps in Redis are checked for changes besides the channel (0 = never)"},
+	{"CONFIG_REDIS_KEY", "", "config:apps", "Redis key holding the apps' JSON with CONFIG_SOURCE=redis"},
+	{"CONFIG_SOURCE", "", "env", "where the apps come from: env or redis"},
+	{"CONFIG_WATCH", "", "false", "reload the apps whenever CONFIG_FILE changes"},
+	{"DENIAL_CACHE_SIZE", "", "10000", "maximum number of entries in the denial cache"},
+	{"DENIAL_CACHE_TTL", "", "2s", "how long missing sessions and bans are remembered in memory (0s = off)"},
+	{"DOCKER_DISCOVERY", "", "false", "add apps for the containers labelled with mithrandir.hostname"},
+	{"DOCKER_GRACE_PERIOD", "", "30s", "how long the app of a stopped container is kept in case it restarts"},
+	{"DOCKER_HOST", "", "unix:///var/run/docker.sock", "Docker socket of DOCKER_DISCOVERY: unix:///path or tcp://host:port"},
+	{"EVENT_STREAM", "", "", "Redis stream receiving session events (empty = disabled)"},
+	{"EVENT_STREAM_MAXLEN", "", "100000", "approximate number of events the stream keeps"},
+	{"GEOIP_ASN_DB_PATH", "", "", "path to a MaxMind ASN database, for allow_asns"},
+	{"GEOIP_DB_PATH", "", "", "path to a MaxMind Country/City database, for country rules"},
+	{"GEOIP_REFRESH_INTERVAL", "", "1h", "how often the GeoIP database files are checked for updates"},
+	{"GRANT_WEBHOOK_URL", "", "", "grant webhook of the apps that don't set grant_webhook_url"},
+	{"HEALTH_LISTEN_ADDRESS", "", "", "IP:Port serving GET /healthz (empty = disabled)"},
+	{"HEALTH_REDIS_THRESHOLD", "", "30s", "how long Redis may be unreachable before /healthz answers 503"},
+	{"IP_FROM_HEADERS", "", "true", "use the client IP headers, not only the connection's address (per-app default)"},
+	{"LISTEN_ADDRESS", "listen", ":8080", "IP:Port the proxy listens on"},
+	{"LOG_LEVEL", "", "info", "minimum log level: debug, info, warn or error"},
+	{"METRICS_LOG_INTERVAL", "", "0s", "log a per-app summary this often (0s = off)"},
+	{"NOT_FOUND_PAGE", "", "", "HTML template rendered for hostnames without an app"},
+	{"PROXY_PROTOCOL", "", "false", "require a PROXY protocol v1/v2 header on every connection"},
+	{"PROXY_PROTOCOL_SOURCES", "", "", "comma-separated CIDRs allowed to connect with PROXY protocol (empty = any)"},
+	{"REDIS_ADDRESS", "redis", "redis:6379", "Redis address: host:port or unix:///path/to/redis.sock"},
+	{"REDIS_BREAKER_COOLDOWN", "", "5s", "how often Redis is pinged while the circuit breaker is open"},
+	{"REDIS_BREAKER_THRESHOLD", "", "5", "consecutive failed Redis calls that open the circuit breaker (0 = never)"},
+	{"REDIS_CLUSTER_ADDRS", "", "", "comma-separated host:port of Redis Cluster nodes"},
+	{"REDIS_CONNECT_TIMEOUT", "", "60s", "how long to wait for Redis at startup (0 = try once)"},
+	{"REDIS_DB", "", "0", "Redis logical database"},
+	{"REDIS_DIAL_TIMEOUT", "", "5s", "timeout of opening a Redis connection"},
+	{"REDIS_HEALTH_INTERVAL", "", "5s", "how often Redis is pinged by the health monitor"},
+	{"REDIS_KEY_PREFIX", "", "", "prepended to every Redis key"},
+	{"REDIS_MASTER_NAME", "", "", "name of the master monitored by the Sentinels"},
+	{"REDIS_MIN_IDLE_CONNS", "", "0", "idle connections kept open per Redis node"},
+	{"REDIS_OP_TIMEOUT", "", "1s", "deadline of every Redis call (0 = none)"},
+	{"REDIS_PASSWORD", "", "", "Redis password"},
+	{"REDIS_POOL_SIZE", "", "", "connections kept per Redis node (default 10 per CPU)"},
+	{"REDIS_READ_TIMEOUT", "", "3s", "socket read timeout of Redis calls, with REDIS_OP_TIMEOUT=0"},
+	{"REDIS_SENTINEL_ADDRS", "", "", "comma-separated host:port of Redis Sentinels"},
+	{"REDIS_SENTINEL_PASSWORD", "", "", "password of the Sentinels, if different from the master's"},
+	{"REDIS_TLS", "", "false", "connect to Redis over TLS"},
+	{"REDIS_TLS_CA_FILE", "", "", "PEM CA certificates to verify the Redis server with"},
+	{"REDIS_TLS_CERT_FILE", "", "", "PEM client certificate for Redis"},
+	{"REDIS_TLS_INSECURE_SKIP_VERIFY", "", "false", "don't verify the Redis server's certificate; testing only"},
+	{"REDIS_TLS_KEY_FILE", "", "", "PEM client key for Redis"},
+	{"REDIS_USERNAME", "", "", "Redis ACL user"},
+	{"REDIS_WRITE_TIMEOUT", "", "", "socket write timeout of Redis calls, with REDIS_OP_TIMEOUT=0 (default REDIS_READ_TIMEOUT)"},
+	{"SESSION_CACHE_SIZE", "", "10000", "maximum number of sessions in the session cache"},
+	{"SESSION_CACHE_TTL", "", "1s", "how long sessions found in Redis are remembered in memory (0s = off)"},
+	{"SESSION_EXPIRY_EVENTS", "", "false", "log sessions whose TTL runs out, using Redis keyspace notifications"},
+	{"SMTP_FROM", "", "", "sender address of login emails"},
+	{"SMTP_HOST", "", "", "SMTP server for emailed login links"},
+	{"SMTP_PASSWORD", "", "", "SMTP password"},
+	{"SMTP_PORT", "", "587", "SMTP port"},
+	{"SMTP_USERNAME", "", "", "SMTP user"},
+	{"STORE", "", "redis", "session store: redis, memory or bolt"},
+	{"STORE_FILE", "", "mithrandir.db", "database file of STORE=bolt"},
+	{"TARPIT_MAX_CONNECTIONS", "", "100", "maximum denied requests held by deny_delay at once"},
+	{"TRUSTED_HOPS", "", "0", "number of trusted proxies in front (per-app default, 0 uses TRUSTED_PROXIES)"},
+	{"TRUSTED_PROXIES", "", "", "comma-separated CIDRs or IPs whose client IP headers are trusted (per-app default)"},
+	{"UPSTREAM_DIAL_TIMEOUT", "", "30s", "timeout of connecting to an upstream (per-app default, 0 = none)"},
+	{"UPSTREAM_HTTP2", "", "true", "negotiate HTTP/2 with https upstreams that offer it (per-app default)"},
+	{"UPSTREAM_IDLE_CONN_TIMEOUT", "", "90s", "how long an idle upstream connection is kept (per-app default, 0 = no limit)"},
+	{"UPSTREAM_MAX_CONNS_PER_HOST", "", "0", "connections per upstream host, busy or idle (per-app default, 0 = no limit)"},
+	{"UPSTREAM_MAX_IDLE_CONNS", "", "100", "idle upstream connections kept in all (per-app default, 0 = no limit)"},
+	{"UPSTREAM_MAX_IDLE_CONNS_PER_HOST", "", "32", "idle connections kept per upstream host (per-app default, 0 = 2)"},
+	{"UPSTREAM_RESPONSE_HEADER_TIMEOUT", "", "60s", "how long an upstream may take to start answering (per-app default, 0 = no limit)"},
+	{"UPSTREAM_TIMEOUT", "", "0s", "deadline of a whole request to an upstream, body included (per-app default, 0s = none)"},
+	{"UPSTREAM_TLS_HANDSHAKE_TIMEOUT", "", "10s", "timeout of the TLS handshake with an https upstream (per-app default, 0 = none)"},
+}
+
+// Settings the config file can't hold: its own path, and the apps it would
+// conflict with
+var envOnlySettings = []string{"APPS_CONFIG", "CONFIG_FILE"}
+
+// How the secret settings are masked when printed, see redactValue
+var settingRedactions = map[string]string{
+	"ADMIN_TOKENS":            redactSecret,
+	"APPS_CONFIG":             redactSecret,
+	"GRANT_WEBHOOK_URL":       redactURL,
+	"REDIS_PASSWORD":          redactSecret,
+	"REDIS_SENTINEL_PASSWORD": redactSecret,
+	"SMTP_PASSWORD":           redactSecret,
+}
+
+// The settings given on the command line, by environment variable name
+var flagSettings = make(map[string]string)
+
+// settingFlag is the flag of a global setting, recording its value when set.
+type settingFlag struct{ setting globalSetting }
+
+func (f settingFlag) String() string { return f.setting.fallback }
+
+func (f settingFlag) Set(value string) error {
+	flagSettings[f.setting.name] = value
+	return nil
+}
+
+// IsBoolFlag lets a boolean setting's flag go without a value, like -config-watch.
+func (f settingFlag) IsBoolFlag() bool {
+	return f.setting.fallback == "true" || f.setting.fallback == "false"
+}
+
+// defineSettingFlags adds the flag of every global setting, to be called
+// before flag.Parse.
+func defineSettingFlags() {
+	for _, setting := range globalSettings {
+		name := setting.flag
+		if name == "" {
+			name = strings.ToLower(strings.ReplaceAll(setting.name, "_", "-"))
+		}
+		flag.Var(settingFlag{setting}, name, setting.usage+" (env "+setting.name+")")
+	}
+}
+
+// setting returns the value of a global setting, or its default.
+func setting(name string) string {
+	for _, setting := range globalSettings {
+		if setting.name == name {
+			return getenv(name, setting.fallback)
+		}
+	}
+	panic("unknown setting " + name)
+}
+
+// isGlobalSetting reports whether name is the environment variable of a
+// global setting.
+func isGlobalSetting(name string) bool {
+	return slices.ContainsFunc(globalSettings, func(setting globalSetting) bool { return setting.name == name })
+}
+
+// isFileSetting reports whether the config file may set the global setting.
+func isFileSetting(name string) bool {
+	return isGlobalSetting(name) && !slices.Contains(envOnlySettings, name)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	signedExpiresParameter   = "exp"
+	signedTTLParameter       = "ttl"
+	signedSignatureParameter = "sig"
+)
+
+// knockSignature computes the HMAC-SHA256 signature of a knock link over the
+// app hostname, the expiry timestamp and the optional session TTL.
+func knockSignature(app *AppConfig, expires, ttl string) string {
+	mac := hmac.New(sha256.New, app.SigningKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s", app.requestHost(), expires, ttl)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedKnock checks the signature and expiry of a knock link and
+// returns the session TTL embedded in it, or zero to use the app's TTL.
+func verifySignedKnock(app *AppConfig, query url.Values, now time.Time) (time.Duration, error) {
+	expires := query.Get(signedExpiresParameter)
+	ttl := query.Get(signedTTLParameter)
+	signature := query.Get(signedSignatureParameter)
+	if expires == "" || signature == "" {
+		return 0, fmt.Errorf("missing %s or %s parameter", signedExpiresParameter, signedSignatureParameter)
+	}
+
+	expected := knockSignature(app, expires, ttl)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return 0, fmt.Errorf("invalid signature")
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry")
+	}
+	if now.Unix() > expiresAt {
+		return 0, fmt.Errorf("link expired at %s", time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	if ttl == "" {
+		return 0, nil
+	}
+	sessionTTL, err := time.ParseDuration(ttl)
+	if err != nil || sessionTTL <= 0 {
+		return 0, fmt.Errorf("invalid ttl")
+	}
+	return sessionTTL, nil
+}
+
+// signedKnockURL builds a ready-to-share knock link for an app that is valid
+// for validFor and optionally grants a session with a custom TTL.
+func signedKnockURL(app *AppConfig, validFor, sessionTTL time.Duration) string {
+	expires := strconv.FormatInt(time.Now().Add(validFor).Unix(), 10)
+	ttl := ""
+	if sessionTTL > 0 {
+		ttl = sessionTTL.String()
+	}
+
+	query := url.Values{}
+	query.Set(signedExpiresParameter, expires)
+	if ttl != "" {
+		query.Set(signedTTLParameter, ttl)
+	}
+	query.Set(signedSignatureParameter, knockSignature(app, expires, ttl))
+
+	link := url.URL{Scheme: "https", Host: app.requestHost(), Path: app.SignedPath, RawQuery: query.Encode()}
+	return link.String()
+}
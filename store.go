@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionStore keeps the sessions of all apps, addressed by the keys of
+// their factors (see sessionFactors). Sessions are stored in Redis, so all
+// replicas share them, or with STORE=memory in this process.
+type SessionStore interface {
+	// Exists looks up the sessions under keys in a single round trip.
+	Exists(ctx context.Context, app *AppConfig, keys []string) ([]storedSession, error)
+	// Grant stores a session under keys, replacing any existing one, and
+	// indexes it under the first key. A zero ttl never expires. If a session
+	// granted in the same second already exists under the first key, it was
+	// granted by a concurrent knock after this one's session check; it is
+	// kept and errConcurrentGrant returned.
+	Grant(ctx context.Context, app *AppConfig, keys []string, metadata map[string]any, ttl time.Duration) error
+	// Renew extends queued renewals' sessions by their app's TTL and
+	// updates their last_seen and request_count, unless they are gone.
+	Renew(ctx context.Context, renewals []*renewal) error
+	// Revoke deletes the sessions under keys.
+	Revoke(ctx context.Context, app *AppConfig, keys []string) error
+	// List returns up to about count of the app's indexed sessions, starting
+	// at cursor, and the cursor of the next page, which is 0 on the last.
+	List(ctx context.Context, app *AppConfig, cursor uint64, count int) ([]storedSession, uint64, error)
+	// Count returns the number of the app's live indexed sessions.
+	Count(ctx context.Context, app *AppConfig) (int, error)
+}
+
+// storedSession is what a SessionStore knows about the session under key.
+type storedSession struct {
+	key    string
+	exists bool
+	// Granted longer than max_session_age ago; always set for sessions
+	// without expiry
+	aged bool
+	// Remaining lifetime, negative for sessions without expiry
+	ttl time.Duration
+	// Nil for sessions stored as plain strings by older versions
+	metadata map[string]string
+}
+
+var sessionStore SessionStore
+
+var errConcurrentGrant = errors.New("session just granted by a concurrent request")
+
+// redisOnlySettings returns the app's settings that keep state in Redis
+// outside of sessions, and so can't be used with STORE=memory.
+func redisOnlySettings(app *AppConfig) []string {
+	var settings []string
+	if app.TOTPKey != nil {
+		settings = append(settings, "totp_secret")
+	}
+	if app.OncePath != "" {
+		settings = append(settings, "once_path")
+	}
+	if len(app.AllowedEmails) > 0 {
+		settings = append(settings, "allowed_emails")
+	}
+	if app.BanThreshold > 0 {
+		settings = append(settings, "ban_threshold")
+	}
+	if app.MaxGrantsPerMinute > 0 {
+		settings = append(settings, "max_grants_per_minute")
+	}
+	if app.MaxFailuresPerMinute > 0 {
+		settings = append(settings, "max_failures_per_minute")
+	}
+	return settings
+}
+
+// redisStore keeps every session as a hash under its key, plus a companion
+// age key with max_session_age, in a per-app (or session group) index set.
+type redisStore struct{}
+
+func (redisStore) Exists(ctx context.Context, app *AppConfig, keys []string) ([]storedSession, error) {
+	pipe := redisClient.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	metadata := make([]*redis.MapStringStringCmd, len(keys))
+	ages := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(ctx, key)
+		metadata[i] = pipe.HGetAll(ctx, key)
+		if app.MaxSessionAge > 0 {
+			ages[i] = pipe.Exists(ctx, sessionAgeKey(key))
+		}
+	}
+	// HGETALL fails for old string sessions, so only errors other than
+	// Redis replies, like connection failures, count
+	if _, err := pipe.Exec(ctx); err != nil {
+		var reply redis.Error
+		if !errors.As(err, &reply) {
+			return nil, err
+		}
+	}
+
+	sessions := make([]storedSession, len(keys))
+	var outdated []string
+	for i, key := range keys {
+		ttl, err := ttls[i].Result()
+		if err != nil {
+			return nil, err
+		}
+		// PTTL reports -2 for missing keys and -1 for keys without expiry
+		session := storedSession{key: key, exists: ttl != -2, ttl: ttl}
+		if session.exists {
+			if values, err := metadata[i].Result(); err == nil {
+				session.metadata = values
+			}
+			// Without its age key, the session aged out, or was granted before
+			// max_session_age was set, which granted_at tells apart
+			if ages[i] != nil && ages[i].Val() == 0 {
+				session.aged = ttl == -1 || !grantedWithin(session.metadata, app.MaxSessionAge, time.Now())
+			}
+			if recordOutdated(session.metadata) {
+				outdated = append(outdated, key)
+			}
+		}
+		sessions[i] = session
+	}
+	if len(outdated) > 0 {
+		go migrateSessions(app, outdated)
+	}
+	return sessions, nil
+}
+
+// grantedWithin reports whether a session's metadata records it being granted
+// less than age before now. Plain string sessions record nothing.
+func grantedWithin(metadata map[string]string, age time.Duration, now time.Time) bool {
+	granted, err := strconv.ParseInt(metadata["granted_at"], 10, 64)
+	return err == nil && now.Sub(time.Unix(granted, 0)) < age
+}
+
+// grantScript stores a session under its keys in one round trip, unless the
+// first key holds a session granted at ARGV[1] or later. KEYS are the session
+// keys, their age keys and the index set; ARGV continues with the TTL and the
+// max_session_age in milliseconds, 0 for none, and the metadata fields and
+// values.
+var grantScript = redis.NewScript(`
+local count = (#KEYS - 1) / 2
+if redis.call("TYPE", KEYS[1]).ok == "hash" then
+	local granted = tonumber(redis.call("HGET", KEYS[1], "granted_at"))
+	if granted and granted >= tonumber(ARGV[1]) then
+		return 0
+	end
+end
+local ttl, age = tonumber(ARGV[2]), tonumber(ARGV[3])
+for i = 1, count do
+	local key = KEYS[i]
+	-- Replaces a stale session, which may still be a plain string
+	redis.call("DEL", key)
+	redis.call("HSET", key, unpack(ARGV, 4))
+	if ttl > 0 then
+		redis.call("PEXPIRE", key, ttl)
+		-- Expires once the session reaches its maximum age, however often
+		-- the session itself is renewed
+		if age > 0 then
+			redis.call("SET", KEYS[count + i], ARGV[1], "PX", age)
+		end
+	end
+end
+redis.call("SADD", KEYS[#KEYS], KEYS[1])
+return 1
+`)
+
+func (redisStore) Grant(ctx context.Context, app *AppConfig, keys []string, metadata map[string]any, ttl time.Duration) error {
+	now := time.Now().Unix()
+	args := []any{now, ttl.Milliseconds(), app.MaxSessionAge.Milliseconds()}
+	for field, value := range metadata {
+		args = append(args, field, value)
+	}
+	scriptKeys := append([]string{}, keys...)
+	for _, key := range keys {
+		scriptKeys = append(scriptKeys, sessionAgeKey(key))
+	}
+	created, err := grantScript.Run(ctx, redisClient, append(scriptKeys, sessionSetKey(app)), args...).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return errConcurrentGrant
+	}
+	go sampleSessionIndex(app)
+	return nil
+}
+
+// renewScript extends a session's keys and updates their metadata, but only
+// for keys that still exist, so a session revoked while its renewal was
+// queued isn't brought back. Sessions stored as plain strings by older
+// versions reject the hash commands, which is ignored.
+var renewScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call("PEXPIRE", key, ARGV[1]) == 1 then
+		redis.pcall("HSET", key, "last_seen", ARGV[2])
+		redis.pcall("HINCRBY", key, "request_count", ARGV[3])
+	end
+end
+return 0
+`)
+
+func (redisStore) Renew(ctx context.Context, renewals []*renewal) error {
+	now := time.Now().Unix()
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, queued := range renewals {
+			renewScript.Eval(ctx, pipe, queued.keys, queued.app.SessionTTL.Milliseconds(), now, queued.requests)
+		}
+		return nil
+	})
+	return err
+}
+
+func (redisStore) Revoke(ctx context.Context, app *AppConfig, keys []string) error {
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		for _, key := range keys {
+			if app.MaxSessionAge > 0 {
+				pipe.Del(ctx, sessionAgeKey(key))
+			}
+			pipe.SRem(ctx, sessionSetKey(app), key)
+		}
+		return nil
+	})
+	return err
+}
+
+// List walks the session index with SSCAN, which only covers a slice of it
+// per call, so large indexes never block Redis. Expired members are removed
+// from the index.
+func (s redisStore) List(ctx context.Context, app *AppConfig, cursor uint64, count int) ([]storedSession, uint64, error) {
+	members, next, err := redisClient.SScan(ctx, sessionSetKey(app), cursor, "", int64(count)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	found, err := s.Exists(ctx, app, members)
+	if err != nil {
+		return nil, 0, err
+	}
+	sessions := []storedSession{}
+	var expired []any
+	for _, session := range found {
+		if session.exists {
+			sessions = append(sessions, session)
+		} else {
+			expired = append(expired, session.key)
+		}
+	}
+	if len(expired) > 0 {
+		if err := redisClient.SRem(ctx, sessionSetKey(app), expired...).Err(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return sessions, next, nil
+}
+
+func (redisStore) Count(ctx context.Context, app *AppConfig) (int, error) {
+	members, err := redisClient.SMembers(ctx, sessionSetKey(app)).Result()
+	if err == nil {
+		members, err = pruneSessionIndex(ctx, app, members)
+	}
+	return len(members), err
+}
+
+// pruneSessionIndex removes members whose session expired from the app's
+// session index and returns the live ones.
+func pruneSessionIndex(ctx context.Context, app *AppConfig, members []string) ([]string, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	pipe := redisClient.Pipeline()
+	results := make([]*redis.IntCmd, len(members))
+	for i, member := range members {
+		results[i] = pipe.Exists(ctx, member)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	var live []string
+	var expired []any
+	for i, member := range members {
+		if results[i].Val() == 0 {
+			expired = append(expired, member)
+		} else {
+			live = append(live, member)
+		}
+	}
+	if len(expired) > 0 {
+		if err := redisClient.SRem(ctx, sessionSetKey(app), expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+// sampleSessionIndex prunes a few random members of the app's session index
+// after every grant, so the index stays close to the number of live sessions
+// even when it is never listed.
+func sampleSessionIndex(app *AppConfig) {
+	members, err := redisClient.SRandMemberN(backgroundContext, sessionSetKey(app), sessionIndexSample).Result()
+	if err == nil {
+		_, err = pruneSessionIndex(backgroundContext, app, members)
+	}
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+	}
+}
+
+// recordOutdated reports whether a session with metadata, nil for plain
+// strings, predates sessionVersion. Records of newer versions, e.g. during a
+// rollback, are left alone.
+func recordOutdated(metadata map[string]string) bool {
+	version, found := metadata["v"]
+	if !found {
+		return true
+	}
+	number, err := strconv.Atoi(version)
+	return err == nil && number < sessionVersion
+}
+
+// migrateSessionScript rewrites a session record in the current format,
+// keeping its TTL. Plain strings are replaced by a hash of the fields in
+// ARGV, which start with v; hashes only get the v field.
+var migrateSessionScript = redis.NewScript(`
+local kind = redis.call("TYPE", KEYS[1]).ok
+if kind == "string" then
+	local ttl = redis.call("PTTL", KEYS[1])
+	redis.call("DEL", KEYS[1])
+	redis.call("HSET", KEYS[1], unpack(ARGV))
+	if ttl > 0 then
+		redis.call("PEXPIRE", KEYS[1], ttl)
+	end
+elseif kind == "hash" then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// migrateSessions upgrades the outdated session records under keys. What a
+// plain string session doesn't record, like when and how it was granted, is
+// left out; its IP is only known for IP sessions.
+func migrateSessions(app *AppConfig, keys []string) {
+	now := time.Now().Unix()
+	for _, key := range keys {
+		fields := []any{"v", sessionVersion, "last_seen", now, "request_count", 0}
+		if ip, found := strings.CutPrefix(key, ipSessionKey(app, "")); found {
+			fields = append(fields, "ip", ip)
+		}
+		err := migrateSessionScript.Run(backgroundContext, redisClient, []string{key}, fields...).Err()
+		if err != nil && err != redis.Nil {
+			app.errorf("Redis error migrating session %s: %v", key, err)
+			return
+		}
+	}
+	app.debugf("Migrated %d session records to version %d", len(keys), sessionVersion)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// useMiniredis points redisClient at an in-memory Redis for the test.
+func useMiniredis(t testing.TB) *miniredis.Miniredis {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	previous := redisClient
+	redisClient = client
+	t.Cleanup(func() {
+		redisClient = previous
+		client.Close()
+	})
+	return server
+}
+
+// useBenchRedis points redisClient at the Redis in BENCH_REDIS_ADDRESS for
+// the benchmark, to measure real round trips, else at an in-memory one.
+func useBenchRedis(b *testing.B) {
+	address := os.Getenv("BENCH_REDIS_ADDRESS")
+	if address == "" {
+		useMiniredis(b)
+		return
+	}
+	client := redis.NewClient(&redis.Options{Addr: address})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		b.Fatalf("BENCH_REDIS_ADDRESS %s: %v", address, err)
+	}
+	previous := redisClient
+	redisClient = client
+	b.Cleanup(func() {
+		redisClient = previous
+		client.Close()
+	})
+}
+
+// useSessionStore makes store the session store for the test.
+func useSessionStore(t testing.TB, store SessionStore) {
+	previous := sessionStore
+	sessionStore = store
+	t.Cleanup(func() { sessionStore = previous })
+}
+
+func TestMigrateOldSessionRecords(t *testing.T) {
+	server := useMiniredis(t)
+	app := &AppConfig{Hostname: "app.example.com", SessionIPv4Prefix: 32, SessionIPv6Prefix: 128}
+	// Version 0, a plain string, and version 1, a hash without v
+	stringKey := ipSessionKey(app, "192.0.2.1")
+	hashKey := ipSessionKey(app, "192.0.2.2")
+	if err := server.Set(stringKey, "1"); err != nil {
+		t.Fatal(err)
+	}
+	server.SetTTL(stringKey, time.Hour)
+	server.HSet(hashKey, "ip", "192.0.2.2", "granted_at", "1700000000", "method", "secret_path")
+	server.SetTTL(hashKey, 30*time.Minute)
+
+	sessions, err := redisStore{}.Exists(context.Background(), app, []string{stringKey, hashKey})
+	if err != nil {
+		t.Fatalf("Exists: %v", err)
+	}
+	for _, session := range sessions {
+		if !session.exists {
+			t.Errorf("session %s isn't honored", session.key)
+		}
+	}
+
+	// Migrated in the background
+	want := strconv.Itoa(sessionVersion)
+	deadline := time.Now().Add(2 * time.Second)
+	for server.HGet(stringKey, "v") != want || server.HGet(hashKey, "v") != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions not migrated: %s v=%q, %s v=%q", stringKey, server.HGet(stringKey, "v"), hashKey, server.HGet(hashKey, "v"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ip := server.HGet(stringKey, "ip"); ip != "192.0.2.1" {
+		t.Errorf("migrated string session has ip %q, want 192.0.2.1", ip)
+	}
+	if method := server.HGet(hashKey, "method"); method != "secret_path" {
+		t.Errorf("migrated hash session lost its method, got %q", method)
+	}
+	if ttl := server.TTL(stringKey); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("migrated string session has TTL %s, want its hour kept", ttl)
+	}
+	if ttl := server.TTL(hashKey); ttl <= 0 || ttl > 30*time.Minute {
+		t.Errorf("migrated hash session has TTL %s, want its 30m kept", ttl)
+	}
+
+	// Still honored once migrated
+	sessions, err = redisStore{}.Exists(context.Background(), app, []string{stringKey, hashKey})
+	if err != nil {
+		t.Fatalf("Exists after migration: %v", err)
+	}
+	for _, session := range sessions {
+		if !session.exists || recordOutdated(session.metadata) {
+			t.Errorf("migrated session %s: exists %t, metadata %v", session.key, session.exists, session.metadata)
+		}
+	}
+}
+
+// BenchmarkSessionRoundTrips compares the latency of session checks and
+// knocks in one round trip to Redis, as redisStore does them, with the two
+// they took before: EXISTS then EXPIRE, and EXISTS then SET. Set
+// BENCH_REDIS_ADDRESS to run it against a real Redis: miniredis runs scripts
+// far slower, and sorts the whole session index for the SRANDMEMBER of every
+// knock. The sessions expire after a minute.
+func BenchmarkSessionRoundTrips(b *testing.B) {
+	ctx := context.Background()
+	// Every call of a benchmark gets new sessions under its own hostname
+	newApp := func() *AppConfig {
+		hostname := fmt.Sprintf("bench-%d.example.com", time.Now().UnixNano())
+		return &AppConfig{Hostname: hostname, SessionTTL: time.Minute, SessionIPv4Prefix: 32, SessionIPv6Prefix: 128}
+	}
+	// A new client for every knock, since grants within a second of a
+	// session's are taken for concurrent knocks
+	ip := func(i int) string {
+		return netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).String()
+	}
+	metadata := sessionMetadata(time.Now().Unix(), "secret_path", "192.0.2.1", "")
+	// Grants prune the session index in the background, see sampleSessionIndex
+	waitForSampling := func() { time.Sleep(100 * time.Millisecond) }
+
+	b.Run("check/two round trips", func(b *testing.B) {
+		useBenchRedis(b)
+		app := newApp()
+		key := ipSessionKey(app, "192.0.2.1")
+		if err := redisClient.Set(ctx, key, "1", app.SessionTTL).Err(); err != nil {
+			b.Fatal(err)
+		}
+		for range b.N {
+			if redisClient.Exists(ctx, key).Val() != 1 {
+				b.Fatal("session not found")
+			}
+			if err := redisClient.Expire(ctx, key, app.SessionTTL).Err(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("check/one round trip", func(b *testing.B) {
+		useBenchRedis(b)
+		app := newApp()
+		keys := []string{ipSessionKey(app, "192.0.2.1")}
+		if err := (redisStore{}).Grant(ctx, app, keys, metadata, app.SessionTTL); err != nil {
+			b.Fatal(err)
+		}
+		waitForSampling()
+		b.ResetTimer()
+		for range b.N {
+			// Renewals are sent in batches in the background, see runRenewals
+			sessions, err := redisStore{}.Exists(ctx, app, keys)
+			if err != nil || !sessions[0].exists {
+				b.Fatalf("session not found: %v", err)
+			}
+		}
+	})
+	b.Run("knock/two round trips", func(b *testing.B) {
+		useBenchRedis(b)
+		app := newApp()
+		for i := range b.N {
+			key := ipSessionKey(app, ip(i))
+			if redisClient.Exists(ctx, key).Val() != 0 {
+				b.Fatal("session already exists")
+			}
+			if err := redisClient.Set(ctx, key, "1", app.SessionTTL).Err(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("knock/one round trip", func(b *testing.B) {
+		useBenchRedis(b)
+		app := newApp()
+		for i := range b.N {
+			if err := (redisStore{}).Grant(ctx, app, []string{ipSessionKey(app, ip(i))}, metadata, app.SessionTTL); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		waitForSampling()
+	})
+}
+
+func TestMaxSessionAgeWithoutAgeKey(t *testing.T) {
+	server := useMiniredis(t)
+	app := &AppConfig{Hostname: "app.example.com", SessionIPv4Prefix: 32, SessionIPv6Prefix: 128, MaxSessionAge: 24 * time.Hour}
+	now := time.Now()
+	tests := []struct {
+		ip string
+		// Unix time, "" for a plain string session
+		grantedAt string
+		ageKey    bool
+		aged      bool
+	}{
+		{"192.0.2.1", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), true, false},
+		// Granted before max_session_age was set
+		{"192.0.2.2", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), false, false},
+		{"192.0.2.3", strconv.FormatInt(now.Add(-48*time.Hour).Unix(), 10), false, true},
+		{"192.0.2.4", "", false, true},
+	}
+	var keys []string
+	for _, test := range tests {
+		key := ipSessionKey(app, test.ip)
+		keys = append(keys, key)
+		if test.grantedAt == "" {
+			server.Set(key, "1")
+		} else {
+			server.HSet(key, "v", strconv.Itoa(sessionVersion), "ip", test.ip, "granted_at", test.grantedAt)
+		}
+		server.SetTTL(key, time.Hour)
+		if test.ageKey {
+			server.Set(sessionAgeKey(key), test.grantedAt)
+			server.SetTTL(sessionAgeKey(key), 23*time.Hour)
+		}
+	}
+
+	sessions, err := redisStore{}.Exists(context.Background(), app, keys)
+	if err != nil {
+		t.Fatalf("Exists: %v", err)
+	}
+	for i, test := range tests {
+		if !sessions[i].exists || sessions[i].aged != test.aged {
+			t.Errorf("session of %s (granted_at %q, age key %t): exists %t, aged %t, want aged %t",
+				test.ip, test.grantedAt, test.ageKey, sessions[i].exists, sessions[i].aged, test.aged)
+		}
+	}
+	// Until the plain string session is migrated in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for server.HGet(keys[3], "v") == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What an app does with requests whose session can't be checked or stored
+// because the session store failed: deny them, let them through, or honor
+// sessions this replica saw recently
+const (
+	storeFailureClosed = "closed"
+	storeFailureOpen   = "open"
+	storeFailureGrace  = "grace"
+)
+
+// sessionGrace remembers when this replica last saw each session of an app
+// exist, for store_failure grace. A nil sessionGrace remembers nothing.
+type sessionGrace struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+}
+
+func newSessionGrace(window time.Duration) *sessionGrace {
+	return &sessionGrace{window: window, seen: make(map[string]time.Time)}
+}
+
+// remember records that the sessions under keys exist.
+func (g *sessionGrace) remember(keys ...string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		g.seen[key] = now
+	}
+}
+
+// recent reports whether all keys were seen within the grace window.
+func (g *sessionGrace) recent(keys []string) bool {
+	if g == nil || len(keys) == 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		seen, exists := g.seen[key]
+		if !exists || now.Sub(seen) > g.window {
+			return false
+		}
+	}
+	return true
+}
+
+// sweep forgets sessions last seen before the grace window. See sweepApps.
+func (g *sessionGrace) sweep(now time.Time) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, seen := range g.seen {
+		if now.Sub(seen) > g.window {
+			delete(g.seen, key)
+		}
+	}
+}
+
+// storeFailureAllows decides, per the app's store_failure, whether a request
+// whose session check failed with err is let through anyway. It returns the
+// keys of the session honored from the grace cache, if any.
+func storeFailureAllows(app *AppConfig, request *http.Request, ip string, err error) ([]string, bool) {
+	switch app.StoreFailure {
+	case storeFailureOpen:
+		app.errorf("Session store unavailable, forwarding %s without a session check (store_failure open): %v", ip, err)
+		return nil, true
+	case storeFailureGrace:
+		var keys []string
+		for _, factor := range sessionFactors(app, request, ip) {
+			keys = append(keys, factor.key)
+		}
+		for _, key := range keys {
+			if key == "" {
+				keys = nil
+				break
+			}
+		}
+		if app.graceSessions.recent(keys) {
+			app.errorf("Session store unavailable, honoring the recently seen session of %s (store_failure grace): %v", ip, err)
+			return keys, true
+		}
+	}
+	app.errorf("Redis error: %v", err)
+	return nil, false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	// Codes from one step before or after the current one are accepted
+	totpSkew = 1
+)
+
+// parseTOTPSecret decodes a base32 shared secret as used by authenticator apps.
+func parseTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("secret is empty")
+	}
+	return key, nil
+}
+
+// totpCode computes the RFC 6238 code for a time step counter.
+func totpCode(key []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func totpCounter(now time.Time) uint64 {
+	return uint64(now.Unix()) / uint64(totpStep.Seconds())
+}
+
+// validTOTPCode returns the time step counter a code belongs to, accepting
+// codes within the allowed clock skew.
+func validTOTPCode(key []byte, code string, now time.Time) (uint64, bool) {
+	current := totpCounter(now)
+	valid, matched := false, uint64(0)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		// Check every candidate so timing doesn't reveal which step matched
+		if secretEqual(code, totpCode(key, counter)) {
+			valid, matched = true, counter
+		}
+	}
+	return matched, valid
+}
+
+// matchTOTPPath checks whether path starts with one of the app's secret path
+// prefixes followed by a currently valid code, returning the full knock path
+// (prefix and code) that should be stripped before proxying.
+func matchTOTPPath(app *AppConfig, path string) (string, bool) {
+	for _, prefix := range app.SecretPathPrefixes {
+		base := strings.TrimSuffix(prefix, "/") + "/"
+		rest, found := strings.CutPrefix(path, base)
+		if !found {
+			continue
+		}
+		code, remainder, _ := strings.Cut(rest, "/")
+		if len(code) != totpDigits || app.SecretPathExact && remainder != "" {
+			continue
+		}
+		if _, valid := validTOTPCode(app.TOTPKey, code, time.Now()); valid {
+			return base + code, true
+		}
+	}
+	return "", false
+}
+
+// claimTOTPCode marks the code at the end of a TOTP knock path as used, so the
+// same code can't be replayed within its validity window. It reports false if
+// the code was already used. Redis errors fail closed.
+func claimTOTPCode(ctx context.Context, app *AppConfig, knockPath string) bool {
+	if !app.TOTPRejectReplay {
+		return true
+	}
+	code := knockPath[strings.LastIndex(knockPath, "/")+1:]
+	counter, valid := validTOTPCode(app.TOTPKey, code, time.Now())
+	if !valid {
+		return false
+	}
+
+	markerKey := appKey(app, "totp:%d", counter)
+	claimed, err := redisClient.SetNX(ctx, markerKey, "1", (2*totpSkew+1)*totpStep).Result()
+	if err != nil {
+		app.errorf("Redis error: %v", err)
+		return false
+	}
+	return claimed
+}
+
+// currentTOTPPath returns the knock path that is valid right now, for testing.
+func currentTOTPPath(app *AppConfig) string {
+	return strings.TrimSuffix(app.SecretPathPrefixes[0], "/") + "/" + totpCode(app.TOTPKey, totpCounter(time.Now()))
+}
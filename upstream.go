@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Context key of the proxiedRequest a request is forwarded as
+type proxiedRequestKey struct{}
+
+// proxiedRequest is what the proxy needs to know of a request: its app, which
+// may be a copy of a wildcard app, and its resolved client IP.
+type proxiedRequest struct {
+	app      *AppConfig
+	clientIP string
+}
+
+// forwarded_headers policies, for the forwarding headers a request reaches its
+// upstream with
+const (
+	// Only those mithrandir sets, from the resolved client IP
+	forwardedHeadersStrip = "strip"
+	// Those of a trusted peer, with the peer appended; an untrusted one's are
+	// dropped
+	forwardedHeadersAppend = "append"
+	// The client's, whoever sent them, with the peer appended to X-Forwarded-For
+	forwardedHeadersPreserve = "preserve"
+)
+
+// The placeholders of request_headers, replaced for each request
+var requestHeaderPlaceholders = []string{"client_ip", "hostname"}
+
+// Headers request_headers can't set, as the proxy and its transport manage
+// them
+var reservedRequestHeaders = []string{"Connection", "Content-Length", "Host", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// The forwarding headers ReverseProxy drops from a request before
+// rewriteUpstreamRequest
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// upstreamOptions are the settings an upstream transport is built with.
+// Apps with the same ones share a transport, and so its idle connections.
+type upstreamOptions struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	// Of the transport's pool: idle connections kept in all and per host,
+	// and for how long, and the connections per host (0 = no limit)
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	maxConnsPerHost     int
+	// Whether HTTP/2 is negotiated with https upstreams that offer it
+	http2 bool
+}
+
+var (
+	// The UPSTREAM_* defaults of the apps' upstream settings
+	defaultUpstream        upstreamOptions
+	defaultUpstreamTimeout time.Duration
+
+	upstreamTransportsMu sync.Mutex
+	// Kept across reloads, so apps whose options don't change keep their
+	// connections
+	upstreamTransports = make(map[upstreamOptions]*http.Transport)
+)
+
+// upstreamSetting is an upstream setting and where its value goes: a
+// *time.Duration, *int or *bool.
+type upstreamSetting struct {
+	name  string
+	value any
+}
+
+// upstreamSettings returns the upstream settings, going into the given
+// options and overall timeout.
+func upstreamSettings(options *upstreamOptions, timeout *time.Duration) []upstreamSetting {
+	return []upstreamSetting{
+		{"upstream_dial_timeout", &options.dialTimeout},
+		{"upstream_tls_handshake_timeout", &options.tlsHandshakeTimeout},
+		{"upstream_response_header_timeout", &options.responseHeaderTimeout},
+		{"upstream_timeout", timeout},
+		{"upstream_max_idle_conns", &options.maxIdleConns},
+		{"upstream_max_idle_conns_per_host", &options.maxIdleConnsPerHost},
+		{"upstream_idle_conn_timeout", &options.idleConnTimeout},
+		{"upstream_max_conns_per_host", &options.maxConnsPerHost},
+		{"upstream_http2", &options.http2},
+	}
+}
+
+// parse sets the setting from its string form; durations and numbers can't
+// be negative.
+func (setting upstreamSetting) parse(raw string) error {
+	var err error
+	switch value := setting.value.(type) {
+	case *time.Duration:
+		if *value, err = time.ParseDuration(raw); err == nil && *value < 0 {
+			err = errors.New("negative")
+		}
+	case *int:
+		if *value, err = strconv.Atoi(raw); err == nil && *value < 0 {
+			err = errors.New("negative")
+		}
+	case *bool:
+		*value, err = strconv.ParseBool(raw)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", setting.name, raw)
+	}
+	return nil
+}
+
+// loadUpstreamDefaults reads the global UPSTREAM_* settings, the defaults of
+// the apps' upstream settings.
+func loadUpstreamDefaults() error {
+	for _, option := range upstreamSettings(&defaultUpstream, &defaultUpstreamTimeout) {
+		option.name = strings.ToUpper(option.name)
+		if err := option.parse(setting(option.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseUpstreamSettings reads the upstream settings of an app, defaulting to
+// the global ones, and builds its proxy.
+func parseUpstreamSettings(app *AppConfig, config map[string]string) error {
+	app.upstream = defaultUpstream
+	app.UpstreamTimeout = defaultUpstreamTimeout
+	for _, option := range upstreamSettings(&app.upstream, &app.UpstreamTimeout) {
+		if raw := config[option.name]; raw != "" {
+			if err := option.parse(raw); err != nil {
+				return err
+			}
+		}
+	}
+
+	tlsConfig, err := parseUpstreamTLS(app, config)
+	if err != nil {
+		return err
+	}
+	switch host := config["upstream_host"]; host {
+	case "", "preserve":
+	case "upstream":
+		app.UpstreamHost = app.UpstreamURL.Host
+	default:
+		if parsed, err := url.Parse("http://" + host); err != nil || parsed.Host != host || parsed.Hostname() == "" {
+			return fmt.Errorf("invalid upstream_host: %s (expected preserve, upstream or a host[:port])", host)
+		}
+		app.UpstreamHost = host
+	}
+	switch app.ForwardedHeaders = strings.ToLower(defaultString(config["forwarded_headers"], forwardedHeadersAppend)); app.ForwardedHeaders {
+	case forwardedHeadersStrip, forwardedHeadersAppend, forwardedHeadersPreserve:
+	default:
+		return fmt.Errorf("invalid forwarded_headers: %s (expected strip, append or preserve)", config["forwarded_headers"])
+	}
+	if app.RequestHeaders, err = parseRequestHeaders(config["request_headers"]); err != nil {
+		return err
+	}
+
+	app.Proxy = &httputil.ReverseProxy{Rewrite: rewriteUpstreamRequest, ErrorHandler: proxyError}
+	if tlsConfig != nil {
+		// Its own, as the files are read again whenever the app is
+		app.Proxy.Transport = newUpstreamTransport(app.upstream, tlsConfig)
+	} else {
+		app.Proxy.Transport = upstreamTransport(app.upstream)
+	}
+	return nil
+}
+
+// rewriteUpstreamRequest points a request at its app's upstream, with the
+// Host header of upstream_host, keeping the client's otherwise, and the
+// forwarding headers of forwarded_headers.
+func rewriteUpstreamRequest(proxyRequest *httputil.ProxyRequest) {
+	proxied := proxyRequest.In.Context().Value(proxiedRequestKey{}).(*proxiedRequest)
+	proxyRequest.SetURL(proxied.app.UpstreamURL)
+	proxyRequest.Out.Host = defaultString(proxied.app.UpstreamHost, proxyRequest.In.Host)
+	setForwardedHeaders(proxyRequest, proxied.app, proxied.clientIP)
+	setRequestHeaders(proxyRequest.Out, proxied)
+}
+
+// setForwardedHeaders sets the X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and X-Real-IP headers of a request to the upstream, and
+// Forwarded when it's passed on, as the app's forwarded_headers has it. Only
+// a peer the app takes client IP headers from is believed about the protocol
+// and host; otherwise they're those of the request mithrandir received.
+func setForwardedHeaders(proxyRequest *httputil.ProxyRequest, app *AppConfig, clientIP string) {
+	in, out := proxyRequest.In, proxyRequest.Out
+	peer := normalizeIP(in.RemoteAddr)
+	if app.ForwardedHeaders == forwardedHeadersPreserve {
+		for _, name := range forwardingHeaders {
+			if values := in.Header.Values(name); len(values) > 0 {
+				out.Header[name] = values
+			}
+		}
+		if peer != "" {
+			out.Header.Set("X-Forwarded-For", strings.Join(append(slices.Clone(in.Header.Values("X-Forwarded-For")), peer), ", "))
+		}
+		if app.UpstreamHost != "" {
+			// So the upstream can still tell the public URL
+			out.Header.Set("X-Forwarded-Host", in.Host)
+		}
+		return
+	}
+
+	trusted := trustsPeer(app, peer)
+	// The others, like X-Forwarded-Port or X-Forwarded-Prefix, are only
+	// passed on from trusted proxies, and never in strip mode
+	if !trusted || app.ForwardedHeaders == forwardedHeadersStrip {
+		for name := range out.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-forwarded-") {
+				delete(out.Header, name)
+			}
+		}
+	}
+	if trusted && app.ForwardedHeaders == forwardedHeadersAppend {
+		if values := in.Header.Values("Forwarded"); len(values) > 0 {
+			out.Header["Forwarded"] = values
+		}
+		out.Header.Set("X-Forwarded-For", strings.Join(append(slices.Clone(in.Header.Values("X-Forwarded-For")), peer), ", "))
+	} else {
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	proto, host := "http", in.Host
+	if in.TLS != nil {
+		proto = "https"
+	}
+	if trusted {
+		proto = defaultString(strings.TrimSpace(strings.Split(in.Header.Get("X-Forwarded-Proto"), ",")[0]), proto)
+		host = defaultString(strings.TrimSpace(strings.Split(in.Header.Get("X-Forwarded-Host"), ",")[0]), host)
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", host)
+	out.Header.Set("X-Real-IP", clientIP)
+}
+
+// parseUpstreamTLS reads the upstream_tls settings of an app with an https
+// upstream, returning nil if it has none, to use the system roots.
+func parseUpstreamTLS(app *AppConfig, config map[string]string) (*tls.Config, error) {
+	names := []string{"upstream_tls_ca_file", "upstream_tls_cert_file", "upstream_tls_key_file", "upstream_tls_insecure_skip_verify"}
+	if !slices.ContainsFunc(names, func(name string) bool { return config[name] != "" }) {
+		return nil, nil
+	}
+	if app.UpstreamURL.Scheme != "https" {
+		for _, name := range names {
+			if config[name] != "" {
+				return nil, fmt.Errorf("%s requires an https upstream_url", name)
+			}
+		}
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := config["upstream_tls_ca_file"]; caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream_tls_ca_file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid upstream_tls_ca_file: no PEM certificates in %s", caFile)
+		}
+	}
+	certFile, keyFile := config["upstream_tls_cert_file"], config["upstream_tls_key_file"]
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("upstream_tls_cert_file and upstream_tls_key_file must be set together")
+	}
+	if certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if skipVerify := config["upstream_tls_insecure_skip_verify"]; skipVerify != "" {
+		var err error
+		if tlsConfig.InsecureSkipVerify, err = strconv.ParseBool(skipVerify); err != nil {
+			return nil, fmt.Errorf("invalid upstream_tls_insecure_skip_verify: %s", skipVerify)
+		}
+	}
+	if tlsConfig.InsecureSkipVerify {
+		app.warnf("upstream_tls_insecure_skip_verify is set: the certificate of %s isn't verified, anyone in between can read and change the traffic", app.UpstreamURL.Host)
+	}
+	return tlsConfig, nil
+}
+
+// parseRequestHeaders parses request_headers, comma-separated Name:value
+// pairs, into the values by canonical header name. The values aren't part of
+// the errors, as they may be secrets.
+func parseRequestHeaders(raw string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, ":")
+		if name = strings.TrimSpace(name); !found || !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid request_headers: %q (expected Name:value pairs)", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		switch {
+		case name == "Host":
+			return nil, fmt.Errorf("request_headers can't set Host, use upstream_host")
+		case slices.Contains(reservedRequestHeaders, name):
+			return nil, fmt.Errorf("request_headers can't set %s", name)
+		case headers[name] != "":
+			return nil, fmt.Errorf("request_headers sets %s twice", name)
+		}
+		if value = strings.TrimSpace(value); value == "" || strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("invalid request_headers: %s needs a value on one line", name)
+		}
+		headers[name] = value
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	return headers, nil
+}
+
+// validHeaderName reports whether name is a header field name, an RFC 9110
+// token.
+func validHeaderName(name string) bool {
+	for _, char := range name {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", char) && (char < '0' || char > '9') && (char < 'A' || char > 'Z') && (char < 'a' || char > 'z') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// setRequestHeaders sets the app's request_headers on a request to its
+// upstream, replacing any the client sent, with the placeholders filled in.
+func setRequestHeaders(out *http.Request, proxied *proxiedRequest) {
+	if len(proxied.app.RequestHeaders) == 0 {
+		return
+	}
+	placeholders := strings.NewReplacer("${client_ip}", proxied.clientIP, "${hostname}", proxied.app.requestHost())
+	for name, value := range proxied.app.RequestHeaders {
+		out.Header.Set(name, placeholders.Replace(value))
+	}
+}
+
+// upstreamTransport returns the shared transport for upstreams with the
+// given options, creating it the first time.
+func upstreamTransport(options upstreamOptions) *http.Transport {
+	upstreamTransportsMu.Lock()
+	defer upstreamTransportsMu.Unlock()
+	if transport, found := upstreamTransports[options]; found {
+		return transport
+	}
+	transport := newUpstreamTransport(options, nil)
+	upstreamTransports[options] = transport
+	return transport
+}
+
+// releaseUpstreamTransports closes the idle connections of the transports the
+// previous apps used and the next ones don't, like those of replaced apps with
+// upstream_tls settings, and forgets the shared ones no app uses any more.
+// Requests still running on them finish as usual.
+func releaseUpstreamTransports(previous, next map[string]*AppConfig) {
+	inUse := make(map[http.RoundTripper]bool)
+	for _, app := range next {
+		inUse[app.Proxy.Transport] = true
+	}
+	for _, app := range previous {
+		if !inUse[app.Proxy.Transport] {
+			app.Proxy.Transport.(*http.Transport).CloseIdleConnections()
+		}
+	}
+	upstreamTransportsMu.Lock()
+	defer upstreamTransportsMu.Unlock()
+	for options, transport := range upstreamTransports {
+		if !inUse[transport] {
+			delete(upstreamTransports, options)
+		}
+	}
+}
+
+// newUpstreamTransport builds a transport for upstreams, with the system
+// roots unless tlsConfig is given.
+func newUpstreamTransport(options upstreamOptions, tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{Timeout: options.dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = options.tlsHandshakeTimeout
+	transport.ResponseHeaderTimeout = options.responseHeaderTimeout
+	transport.MaxIdleConns = options.maxIdleConns
+	transport.MaxIdleConnsPerHost = options.maxIdleConnsPerHost
+	transport.IdleConnTimeout = options.idleConnTimeout
+	transport.MaxConnsPerHost = options.maxConnsPerHost
+	transport.ForceAttemptHTTP2 = options.http2
+	return transport
+}
+
+func (options upstreamOptions) String() string {
+	connsPerHost := "no limit"
+	if options.maxConnsPerHost > 0 {
+		connsPerHost = strconv.Itoa(options.maxConnsPerHost)
+	}
+	return fmt.Sprintf("dial timeout %s, TLS handshake timeout %s, response header timeout %s; %d idle connections, %d per host, closed after %s idle; connections per host: %s; HTTP/2: %t",
+		options.dialTimeout, options.tlsHandshakeTimeout, options.responseHeaderTimeout,
+		options.maxIdleConns, options.maxIdleConnsPerHost, options.idleConnTimeout, connsPerHost, options.http2)
+}
+
+// proxyError answers a request the upstream failed to: 504 if it timed out,
+// 502 otherwise, with the app's error_page if it has one. Requests the client
+// gave up on are only logged at DEBUG, as there's no one left to answer.
+func proxyError(responseWriter http.ResponseWriter, request *http.Request, err error) {
+	app := request.Context().Value(proxiedRequestKey{}).(*proxiedRequest).app
+	if errors.Is(err, context.Canceled) {
+		app.debugf("Client went away during %s %s to upstream %s: %v", request.Method, logPath(app, request.URL.Path), app.UpstreamURL.Redacted(), err)
+		return
+	}
+
+	status := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		status = http.StatusGatewayTimeout
+	}
+	app.errorf("Upstream %s failed for %s %s, answering %d: %v", app.UpstreamURL.Redacted(), request.Method, logPath(app, request.URL.Path), status, err)
+
+	data := map[string]any{"Hostname": app.requestHost(), "Status": status}
+	if app.ErrorPage == nil || !writeTemplate(responseWriter, app.ErrorPage, status, data) {
+		http.Error(responseWriter, http.StatusText(status), status)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingUpstream starts an upstream for the test, answering requests with
+// handler, or with 200 ok, and counts the connections opened to it.
+func countingUpstream(t testing.TB, handler http.HandlerFunc) (*httptest.Server, *atomic.Int64) {
+	if handler == nil {
+		handler = func(responseWriter http.ResponseWriter, request *http.Request) {
+			responseWriter.Write([]byte("ok"))
+		}
+	}
+	var connections atomic.Int64
+	upstream := httptest.NewUnstartedServer(handler)
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, &connections
+}
+
+// useProxiedApp serves an app for upstream with the given extra settings,
+// where 192.0.2.1, the client of httptest requests, has a session.
+func useProxiedApp(t testing.TB, upstream *httptest.Server, settings map[string]string) *AppConfig {
+	t.Helper()
+	config := map[string]string{
+		"hostname":     "app.example.com",
+		"upstream_url": upstream.URL,
+		"secret_path":  "/knock",
+		"session_ttl":  "1h",
+		"log_level":    "warn",
+	}
+	maps.Copy(config, settings)
+	useSessionStore(t, newMemoryStore())
+	app := useApp(t, config)
+	request := httptest.NewRequest(http.MethodGet, "http://app.example.com/knock", nil)
+	if err := grantSession(app, httptest.NewRecorder(), request, "192.0.2.1", "secret_path", app.SessionTTL); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// proxyRequest sends a request from 192.0.2.1 through handleRequest and fails
+// the test unless the upstream answered it.
+func proxyRequest(t testing.TB) {
+	recorder := httptest.NewRecorder()
+	handleRequest(recorder, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "ok" {
+		t.Errorf("got %d %q, want the upstream's 200 ok", recorder.Code, recorder.Body.String())
+	}
+}
+
+// heldUpstream starts a counting upstream whose requests report on arrived
+// and wait for a value on release before answering 200 ok.
+func heldUpstream(t testing.TB) (upstream *httptest.Server, connections *atomic.Int64, arrived, release chan struct{}) {
+	arrived, release = make(chan struct{}), make(chan struct{})
+	upstream, connections = countingUpstream(t, func(responseWriter http.ResponseWriter, request *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		responseWriter.Write([]byte("ok"))
+	})
+	return upstream, connections, arrived, release
+}
+
+// proxyRequests sends count requests through handleRequest at once and
+// returns a function waiting for them to be answered.
+func proxyRequests(t testing.TB, count int) (wait func()) {
+	var requests sync.WaitGroup
+	requests.Add(count)
+	for range count {
+		go func() {
+			defer requests.Done()
+			proxyRequest(t)
+		}()
+	}
+	return requests.Wait
+}
+
+func TestUpstreamKeepAlive(t *testing.T) {
+	upstream, connections := countingUpstream(t, nil)
+	useProxiedApp(t, upstream, nil)
+	for range 20 {
+		proxyRequest(t)
+	}
+	if got := connections.Load(); got != 1 {
+		t.Errorf("20 requests opened %d upstream connections, want 1 kept alive", got)
+	}
+}
+
+func TestUpstreamConnectionPool(t *testing.T) {
+	const concurrent, rounds = 8, 5
+	for _, test := range []struct {
+		idlePerHost string
+		// Over all rounds
+		wantConnections int64
+	}{
+		// Reused in every round
+		{"8", concurrent},
+		// All but 2 closed after every round
+		{"2", concurrent + (concurrent-2)*(rounds-1)},
+	} {
+		t.Run("upstream_max_idle_conns_per_host="+test.idlePerHost, func(t *testing.T) {
+			upstream, connections, arrived, release := heldUpstream(t)
+			useProxiedApp(t, upstream, map[string]string{"upstream_max_idle_conns_per_host": test.idlePerHost})
+			for range rounds {
+				wait := proxyRequests(t, concurrent)
+				// All connections busy at once before any is answered
+				for range concurrent {
+					<-arrived
+				}
+				for range concurrent {
+					release <- struct{}{}
+				}
+				wait()
+				// For the transport to take the connections back
+				time.Sleep(20 * time.Millisecond)
+			}
+			if got := connections.Load(); got != test.wantConnections {
+				t.Errorf("%d rounds of %d requests opened %d upstream connections, want %d", rounds, concurrent, got, test.wantConnections)
+			}
+		})
+	}
+
+	t.Run("upstream_max_conns_per_host=2", func(t *testing.T) {
+		upstream, connections, arrived, release := heldUpstream(t)
+		useProxiedApp(t, upstream, map[string]string{"upstream_max_conns_per_host": "2"})
+		wait := proxyRequests(t, concurrent)
+		// The others wait for one of the two connections
+		for range concurrent {
+			<-arrived
+			release <- struct{}{}
+		}
+		wait()
+		if got := connections.Load(); got != 2 {
+			t.Errorf("%d requests at once opened %d upstream connections, want 2", concurrent, got)
+		}
+	})
+}
+
+// BenchmarkProxy compares the allocations of proxying a request with the
+// app's proxy, built once, with those of building the same proxy for every
+// request, on the shared transport or a new one. It's the transport that
+// must be kept: upstream-conns/op shows whether connections are reused.
+func BenchmarkProxy(b *testing.B) {
+	for _, build := range []string{"once", "per request", "with a transport per request"} {
+		b.Run("built "+build, func(b *testing.B) {
+			upstream, connections := countingUpstream(b, nil)
+			app := useProxiedApp(b, upstream, nil)
+			ctx := context.WithValue(context.Background(), proxiedRequestKey{}, &proxiedRequest{app: app, clientIP: "192.0.2.1"})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				proxy := app.Proxy
+				switch build {
+				case "per request":
+					proxy = &httputil.ReverseProxy{Rewrite: rewriteUpstreamRequest, ErrorHandler: proxyError, Transport: app.Proxy.Transport}
+				case "with a transport per request":
+					proxy = &httputil.ReverseProxy{Rewrite: rewriteUpstreamRequest, ErrorHandler: proxyError, Transport: newUpstreamTransport(app.upstream, nil)}
+				}
+				recorder := httptest.NewRecorder()
+				proxy.ServeHTTP(recorder, httptest.NewRequestWithContext(ctx, http.MethodGet, "http://app.example.com/", nil))
+				if recorder.Code != http.StatusOK {
+					b.Fatalf("upstream answered %d", recorder.Code)
+				}
+				if proxy.Transport != app.Proxy.Transport {
+					proxy.Transport.(*http.Transport).CloseIdleConnections()
+				}
+			}
+			b.ReportMetric(float64(connections.Load())/float64(b.N), "upstream-conns/op")
+		})
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	spoofed := http.Header{
+		"X-Forwarded-For":    {"6.6.6.6, 5.5.5.5"},
+		"X-Forwarded-Proto":  {"https"},
+		"X-Forwarded-Host":   {"evil.example.com"},
+		"Forwarded":          {"for=6.6.6.6"},
+		"X-Real-Ip":          {"6.6.6.6"},
+		"X-Forwarded-Port":   {"6666"},
+		"X-Forwarded-Prefix": {"/evil"},
+		"X-Forwarded-Server": {"evil.example.com"},
+		"X-Forwarded-Ssl":    {"on"},
+	}
+	// The X-Forwarded-* headers mithrandir doesn't set itself, as spoofed
+	passedOn := map[string]string{"X-Forwarded-Port": "6666", "X-Forwarded-Prefix": "/evil", "X-Forwarded-Server": "evil.example.com", "X-Forwarded-Ssl": "on"}
+	dropped := map[string]string{"X-Forwarded-Port": "", "X-Forwarded-Prefix": "", "X-Forwarded-Server": "", "X-Forwarded-Ssl": ""}
+	trustedProxy := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name           string
+		mode           string
+		remoteAddr     string
+		trustedProxies []netip.Prefix
+		upstreamHost   string
+		// Of the request to the upstream, "" for absent
+		want map[string]string
+		// The headers of passedOn, or dropped
+		others map[string]string
+	}{
+		{
+			name: "append from an untrusted client", mode: forwardedHeadersAppend, remoteAddr: "192.0.2.1:51234", others: dropped,
+			want: map[string]string{"X-Forwarded-For": "192.0.2.1", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "app.example.com", "X-Real-Ip": "192.0.2.1", "Forwarded": ""},
+		},
+		{
+			name: "append from a trusted proxy", mode: forwardedHeadersAppend, remoteAddr: "10.0.0.2:51234", trustedProxies: trustedProxy, others: passedOn,
+			want: map[string]string{"X-Forwarded-For": "6.6.6.6, 5.5.5.5, 10.0.0.2", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com", "X-Real-Ip": "6.6.6.6", "Forwarded": "for=6.6.6.6"},
+		},
+		{
+			name: "strip from an untrusted client", mode: forwardedHeadersStrip, remoteAddr: "192.0.2.1:51234", others: dropped,
+			want: map[string]string{"X-Forwarded-For": "192.0.2.1", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "app.example.com", "X-Real-Ip": "192.0.2.1", "Forwarded": ""},
+		},
+		{
+			name: "strip from a trusted proxy", mode: forwardedHeadersStrip, remoteAddr: "10.0.0.2:51234", trustedProxies: trustedProxy, others: dropped,
+			want: map[string]string{"X-Forwarded-For": "6.6.6.6", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com", "X-Real-Ip": "6.6.6.6", "Forwarded": ""},
+		},
+		{
+			name: "preserve from an untrusted client", mode: forwardedHeadersPreserve, remoteAddr: "192.0.2.1:51234", others: passedOn,
+			want: map[string]string{"X-Forwarded-For": "6.6.6.6, 5.5.5.5, 192.0.2.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com", "X-Real-Ip": "6.6.6.6", "Forwarded": "for=6.6.6.6"},
+		},
+		{
+			name: "preserve with upstream_host", mode: forwardedHeadersPreserve, remoteAddr: "192.0.2.1:51234", upstreamHost: "app.internal", others: passedOn,
+			want: map[string]string{"X-Forwarded-For": "6.6.6.6, 5.5.5.5, 192.0.2.1", "X-Forwarded-Host": "app.example.com"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := &AppConfig{
+				Hostname:         "app.example.com",
+				ForwardedHeaders: test.mode,
+				UpstreamHost:     test.upstreamHost,
+				IPFromHeaders:    true,
+				IPHeaders:        defaultIPHeaders,
+				TrustedProxies:   test.trustedProxies,
+			}
+			in := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			in.RemoteAddr = test.remoteAddr
+			for name, values := range spoofed {
+				in.Header[name] = values
+			}
+			// As ReverseProxy hands it to Rewrite
+			out := in.Clone(in.Context())
+			for _, name := range forwardingHeaders {
+				out.Header.Del(name)
+			}
+
+			setForwardedHeaders(&httputil.ProxyRequest{In: in, Out: out}, app, clientIP(in, app))
+			for name, want := range test.others {
+				if got := out.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range test.want {
+				if got := out.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
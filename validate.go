@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// printValidation prints what -validate found: a summary of each app, which
+// went through the same loading and checks as at startup. Secrets are never
+// printed, only which knock methods are set up; values derived from them,
+// like the secret paths, are masked by redactedAppValue.
+func printValidation(apps map[string]*AppConfig) {
+	fmt.Printf("Configuration is valid: %d apps\n", len(sortedHostnames(apps)))
+	for _, hostname := range sortedHostnames(apps) {
+		fmt.Println()
+		for _, line := range describeApp(apps[hostname]) {
+			fmt.Println(line)
+		}
+	}
+}
+
+// describeApp returns the summary of an app printed by -validate.
+func describeApp(app *AppConfig) []string {
+	lines := []string{fmt.Sprintf("%s -> %s", app.Hostname, redactedAppValue("upstream_url", app.UpstreamURL.String()))}
+	detail := func(label string, values []string) {
+		if len(values) > 0 {
+			lines = append(lines, fmt.Sprintf("  %s: %s", label, strings.Join(values, ", ")))
+		}
+	}
+	detail("aliases", app.Aliases)
+
+	secretPaths := "secret path " + redactedAppValue("secret_path", strings.Join(app.SecretPathPrefixes, ", "))
+	switch {
+	case app.TOTPKey != nil:
+		secretPaths += " + TOTP code"
+	case app.RotationSeed != nil:
+		secretPaths += fmt.Sprintf(" + segment rotating every %s", app.RotationInterval)
+	case app.SecretPathExact:
+		secretPaths += " (exact)"
+	}
+	knocks := []string{secretPaths}
+	if app.OncePath != "" {
+		knocks = append(knocks, "one-time links below "+app.OncePath)
+	}
+	if app.SecretQueryName != "" {
+		knocks = append(knocks, "query parameter "+app.SecretQueryName)
+	}
+	if app.KnockHeader != "" {
+		knocks = append(knocks, "header "+app.KnockHeader)
+	}
+	if app.SigningKey != nil {
+		knocks = append(knocks, "signed links at "+app.SignedPath)
+	}
+	if app.EmailPath != "" {
+		knocks = append(knocks, fmt.Sprintf("email links at %s for %d addresses", app.EmailPath, len(app.AllowedEmails)))
+	}
+	detail("knock", knocks)
+	var conditions []string
+	if app.ConfirmKnock {
+		conditions = append(conditions, "confirmed with a POST")
+	}
+	if app.KnockPassphrase != nil {
+		conditions = append(conditions, "passphrase")
+	}
+	if app.KnockUserAgentRegex != nil {
+		conditions = append(conditions, "user agents matching "+app.KnockUserAgentRegex.String())
+	}
+	detail("knocks need", conditions)
+
+	sessions := []string{app.SessionMode + " sessions", "ttl " + app.SessionTTL.String()}
+	if app.AutoRenew {
+		sessions = append(sessions, "renewed")
+	}
+	if app.MaxSessionAge > 0 {
+		sessions = append(sessions, "max age "+app.MaxSessionAge.String())
+	}
+	if app.MaxSessions > 0 {
+		sessions = append(sessions, fmt.Sprintf("at most %d", app.MaxSessions))
+	}
+	if app.SessionGroup != "" {
+		sessions = append(sessions, "session group "+app.SessionGroup)
+	} else if app.ShareSessions {
+		sessions = append(sessions, "shared by the hostnames it matches")
+	} else if isWildcardHostname(app.Hostname) {
+		sessions = append(sessions, "kept per hostname")
+	}
+	if len(app.PreauthorizedIPs) > 0 {
+		sessions = append(sessions, fmt.Sprintf("%d preauthorized IPs", len(app.PreauthorizedIPs)))
+	}
+	logoutPath := app.LogoutPath
+	if app.config["logout_path"] == "" {
+		// Below the secret path
+		logoutPath = redactedAppValue("secret_path", strings.TrimSuffix(app.SecretPathPrefixes[0], "/")) + "/logout"
+	}
+	sessions = append(sessions, "logout at "+logoutPath, "store failure "+app.StoreFailure)
+	detail("sessions", sessions)
+
+	var paths []string
+	if len(app.PublicPaths) > 0 {
+		paths = append(paths, "public "+strings.Join(app.PublicPaths, " "))
+	}
+	if len(app.ProtectedPaths) > 0 {
+		paths = append(paths, "only protected "+strings.Join(app.ProtectedPaths, " "))
+	}
+	detail("paths", paths)
+
+	var access []string
+	if len(app.AllowIPs) > 0 {
+		access = append(access, fmt.Sprintf("%d allowed IP rules", len(app.AllowIPs)))
+	}
+	if len(app.BlockIPs) > 0 {
+		access = append(access, fmt.Sprintf("%d blocked IP rules", len(app.BlockIPs)))
+	}
+	if app.AllowPrivate {
+		access = append(access, "private IPs allowed")
+	}
+	if len(app.AllowCountries) > 0 {
+		access = append(access, fmt.Sprintf("%d allowed countries", len(app.AllowCountries)))
+	}
+	if len(app.DenyCountries) > 0 {
+		access = append(access, fmt.Sprintf("%d denied countries", len(app.DenyCountries)))
+	}
+	if len(app.AllowASNs) > 0 {
+		access = append(access, fmt.Sprintf("%d allowed ASNs", len(app.AllowASNs)))
+	}
+	if app.RateLimiter != nil {
+		access = append(access, "rate limited")
+	}
+	if app.BanThreshold > 0 {
+		access = append(access, fmt.Sprintf("banned for %s after %d denials in %s", app.BanDuration, app.BanThreshold, app.BanWindow))
+	}
+	if app.DenyRedirectURL != nil {
+		access = append(access, "denied with a redirect to "+redactedAppValue("deny_redirect_url", app.DenyRedirectURL.String()))
+	} else {
+		access = append(access, fmt.Sprintf("denied with %d", app.DenyStatus))
+	}
+	detail("access", access)
+	return lines
+}
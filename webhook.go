@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// grantEvent is the JSON payload POSTed to grant webhooks.
+type grantEvent struct {
+	Event      string    `json:"event"`
+	Hostname   string    `json:"hostname"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Timestamp  time.Time `json:"timestamp"`
+	TTLSeconds int64     `json:"ttl_seconds"`
+}
+
+// notifyGrant reports a granted session to the app's grant webhook in the
+// background, so the client's response is never delayed. Delivery is retried
+// a couple of times; failures are only logged.
+func notifyGrant(app *AppConfig, ip, userAgent string, ttl time.Duration) {
+	if app.GrantWebhookURL == nil {
+		return
+	}
+	payload, err := json.Marshal(grantEvent{
+		Event:      "grant",
+		Hostname:   app.requestHost(),
+		IP:         ip,
+		UserAgent:  userAgent,
+		Timestamp:  time.Now().UTC(),
+		TTLSeconds: int64(ttl.Seconds()),
+	})
+	if err != nil {
+		app.warnf("Failed to encode grant webhook payload: %v", err)
+		return
+	}
+	go postWebhook(app, app.GrantWebhookURL.String(), payload)
+}
+
+// knockLimitEvent is POSTed to the grant webhook when a knock limit is reached.
+type knockLimitEvent struct {
+	Event     string    `json:"event"`
+	Hostname  string    `json:"hostname"`
+	Limit     string    `json:"limit"`
+	Count     int       `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// notifyKnockLimit reports a reached knock limit to the app's grant webhook in
+// the background.
+func notifyKnockLimit(app *AppConfig, kind string, count int) {
+	if app.GrantWebhookURL == nil {
+		return
+	}
+	payload, err := json.Marshal(knockLimitEvent{
+		Event:     "knock_limit",
+		Hostname:  app.Hostname,
+		Limit:     kind,
+		Count:     count,
+		Timestamp: time.Now().UTC(),
+	})
+	if err != nil {
+		app.warnf("Failed to encode knock limit webhook payload: %v", err)
+		return
+	}
+	go postWebhook(app, app.GrantWebhookURL.String(), payload)
+}
+
+func postWebhook(app *AppConfig, webhookURL string, payload []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		var response *http.Response
+		response, err = webhookClient.Post(webhookURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			return
+		}
+		err = fmt.Errorf("unexpected status %s", response.Status)
+	}
+	app.warnf("Failed to deliver webhook after %d attempts: %v", webhookAttempts, err)
+}